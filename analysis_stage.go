@@ -19,7 +19,10 @@ var getChanges = getChangesSync
 // modified, and deleted files.
 func dryRunStage(ctx *context) (syncResult, error) {
 	log.Print("Beginning dry run stage.")
-	r := syncResult{}
+	r := syncResult{
+		sizes:    make(map[string]int),
+		filtered: make(map[string]filterDecision),
+	}
 
 	// Dry runs
 	for _, folder := range ctx.syncFolders {
@@ -30,11 +33,18 @@ func dryRunStage(ctx *context) (syncResult, error) {
 		r.newF = append(r.newF, resp.newF...)
 		r.modified = append(r.modified, resp.modified...)
 		r.deleted = append(r.deleted, resp.deleted...)
+		for k, v := range resp.sizes {
+			r.sizes[k] = v
+		}
+		for k, v := range resp.filtered {
+			r.filtered[k] = v
+		}
 	}
 	sort.Strings(r.newF)
 	sort.Strings(r.modified)
 	sort.Strings(r.deleted)
 
+	logFilterDecisions(r.filtered)
 	log.Print("Done with dry run...\nParsing changes...")
 	log.Printf("New on remote: %s", r.newF)
 	log.Printf("Modified on remote: %s", r.modified)
@@ -57,12 +67,21 @@ func getChangesSync(ctx *context, folder syncFolder) (syncResult,
 	if err != nil {
 		return res, handle("Error in getting filtered list of files", err)
 	}
-	newState, err := getCurrentState(folderSet, toInspect)
+	newState, err := getCurrentState(ctx, folderSet, toInspect)
 	if err != nil {
 		return res, handle("Error in getting current directory state.", err)
 	}
+	// Dropped files are left as they are on the bucket.
+	filtered := filterFiles(folder, newState)
+	for name, decision := range filtered {
+		if !decision.kept {
+			delete(newState, name)
+			delete(pastState, name)
+		}
+	}
 	combinedNames := combineNames(pastState, newState)
 	res = fileChangeLogic(pastState, newState, combinedNames)
+	res.filtered = filtered
 	return res, err
 }
 
@@ -75,10 +94,17 @@ func getFilteredSet(ctx *context, folder syncFolder) (*set.Set, *set.Set,
 	folderSet := set.New()
 	template := "rsync -arzvn --inplace --itemize-changes --delete --no-motd " +
 		"--copy-links --prune-empty-dirs"
+	if ctx.src.password != "" {
+		passFile, err := writeCredentialsFile(ctx, "rsync", ctx.src.password)
+		if err != nil {
+			return toInspect, folderSet, handle("Couldn't write password file.", err)
+		}
+		template += " --password-file=" + passFile
+	}
 	for _, flag := range folder.flags {
 		template += " --" + flag
 	}
-	source := "rsync://" + ctx.server + folder.sourcePath + "/"
+	source := rsyncSource(ctx, folder.sourcePath)
 	tmp := ctx.local + "/synctmp"
 	cmd := fmt.Sprintf("%s %s %s", template, source, tmp)
 	if err := ctx.os.MkdirAll(tmp, os.ModePerm); err != nil {
@@ -102,53 +128,65 @@ func getPreviousState(ctx *context, folder syncFolder) (map[string]fInfo,
 	// Get listing from S3 and last modtimes. Represents the previous state of
 	// the directory.
 	pastState := make(map[string]fInfo)
-	svc := ctx.svcS3
-	path := folder.sourcePath[1:] // Remove leading forward slash
-	input := &s3.ListObjectsInput{
-		Bucket: aws.String(ctx.bucket),
-		Prefix: aws.String(path),
-	}
-	response := []*s3.Object{}
-	err := svc.ListObjectsPages(input,
-		func(page *s3.ListObjectsOutput, lastPage bool) bool {
-			response = append(response, page.Contents...)
-			return true
-		})
+	response, err := listObjects(ctx, objectKey(ctx, folder.sourcePath))
 	if err != nil {
 		return pastState, handle("Error in getting listing of existing files.", err)
 	}
 
-	var modTime string
+	if len(response) == 0 {
+		return pastState, err
+	}
+	// Load the modified times of the whole folder at once.
+	modTimes, err := dbModTimes(ctx, folder.sourcePath)
+	if err != nil {
+		return pastState, handle("Error in getting db modTimes.", err)
+	}
+
+	base := currentKeyBase(ctx, folder)
 	for _, val := range response {
-		name := "/" + *val.Key
+		name := "/" + strings.TrimPrefix(*val.Key, base)
 		size := int(*val.Size)
 		if size == 0 {
 			continue
 		}
-		modTime, err = dbGetModTime(ctx, name)
-		if err != nil {
-			errOut("Error in getting db modTime", err)
-			modTime = ""
+		modTime, present := modTimes[name]
+		if !present {
+			log.Print("No entries found for: " + name)
 		}
 		pastState[name] = fInfo{name, modTime, size}
 	}
 	return pastState, err
 }
 
+// listObjects lists all the objects under a key prefix on the bucket.
+func listObjects(ctx *context, prefix string) ([]*s3.Object, error) {
+	input := &s3.ListObjectsInput{
+		Bucket: aws.String(ctx.bucket),
+		Prefix: aws.String(prefix),
+	}
+	response := []*s3.Object{}
+	err := ctx.svcS3.ListObjectsPages(input,
+		func(page *s3.ListObjectsOutput, lastPage bool) bool {
+			response = append(response, page.Contents...)
+			return true
+		})
+	return response, err
+}
+
 // getCurrentState gets a representation of the current state of the folder to
 // sync on the remote server. Gets the file listing and metadata via FTP.
 // Returns a map of the file path names to fInfo metadata structs.
-func getCurrentState(folderSet *set.Set, toInspect *set.Set) (map[string]fInfo,
-	error) {
+func getCurrentState(ctx *context, folderSet *set.Set,
+	toInspect *set.Set) (map[string]fInfo, error) {
 	res := make(map[string]fInfo)
 
 	// Open FTP connection
-	client, err := connectToServer()
+	client, err := connectToServer(ctx)
 	if err != nil {
 		return res, handle("Error in connecting to FTP server.", err)
 	}
 	defer func() {
-		if err = client.Quit(); err != nil {
+		if err = quitServer(client); err != nil {
 			errOut("Error in quitting client", err)
 		}
 	}()
@@ -199,6 +237,7 @@ func combineNames(pastState map[string]fInfo,
 func fileChangeLogic(pastState map[string]fInfo, newState map[string]fInfo,
 	names []string) syncResult {
 	var n, m, d []string // New, modified, deleted
+	sizes := make(map[string]int)
 	for _, f := range names {
 		past, inPast := pastState[f]
 		cur, inCurrent := newState[f]
@@ -221,5 +260,8 @@ func fileChangeLogic(pastState map[string]fInfo, newState map[string]fInfo,
 			}
 		}
 	}
-	return syncResult{n, m, d}
+	for _, f := range append(n, m...) {
+		sizes[f] = newState[f].size
+	}
+	return syncResult{newF: n, modified: m, deleted: d, sizes: sizes}
 }
@@ -23,7 +23,7 @@ func TestDryRunStage(t *testing.T) {
 	res, _ := dryRunStage(ctx)
 	testServer.WaitRequest()
 	actual := fmt.Sprint(res)
-	expected := "{[] [] []}"
+	expected := "{[] [] [] map[] map[]}"
 	assert.Equal(t, expected, actual)
 }
 
@@ -37,7 +37,7 @@ func TestDryRunStageWithFake(t *testing.T) {
 	defer func() { getChanges = tmp }()
 	res, err := dryRunStage(ctx)
 	assert.Nil(t, err)
-	assert.Equal(t, "{[lemon] [lime] [mango]}", fmt.Sprint(res))
+	assert.Equal(t, "{[lemon] [lime] [mango] map[] map[]}", fmt.Sprint(res))
 }
 
 func TestGetFilteredSet(t *testing.T) {
@@ -115,4 +115,7 @@ func TestFileChangeLogic(t *testing.T) {
 	assert.EqualValues(t, []string{"raisin", "raspberry.md5"}, res.modified)
 	assert.NotContains(t, res.modified, "orange")
 	assert.EqualValues(t, []string{"cucumber"}, res.deleted)
+	assert.Equal(t, 7, res.sizes["honeydew"])
+	assert.Equal(t, 6, res.sizes["raisin"])
+	assert.NotContains(t, res.sizes, "cucumber")
 }
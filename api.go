@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// apiAddr gets the address the API listens on. Defaults to port 80, which
+// the Docker image exposes.
+func apiAddr() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":80"
+}
+
+// serveAPI serves the API alongside the sync daemon.
+func serveAPI(ctx *context, addr string) {
+	log.Print("Serving API on " + addr)
+	errOut("API server stopped", http.ListenAndServe(addr, apiHandler(ctx)))
+}
+
+// apiHandler routes the API endpoints.
+func apiHandler(ctx *context) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealth(ctx, liveness))
+	mux.HandleFunc("/readyz", handleHealth(ctx, readiness))
+	mux.HandleFunc("/diff", func(w http.ResponseWriter, r *http.Request) {
+		handleDiff(ctx, w, r)
+	})
+	mux.HandleFunc("/thaw", func(w http.ResponseWriter, r *http.Request) {
+		handleThaw(ctx, w, r)
+	})
+	return mux
+}
+
+// handleDiff lists the files under a path that differ between two dates or
+// runs. Ex: /diff?path=/pub/taxonomy&from=2017-08-01&to=2017-09-01
+func handleDiff(ctx *context, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	srcCtx, err := contextForSource(ctx, query.Get("source"))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, apiError{err.Error()})
+		return
+	}
+	path := query.Get("path")
+	if path == "" {
+		path = "/"
+	}
+	diffs, err := diffPoints(srcCtx, path, query.Get("from"), query.Get("to"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, diffs)
+}
+
+// handleThaw gets the restore state of a file version and a download link
+// once it is readable. POST starts a restore of a version in cold storage.
+// Ex: /thaw?path=/pub/taxonomy/taxdump.tar.gz&version=3&days=7&tier=Bulk
+func handleThaw(ctx *context, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	srcCtx, err := contextForSource(ctx, query.Get("source"))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, apiError{err.Error()})
+		return
+	}
+	path := query.Get("path")
+	if path == "" {
+		writeJSON(w, http.StatusBadRequest, apiError{"Set a path to thaw."})
+		return
+	}
+	opts := thawOptions{tier: query.Get("tier")}
+	num, _ := strconv.Atoi(query.Get("version"))
+	opts.days, _ = strconv.Atoi(query.Get("days"))
+	res, err := thawVersion(srcCtx, path, num, r.Method == http.MethodPost,
+		opts)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+	status := http.StatusOK
+	if res.Status == restoreStarted {
+		status = http.StatusAccepted
+	}
+	writeJSON(w, status, res)
+}
+
+// An apiError represents an error answered by the API.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// writeJSON answers a request with a value as JSON.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	errOut("Error in writing response", json.NewEncoder(w).Encode(v))
+}
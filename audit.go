@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"log"
+	"sort"
+	"strings"
+)
+
+// An auditReport represents disagreements between the entries table, the
+// current objects, and the archived objects of a source.
+type auditReport struct {
+	untracked  []*s3.Object // Current objects with no active db version
+	missing    []entry      // Versions whose stored copy is missing
+	orphaned   []string     // Archived objects no entry refers to
+	mismatched []sizeChange // Stored copies that differ from the db size
+}
+
+// A sizeChange represents a file version whose stored copy has a different
+// size than recorded.
+type sizeChange struct {
+	version entry
+	key     string
+	actual  int
+}
+
+// issues gets the number of problems found.
+func (r auditReport) issues() int {
+	return len(r.untracked) + len(r.missing) + len(r.orphaned) +
+		len(r.mismatched)
+}
+
+// auditSource compares the entries of the current source's syncFolders with
+// the objects on its bucket.
+func auditSource(ctx *context) (auditReport, error) {
+	res := auditReport{}
+	entries, err := dbEntries(ctx, "/")
+	if err != nil {
+		return res, handle("Error in getting entries.", err)
+	}
+	current, err := listFolderObjects(ctx, func(folder syncFolder) string {
+		return objectKey(ctx, folder.sourcePath)
+	})
+	if err != nil {
+		return res, handle("Error in listing current objects.", err)
+	}
+	archived, err := listFolderObjects(ctx, func(folder syncFolder) string {
+		return folderKey(ctx, folder, layoutBase(layoutOf(folder).archive))
+	})
+	if err != nil {
+		return res, handle("Error in listing archived objects.", err)
+	}
+
+	tracked := make(map[string]bool)
+	referenced := make(map[string]bool)
+	for _, e := range entries {
+		if e.archiveKey != "" && e.versionId == "" {
+			// Archived copies stay referenced after their folder is dropped
+			// from the config.
+			referenced[resolveArchiveKey(ctx, e.archiveKey)] = true
+		}
+		if folderOf(ctx, e.pathName).sourcePath == "" {
+			continue // Not part of a syncFolder
+		}
+		key := objectKey(ctx, e.pathName)
+		var obj *s3.Object
+		switch {
+		case e.archiveKey == "":
+			tracked[key] = true
+			obj = current[key]
+		case e.versionId != "":
+			// Noncurrent versions on a versioned bucket aren't listed.
+			obj, err = headVersion(ctx, e.archiveKey, e.versionId)
+			if err != nil {
+				return res, handle("Error in checking "+e.pathName, err)
+			}
+			key = e.archiveKey
+		default:
+			key = resolveArchiveKey(ctx, e.archiveKey)
+			obj = archived[key]
+		}
+		if obj == nil {
+			res.missing = append(res.missing, e)
+			continue
+		}
+		size := int(aws.Int64Value(obj.Size))
+		if e.size > 0 && size != e.size {
+			res.mismatched = append(res.mismatched, sizeChange{e, key, size})
+		}
+	}
+
+	for _, key := range sortedObjectKeys(current) {
+		// Zero-byte keys are folder placeholders.
+		if !tracked[key] && aws.Int64Value(current[key].Size) > 0 {
+			res.untracked = append(res.untracked, current[key])
+		}
+	}
+	for _, key := range sortedObjectKeys(archived) {
+		if !referenced[key] {
+			res.orphaned = append(res.orphaned, key)
+		}
+	}
+	return res, err
+}
+
+// listFolderObjects lists the objects under a key prefix of every syncFolder
+// of the current source. Folders sharing a prefix are listed once.
+func listFolderObjects(ctx *context,
+	prefixOf func(folder syncFolder) string) (map[string]*s3.Object, error) {
+	res := make(map[string]*s3.Object)
+	listed := make(map[string]bool)
+	for _, folder := range ctx.syncFolders {
+		prefix := prefixOf(folder)
+		if listed[prefix] {
+			continue
+		}
+		listed[prefix] = true
+		objects, err := listObjects(ctx, prefix)
+		if err != nil {
+			return res, handle("Error in listing "+prefix, err)
+		}
+		for _, obj := range objects {
+			res[aws.StringValue(obj.Key)] = obj
+		}
+	}
+	return res, nil
+}
+
+// headVersion gets the size of one version of an object. Returns nil if it
+// doesn't exist.
+func headVersion(ctx *context, key string, versionId string) (*s3.Object,
+	error) {
+	output, err := ctx.svcS3.HeadObject(versionInput(ctx, key, versionId))
+	if err != nil {
+		if strings.Contains(err.Error(), "NotFound") {
+			return nil, nil
+		}
+		return nil, handle("Error in getting "+key, err)
+	}
+	return &s3.Object{Key: aws.String(key), Size: output.ContentLength}, err
+}
+
+// sortedObjectKeys gets the keys of an object listing in order.
+func sortedObjectKeys(objects map[string]*s3.Object) []string {
+	res := []string{}
+	for key := range objects {
+		res = append(res, key)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// printAuditReport writes the problems found as tab-separated lines.
+func printAuditReport(r auditReport) {
+	for _, obj := range r.untracked {
+		fmt.Printf("untracked\t%s\t%d\n", aws.StringValue(obj.Key),
+			aws.Int64Value(obj.Size))
+	}
+	for _, e := range r.missing {
+		fmt.Printf("missing\t%s\tv%d\t%s\n", e.pathName, e.versionNum,
+			e.archiveKey)
+	}
+	for _, key := range r.orphaned {
+		fmt.Printf("orphaned\t%s\n", key)
+	}
+	for _, c := range r.mismatched {
+		fmt.Printf("size\t%s\tv%d\t%s\t%d\t%d\n", c.version.pathName,
+			c.version.versionNum, c.key, c.version.size, c.actual)
+	}
+}
+
+// repairAudit fixes the problems that can be fixed safely. Untracked objects
+// get a db version and entries of missing archived copies are removed.
+// Orphaned archived objects are only deleted with deleteOrphans, and never
+// while any db entry still refers to them. Missing current copies are fetched
+// again by the next sync. Size mismatches need a person to decide which copy
+// is right, so they are only reported. With dryRun, only logs what would be
+// done. Returns the number of repairs that failed.
+func repairAudit(ctx *context, r auditReport, dryRun bool,
+	deleteOrphans bool) int {
+	failed := 0
+	do := func(msg string, fix func() error) {
+		log.Print(msg)
+		if dryRun {
+			return
+		}
+		if err := fix(); err != nil {
+			errOut("Error in repair", err)
+			failed++
+		}
+	}
+
+	cache := make(map[string]map[string]string)
+	base := currentKeyBases(ctx)
+	for _, obj := range r.untracked {
+		key := aws.StringValue(obj.Key)
+		file := fileOfKey(key, base)
+		info := uploadInfo{size: int(aws.Int64Value(obj.Size))}
+		do("Adding db version for "+key, func() error {
+			_, err := dbNewVersion(ctx, file, cache, info)
+			return err
+		})
+	}
+	for _, e := range r.missing {
+		if e.archiveKey == "" {
+			continue
+		}
+		e := e
+		do(fmt.Sprintf("Removing entry of %s v%d", e.pathName, e.versionNum),
+			func() error {
+				return dbDeleteEntry(ctx, e.pathName, e.versionNum)
+			})
+	}
+	for _, key := range r.orphaned {
+		if !deleteOrphans {
+			log.Printf("%d orphaned objects kept. Use -delete-orphans to "+
+				"delete them.", len(r.orphaned))
+			break
+		}
+		key := key
+		do("Deleting orphaned object "+key, func() error {
+			used, err := dbArchiveKeyUsed(ctx, key)
+			if err != nil {
+				return err
+			}
+			if used {
+				log.Printf("Keeping %s. A db entry still refers to it.", key)
+				return err
+			}
+			return deleteObject(ctx, key)
+		})
+	}
+	if len(r.mismatched) > 0 {
+		log.Printf("%d size mismatches need to be checked by hand.",
+			len(r.mismatched))
+	}
+	return failed
+}
+
+// currentKeyBases gets the current key base of each syncFolder by the prefix
+// its objects are listed under.
+func currentKeyBases(ctx *context) map[string]string {
+	res := make(map[string]string)
+	for _, folder := range ctx.syncFolders {
+		res[objectKey(ctx, folder.sourcePath)] = currentKeyBase(ctx, folder)
+	}
+	return res
+}
+
+// fileOfKey gets the file path of a current object key, given the key bases
+// of the folders by their listing prefixes.
+func fileOfKey(key string, bases map[string]string) string {
+	best := ""
+	for prefix := range bases {
+		if strings.HasPrefix(key, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	return "/" + strings.TrimPrefix(key, bases[best])
+}
+
+// runAudit is the audit command. Reports disagreements between the db and
+// the bucket of a source, and optionally repairs them.
+func runAudit(ctx *context, args []string) error {
+	flags, name := newFlagSet("audit")
+	repair := flags.Bool("repair", false, "Repair the problems found.")
+	dryRun := flags.Bool("dry", false, "Only log the repairs that would be "+
+		"done.")
+	deleteOrphans := flags.Bool("delete-orphans", false, "Also delete "+
+		"archived objects no db entry refers to when repairing.")
+	if err := flags.Parse(args); err != nil {
+		return handle("Error in parsing flags.", err)
+	}
+	srcCtx, err := contextForSource(ctx, *name)
+	if err != nil {
+		return handle("Error in finding source.", err)
+	}
+	report, err := auditSource(srcCtx)
+	if err != nil {
+		return handle("Error in auditing source.", err)
+	}
+	printAuditReport(report)
+	log.Printf("Audit found %d untracked, %d missing, %d orphaned, and %d "+
+		"mismatched.", len(report.untracked), len(report.missing),
+		len(report.orphaned), len(report.mismatched))
+	if !*repair && !*dryRun {
+		return err
+	}
+	if failed := repairAudit(srcCtx, report, *dryRun,
+		*deleteOrphans); failed > 0 {
+		return fmt.Errorf("%d repairs failed", failed)
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"testing"
+)
+
+func TestAuditSource(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.bucket = "bucket"
+	ctx.syncFolders = []syncFolder{{sourcePath: "/pub/taxonomy"}}
+	rows := sqlmock.NewRows([]string{"PathName", "VersionNum", "DateModified", "ArchiveKey", "VersionId", "Size", "Md5", "Sha256"}).
+		AddRow("/pub/taxonomy/a", 1, nil, "archive/one", nil, 5, nil, nil).
+		AddRow("/pub/taxonomy/a", 2, nil, nil, nil, 7, nil, nil).
+		AddRow("/pub/taxonomy/b", 1, nil, "archive/missing", nil, nil, nil, nil).
+		AddRow("/other/c", 1, nil, nil, nil, nil, nil, nil).
+		AddRow("/other/c", 2, nil, "archive/dropped", nil, 4, nil, nil)
+	mock.ExpectQuery("select PathName, VersionNum").WithArgs("", "/%").WillReturnRows(rows)
+	testServer.Response(200, nil, "<ListBucketResult>"+
+		"<Contents><Key>pub/taxonomy/a</Key><Size>8</Size></Contents>"+
+		"<Contents><Key>pub/taxonomy/c</Key><Size>3</Size></Contents>"+
+		"<Contents><Key>pub/taxonomy/dir/</Key><Size>0</Size></Contents>"+
+		"</ListBucketResult>")
+	testServer.Response(200, nil, "<ListBucketResult>"+
+		"<Contents><Key>archive/one</Key><Size>5</Size></Contents>"+
+		"<Contents><Key>archive/orphan</Key><Size>2</Size></Contents>"+
+		"<Contents><Key>archive/dropped</Key><Size>4</Size></Contents>"+
+		"</ListBucketResult>")
+
+	res, err := auditSource(ctx)
+	assert.Nil(t, err)
+	testServer.WaitRequests(2)
+	assert.Equal(t, 1, len(res.untracked))
+	assert.Equal(t, "pub/taxonomy/c", aws.StringValue(res.untracked[0].Key))
+	assert.Equal(t, 1, len(res.missing))
+	assert.Equal(t, "/pub/taxonomy/b", res.missing[0].pathName)
+	assert.Equal(t, []string{"archive/orphan"}, res.orphaned)
+	assert.Equal(t, 1, len(res.mismatched))
+	assert.Equal(t, 8, res.mismatched[0].actual)
+	assert.Equal(t, 4, res.issues())
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRepairAudit(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.bucket = "bucket"
+	ctx.syncFolders = []syncFolder{{sourcePath: "/pub/taxonomy"}}
+	tmp := getModTime
+	getModTime = FakeGetModTime
+	defer func() { getModTime = tmp }()
+	report := auditReport{
+		untracked: []*s3.Object{{Key: aws.String("pub/taxonomy/c"), Size: aws.Int64(3)}},
+		missing: []entry{{"/pub/taxonomy/b", 1, "", "archive/missing", "", 0, "", ""},
+			{"/pub/taxonomy/d", 2, "", "", "", 0, "", ""}},
+		orphaned: []string{"archive/orphan", "archive/0123456789abcdef0123456789abcdef"},
+	}
+
+	// Dry runs change nothing.
+	assert.Equal(t, 0, repairAudit(ctx, report, true, true))
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Orphans are kept without deleteOrphans.
+	mock.ExpectQuery("select VersionNum from entries").WithArgs("/pub/taxonomy/c").WillReturnRows(testRows)
+	mock.ExpectExec("insert into entries").WithArgs("/pub/taxonomy/c", 1, "2017-08-02T22:20:26", nil, 3, nil, nil).WillReturnResult(testResult)
+	mock.ExpectExec("delete from entries").WithArgs("/pub/taxonomy/b", 1).WillReturnResult(testResult)
+	assert.Equal(t, 0, repairAudit(ctx, report, false, false))
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	mock.ExpectQuery("select VersionNum from entries").WithArgs("/pub/taxonomy/c").WillReturnRows(testRows)
+	mock.ExpectExec("insert into entries").WithArgs("/pub/taxonomy/c", 1, "2017-08-02T22:20:26", nil, 3, nil, nil).WillReturnResult(testResult)
+	mock.ExpectExec("delete from entries").WithArgs("/pub/taxonomy/b", 1).WillReturnResult(testResult)
+	mock.ExpectQuery("select count").WithArgs("archive/orphan", "archive/orphan").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	// Objects still in the db of another source are kept.
+	mock.ExpectQuery("select count").WithArgs("archive/0123456789abcdef0123456789abcdef", "0123456789abcdef0123456789abcdef").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	testServer.Response(204, nil, "")
+	assert.Equal(t, 0, repairAudit(ctx, report, false, true))
+	req := testServer.WaitRequest()
+	assert.Equal(t, "DELETE", req.Method)
+	assert.Equal(t, "/bucket/archive/orphan", req.URL.Path)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestFileOfKey(t *testing.T) {
+	bases := map[string]string{"pub/a": "", "mirror/current/pub/b": "mirror/current/"}
+	assert.Equal(t, "/pub/a/x", fileOfKey("pub/a/x", bases))
+	assert.Equal(t, "/pub/b/y", fileOfKey("mirror/current/pub/b/y", bases))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A command represents a one-off task run from the command line instead of
+// the sync daemon. Ex: ncbi-tool-sync migrate-versioning -source ebi
+type command struct {
+	usage string
+	run   func(ctx *context, args []string) error
+}
+
+// commands holds the available commands by name.
+var commands = map[string]command{
+	"migrate-versioning": {
+		"Convert archive/ copies into S3 object versions.",
+		runMigrateVersioning},
+	"snapshot": {
+		"Take a named snapshot of the current file versions.",
+		runSnapshot},
+	"list-snapshots": {
+		"List the recorded snapshots.",
+		runListSnapshots},
+	"diff-snapshots": {
+		"List the files that differ between two snapshots.",
+		runDiffSnapshots},
+	"resolve-snapshot": {
+		"List the key of every file version in a snapshot.",
+		runResolveSnapshot},
+	"restore": {
+		"Copy the tree under a path as of a date to a local dir or bucket.",
+		runRestore},
+	"audit": {
+		"Check that the db, current objects, and archive agree.",
+		runAudit},
+	"import": {
+		"Add db entries for objects already on the bucket.",
+		runImport},
+	"diff": {
+		"List the files under a path changed between two dates or runs.",
+		runDiff},
+	"derive": {
+		"Run processors on the files under a path or retry failed runs.",
+		runDerive},
+	"list-derived": {
+		"List the objects derived from each file version.",
+		runListDerived},
+}
+
+// commandArgs gets the command line arguments naming a command, if any.
+// Flags, e.g. from go test, are not commands.
+func commandArgs() []string {
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		return nil
+	}
+	return os.Args[1:]
+}
+
+// runCommand runs the command named by the first argument with the rest of
+// the arguments.
+func runCommand(ctx *context, args []string) error {
+	cmd, present := commands[args[0]]
+	if !present {
+		names := []string{}
+		for name, c := range commands {
+			names = append(names, name+": "+c.usage)
+		}
+		sort.Strings(names)
+		log.Print("Available commands:\n  " + strings.Join(names, "\n  "))
+		return errors.New("Unknown command " + args[0])
+	}
+	log.Print("Running command " + args[0] + "...")
+	return cmd.run(ctx, args[1:])
+}
+
+// newFlagSet makes a flag set for a command with the common -source flag.
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	src := flags.String("source", "", "Name of the source. Optional if "+
+		"there is only one.")
+	return flags, src
+}
+
+// contextForSource gets a context set up for the named source. The name may
+// be empty if there is only one source.
+func contextForSource(ctx *context, name string) (*context, error) {
+	sources := syncSources(ctx)
+	if name == "" && len(sources) == 1 {
+		return sourceContext(ctx, sources[0]), nil
+	}
+	for _, src := range sources {
+		if src.name == name {
+			return sourceContext(ctx, src), nil
+		}
+	}
+	if name == "" {
+		return nil, errors.New("Several sources are configured. Set -source.")
+	}
+	return nil, errors.New("No source named " + name)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRunCommandUnknown(t *testing.T) {
+	_, ctx := testSetup(t)
+	err := runCommand(ctx, []string{"peel"})
+	assert.Equal(t, "Unknown command peel", err.Error())
+}
+
+func TestContextForSource(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.sources = []source{{name: "ncbi"}, {name: "ebi", prefix: "ebi"}}
+	res, err := contextForSource(ctx, "ebi")
+	assert.Nil(t, err)
+	assert.Equal(t, "ebi", res.src.prefix)
+	_, err = contextForSource(ctx, "")
+	assert.NotNil(t, err)
+	_, err = contextForSource(ctx, "ddbj")
+	assert.NotNil(t, err)
+
+	ctx.sources = ctx.sources[:1]
+	res, err = contextForSource(ctx, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "ncbi", res.src.name)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/smallfish/simpleyaml"
@@ -10,6 +11,7 @@ import (
 	"github.com/gosexy/to"
 	"os"
 	"os/user"
+	"strings"
 )
 
 // setupConfig sets up context variables and connections. context is
@@ -33,16 +35,35 @@ func setupConfig(ctx *context) error {
 		msg := "Error in making temp dir. May not have write privileges"
 		return handle(msg, err)
 	}
-	if _, err = ctx.os.Create(ctx.temp + "/testFile"); err != nil {
+	testFile := ctx.temp + "/testFile"
+	f, err := ctx.os.Create(testFile)
+	if err != nil {
 		msg := "Error in making test file. May not have write privileges"
 		return handle(msg, err)
 	}
+	errOut("Error in closing test file", f.Close())
+	if err = ctx.os.Remove(testFile); err != nil {
+		return handle("Error in removing test file.", err)
+	}
+	// Partial downloads from an earlier run would only take up space.
+	if _, err = cleanStaging(ctx); err != nil {
+		errOut("Error in cleaning up staging folder", err)
+	}
+	ctx.temp = instanceStaging(ctx.temp)
+	if err = ctx.os.MkdirAll(ctx.temp, os.ModePerm); err != nil {
+		return handle("Error in making staging dir.", err)
+	}
 
 	ctx.svcS3 = s3.New(session.Must(session.NewSession()))
 
 	if serv := os.Getenv("SERVER"); serv != "" {
 		ctx.server = serv
 	}
+	// Without named sources, the top-level settings form a single source.
+	if len(ctx.sources) == 0 {
+		ctx.sources = []source{defaultSource(ctx)}
+	}
+	ctx.stats = make(map[string]*sourceStats)
 	// Set the region as us-west-2 if absent.
 	if region := os.Getenv("AWS_REGION"); region == "" {
 		if err = os.Setenv("AWS_REGION", "us-west-2"); err != nil {
@@ -65,22 +86,178 @@ func loadConfigFile(ctx *context) {
 		log.Fatal("Error in parsing config. ", err)
 	}
 
+	ctx.limits = loadLimits(yml)
+	ctx.health = loadHealthConfig(yml)
+	ctx.shutdownGrace = loadDuration(yml.Get("shutdown"), "grace",
+		defaultShutdownGrace)
+	ctx.leaseTTL = loadDuration(yml.Get("lock"), "ttl", defaultLeaseTTL)
+	ctx.database = dbConfig{
+		driver: strings.ToLower(optionalString(yml.Get("database"), "driver", "")),
+		path:   optionalString(yml.Get("database"), "path", ""),
+	}
+	if !validDatabase(ctx.database.driver) {
+		log.Fatal("Unknown database " + ctx.database.driver + ".")
+	}
 	var str string
 	if str, err = yml.Get("server").String(); err != nil {
 		log.Print("No server set in config.yaml. Will try to set from env.")
 	} else {
 		ctx.server = str
 	}
+	if yml.Get("sources").IsFound() {
+		// Top-level bucket is only a default for the named sources.
+		ctx.bucket, _ = yml.Get("bucket").String()
+		loadSources(ctx, yml)
+		return
+	}
 	if str, err = yml.Get("bucket").String(); err != nil {
 		log.Fatal("Error in setting bucket. ", err)
 	}
 	ctx.bucket = str
+	ctx.src.protocol = optionalString(yml, "protocol", "ftp")
+	ctx.src.versioning = optionalBool(yml, "versioning", false)
+	ctx.src.streaming = optionalBool(yml, "streaming", false)
+	ctx.src.snapshots = optionalBool(yml, "snapshots", false)
+	ctx.src.manifests = loadManifestFormat(yml)
+	ctx.src.processors = loadProcessors(yml)
+	ctx.src.publishers = loadPublishers(yml)
+	if ctx.src.streaming && !isStreamable(ctx.src.protocol) {
+		log.Fatal("Streaming is not supported over " + ctx.src.protocol + ".")
+	}
+	// With a single source, the top-level caps are its own.
+	ctx.src.limits, ctx.limits = ctx.limits, transferLimits{}
+
+	ctx.syncFolders = loadSyncFolders(yml)
+}
+
+// loadSources loads the named upstream sources from the config file. Each
+// source has its own server, credentials, folders, and destination.
+func loadSources(ctx *context, yml *simpleyaml.Yaml) {
+	size, err := yml.Get("sources").GetArraySize()
+	if err != nil {
+		log.Fatal("Error in loading sources. ", err)
+	}
+	destinations := make(map[string]string)
+	for i := 0; i < size; i++ {
+		item := yml.Get("sources").GetIndex(i)
+		src := source{}
+		if src.name, err = item.Get("name").String(); err != nil {
+			log.Fatal("Error in loading source name. ", err)
+		}
+		if src.server, err = item.Get("server").String(); err != nil {
+			log.Fatal("Error in loading server for source "+src.name+". ", err)
+		}
+		src.bucket = optionalString(item, "bucket", ctx.bucket)
+		if src.bucket == "" {
+			log.Fatal("No bucket set for source " + src.name + ".")
+		}
+		src.prefix = strings.Trim(optionalString(item, "prefix", ""), "/")
+		src.protocol = optionalString(item, "protocol", "ftp")
+		src.username = optionalString(item, "username", "")
+		// Passwords may reference env variables, e.g. ${EBI_PASSWORD}.
+		src.password = os.ExpandEnv(optionalString(item, "password", ""))
+		src.versioning = optionalBool(item, "versioning", false)
+		src.streaming = optionalBool(item, "streaming", false)
+		src.snapshots = optionalBool(item, "snapshots", false)
+		src.manifests = loadManifestFormat(item)
+		src.processors = loadProcessors(item)
+		src.publishers = loadPublishers(item)
+		if src.streaming && !isStreamable(src.protocol) {
+			log.Fatal("Streaming is not supported over " + src.protocol + ".")
+		}
+		src.syncFolders = loadSyncFolders(item)
+		src.limits = loadLimits(item)
+
+		// Sources writing to the same place would overwrite each other.
+		dest := src.bucket + "/" + src.prefix
+		if other, present := destinations[dest]; present {
+			log.Fatalf("Sources %s and %s have the same destination %s.",
+				other, src.name, dest)
+		}
+		destinations[dest] = src.name
+		ctx.sources = append(ctx.sources, src)
+	}
+	if err = checkSourceOverlap(ctx.sources); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// checkSourceOverlap checks that no two sources record the same files in the
+// db. Entries are keyed by the source prefix and path, so sources with the
+// same or no prefix must sync different folders, even to different buckets.
+func checkSourceOverlap(sources []source) error {
+	for i, a := range sources {
+		for _, b := range sources[:i] {
+			for _, fa := range a.syncFolders {
+				for _, fb := range b.syncFolders {
+					x := strings.TrimSuffix(prefixedPath(a.prefix,
+						fa.sourcePath), "/")
+					y := strings.TrimSuffix(prefixedPath(b.prefix,
+						fb.sourcePath), "/")
+					if x == y || strings.HasPrefix(x, y+"/") ||
+						strings.HasPrefix(y, x+"/") {
+						return fmt.Errorf("Sources %s and %s both record "+
+							"%s in the db. Give them different prefixes.",
+							b.name, a.name, fa.sourcePath)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// defaultSource builds a single source from the top-level server, bucket, and
+// syncFolders settings.
+func defaultSource(ctx *context) source {
+	return source{
+		name:        "default",
+		server:      ctx.server,
+		bucket:      ctx.bucket,
+		protocol:    ctx.src.protocol,
+		limits:      ctx.src.limits,
+		versioning:  ctx.src.versioning,
+		streaming:   ctx.src.streaming,
+		snapshots:   ctx.src.snapshots,
+		manifests:   ctx.src.manifests,
+		processors:  ctx.src.processors,
+		publishers:  ctx.src.publishers,
+		syncFolders: ctx.syncFolders,
+	}
+}
 
-	loadSyncFolders(ctx, yml)
+// optionalString gets a string value from the config or returns the
+// fallback if it is not set.
+func optionalString(yml *simpleyaml.Yaml, key string, fallback string) string {
+	str, err := yml.Get(key).String()
+	if err != nil {
+		return fallback
+	}
+	return str
+}
+
+// optionalBool gets a boolean value from the config or returns the fallback
+// if it is not set.
+func optionalBool(yml *simpleyaml.Yaml, key string, fallback bool) bool {
+	res, err := yml.Get(key).Bool()
+	if err != nil {
+		return fallback
+	}
+	return res
+}
+
+// loadManifestFormat loads the optional run manifest format.
+func loadManifestFormat(yml *simpleyaml.Yaml) string {
+	format := strings.ToLower(optionalString(yml, "manifests", ""))
+	if !validManifestFormat(format) {
+		log.Fatal("Unknown manifest format " + format + ".")
+	}
+	return format
 }
 
 // loadSyncFolders loads the folders to sync and flags from config file.
-func loadSyncFolders(ctx *context, yml *simpleyaml.Yaml) {
+func loadSyncFolders(yml *simpleyaml.Yaml) []syncFolder {
+	res := []syncFolder{}
 	size, err := yml.Get("syncFolders").GetArraySize()
 	if err != nil {
 		log.Fatal("Error in loading syncFolders. ", err)
@@ -99,9 +276,30 @@ func loadSyncFolders(ctx *context, yml *simpleyaml.Yaml) {
 		for _, v := range flagsYml {
 			flags = append(flags, to.String(v))
 		}
-		res := syncFolder{name, flags}
-		ctx.syncFolders = append(ctx.syncFolders, res)
+		res = append(res, syncFolder{
+			sourcePath: name,
+			flags:      flags,
+			prefix:     strings.Trim(optionalString(folder, "prefix", ""), "/"),
+			layout:     loadKeyLayout(folder),
+			filters:    loadFilters(folder),
+			onChange:   loadHooks(folder),
+			staleAfter: loadDuration(folder, "staleAfter", 0),
+			storage:    loadStoragePolicy(folder),
+		})
+	}
+	return res
+}
+
+// loadKeyLayout loads the optional key layout templates of a folder.
+func loadKeyLayout(folder *simpleyaml.Yaml) keyLayout {
+	res := keyLayout{
+		current: optionalString(folder.Get("keyLayout"), "current", ""),
+		archive: optionalString(folder.Get("keyLayout"), "archive", ""),
+	}
+	if err := validateLayout(layoutOf(syncFolder{layout: res})); err != nil {
+		log.Fatal("Error in loading key layout. ", err)
 	}
+	return res
 }
 
 // getUserHome gets the full path of the user's home directory.
@@ -22,11 +22,16 @@ func TestLoadSyncFolders(t *testing.T) {
 	ac(t, f[0].flags, "exclude 'other_genomic.gz'")
 	ae(t, f[1].sourcePath, "/pub/taxonomy")
 	ac(t, f[1].flags, "exclude '.*'")
+	ae(t, "ftp", ctx.src.protocol)
+	ae(t, 10*1024*1024, ctx.src.limits.download.rate)
+	assert.Nil(t, ctx.limits.download)
 }
 
 func FakeIoutilReadFile(input string) ([]byte, error) {
 	out := `server: rsync://ftp.ncbi.nih.gov
 bucket: czbiohub-ncbi-store
+bandwidth:
+  download: 10M
 
 syncFolders:
   - name: /blast/db
@@ -59,3 +64,69 @@ func TestSetupConfig(t *testing.T) {
 	ane(t, ctx.svcS3)
 	assert.Nil(t, err)
 }
+
+func TestLoadSources(t *testing.T) {
+	_, ctx := testSetup(t)
+	tmp := ioutilReadFile
+	ioutilReadFile = FakeIoutilReadFileSources
+	defer func() { ioutilReadFile = tmp }()
+	loadConfigFile(ctx)
+	assert.Equal(t, 2, len(ctx.sources))
+	ae := assert.Equal
+	s := ctx.sources
+	ae(t, "ncbi", s[0].name)
+	ae(t, "ftp.ncbi.nih.gov", s[0].server)
+	ae(t, "czbiohub-ncbi-store", s[0].bucket)
+	ae(t, "ftp", s[0].protocol)
+	ae(t, "/blast/db", s[0].syncFolders[0].sourcePath)
+	ae(t, "ebi", s[1].name)
+	ae(t, "https", s[1].protocol)
+	ae(t, "czbiohub-ebi-store", s[1].bucket)
+	ae(t, "mirror", s[1].prefix)
+	ae(t, "reader", s[1].username)
+	ae(t, "/pub/taxonomy", s[1].syncFolders[0].sourcePath)
+}
+
+func FakeIoutilReadFileSources(input string) ([]byte, error) {
+	out := `bucket: czbiohub-ncbi-store
+
+sources:
+  - name: ncbi
+    server: ftp.ncbi.nih.gov
+    syncFolders:
+      - name: /blast/db
+        flags:
+          - exclude '.*'
+  - name: ebi
+    server: ftp.ebi.ac.uk
+    protocol: https
+    username: reader
+    password: secret
+    bucket: czbiohub-ebi-store
+    prefix: /mirror/
+    syncFolders:
+      - name: /pub/taxonomy
+        flags:
+          - exclude '.*'`
+	return []byte(out), nil
+}
+
+func TestCheckSourceOverlap(t *testing.T) {
+	taxonomy := []syncFolder{{sourcePath: "/pub/taxonomy"}}
+	sources := []source{
+		{name: "ncbi", bucket: "a", syncFolders: taxonomy},
+		{name: "mirror", bucket: "b", syncFolders: taxonomy},
+	}
+	// Same upstream path to different buckets.
+	assert.NotNil(t, checkSourceOverlap(sources))
+	sources[1].syncFolders = []syncFolder{{sourcePath: "/pub/taxonomy/new"}}
+	assert.NotNil(t, checkSourceOverlap(sources))
+	sources[1].syncFolders = []syncFolder{{sourcePath: "/pub/taxonomy_old"}}
+	assert.Nil(t, checkSourceOverlap(sources))
+
+	sources[1].syncFolders = taxonomy
+	sources[1].prefix = "mirror"
+	assert.Nil(t, checkSourceOverlap(sources))
+	sources[0].prefix = "mirror"
+	assert.NotNil(t, checkSourceOverlap(sources))
+}
@@ -5,31 +5,22 @@ import (
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"log"
-	"os"
+	"strings"
 )
 
 var setupDatabase = dbSetupWithCtx
 var lastVersionNum = dbLastVersionNum
 
-// dbSetupWithCtx sets up the database from environment variables and
-// checks connection conditions.
+// dbSetupWithCtx sets up the configured database from environment variables
+// and checks connection conditions.
 func dbSetupWithCtx(ctx *context) (string, error) {
 	var err error
-	// Setup RDS db from env variables
-	rdsHostname := os.Getenv("RDS_HOSTNAME")
-	rdsPort := os.Getenv("RDS_PORT")
-	rdsDbName := os.Getenv("RDS_DB_NAME")
-	rdsUsername := os.Getenv("RDS_USERNAME")
-	rdsPassword := os.Getenv("RDS_PASSWORD")
-	sourceName := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s",
-		rdsUsername, rdsPassword, rdsHostname, rdsPort, rdsDbName)
+	// Setup db from env variables or config
+	sourceName := dataSourceName(ctx)
 	log.Print("DB connection string: " + sourceName)
 
-	if ctx.db, err = sql.Open("mysql", sourceName); err != nil {
-		return sourceName, handle("Failed to set up database opener", err)
-	}
-	if err = ctx.db.Ping(); err != nil {
-		return sourceName, handle("Failed to ping database", err)
+	if err = openDatabase(ctx, sourceName); err != nil {
+		return sourceName, err
 	}
 	dbCreateTable(ctx)
 	log.Print("Successfully checked database.")
@@ -42,36 +33,170 @@ func dbCreateTable(ctx *context) {
 		"PathName VARCHAR(500) NOT NULL, " +
 		"VersionNum INT NOT NULL, " +
 		"DateModified DATETIME, " +
-		"ArchiveKey VARCHAR(50), " +
+		"ArchiveKey VARCHAR(1000), " +
+		"VersionId VARCHAR(1024), " +
+		"Size BIGINT, " +
+		"Md5 VARCHAR(32), " +
+		"Sha256 VARCHAR(64), " +
 		"PRIMARY KEY (PathName, VersionNum));"
-	if _, err := ctx.db.Exec(query); err != nil {
+	if _, err := ctx.db.Exec(dbCreateQuery(ctx, query)); err != nil {
 		log.Print(err)
 		log.Fatal("Failed to find or create table.")
 	}
+	// Check the schema first so that tables are only altered when needed.
+	columns, err := dbColumns(ctx, "entries")
+	if err != nil {
+		log.Print(err)
+		log.Fatal("Failed to check table.")
+	}
+	// ArchiveKey used to hold only a checksum. Widen it for full object keys.
+	archiveKey := "VARCHAR(1000)"
+	if cur, present := columns["archivekey"]; present &&
+		cur != strings.ToLower(archiveKey) {
+		err = dbModifyColumn(ctx, "entries", "ArchiveKey", archiveKey)
+		if err != nil {
+			log.Print(err)
+			log.Fatal("Failed to update table.")
+		}
+	}
+	dbAddColumn(ctx, columns, "VersionId VARCHAR(1024)")
+	dbAddColumn(ctx, columns, "Size BIGINT")
+	dbAddColumn(ctx, columns, "Md5 VARCHAR(32)")
+	dbAddColumn(ctx, columns, "Sha256 VARCHAR(64)")
+	dbCreateSnapshotTables(ctx)
+	dbCreateDerivedTables(ctx)
+	dbCreateRunTables(ctx)
+	dbCreateLeaseTable(ctx)
+	dbCreateStorageTable(ctx)
+}
+
+// dbAddColumn adds a column to the entries table of an existing db. Does
+// nothing if the column is already present.
+func dbAddColumn(ctx *context, columns map[string]string, column string) {
+	name := strings.ToLower(strings.Fields(column)[0])
+	if _, present := columns[name]; present {
+		return
+	}
+	column = dialectOf(ctx).types.Replace(column)
+	// Another instance may have added it since.
+	_, err := ctx.db.Exec("ALTER TABLE entries ADD COLUMN " + column + ";")
+	if err != nil && !isDuplicateColumn(err) {
+		log.Print(err)
+		log.Fatal("Failed to add column to table.")
+	}
+}
+
+// dbPathName gets the path name recorded in the db for a file. Files from a
+// source with a destination prefix are qualified by it, so that sources
+// sharing a db don't collide.
+func dbPathName(ctx *context, file string) string {
+	return prefixedPath(ctx.src.prefix, file)
+}
+
+// prefixedPath qualifies a file path by a source prefix.
+func prefixedPath(prefix string, file string) string {
+	if prefix == "" {
+		return file
+	}
+	return "/" + prefix + file
+}
+
+// dbPathMatch gets the db path name of a path and a LIKE pattern for the
+// files under it. Ex: /pub/taxonomy and /pub/taxonomy/%
+func dbPathMatch(ctx *context, path string) (string, string) {
+	path = strings.TrimSuffix(path, "/")
+	return dbPathName(ctx, path), dbPathName(ctx, path) + "/%"
+}
+
+// underPath reports whether a file is a path or under it. Sibling paths that
+// only share the prefix don't match. Ex: /pub/taxonomy_old
+func underPath(file string, path string) bool {
+	path = strings.TrimSuffix(path, "/")
+	return file == path || strings.HasPrefix(file, path+"/")
+}
+
+// fileOfDbPath gets the file path of a db path name for the current source.
+// Returns false if the entry belongs to another source.
+func fileOfDbPath(ctx *context, name string) (string, bool) {
+	if ctx.src.prefix == "" {
+		return name, true
+	}
+	base := "/" + ctx.src.prefix
+	if !strings.HasPrefix(name, base+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(name, base), true
 }
 
-// dbArchiveFile updates the old db entry with a new archive blob for
-// reference.
+// dbArchiveFile updates the old db entry with the S3 key of its archived copy
+// for reference.
 func dbArchiveFile(ctx *context, file string, key string, num int) error {
 	query := fmt.Sprintf(
 		"update entries set ArchiveKey='%s' where "+
-			"PathName='%s' and VersionNum=%d;", key, file, num)
+			"PathName='%s' and VersionNum=%d;", key, dbPathName(ctx, file), num)
 	log.Print("db query: " + query)
 	_, err := ctx.db.Exec("update entries set ArchiveKey=? where "+
-		"PathName=? and VersionNum=?;", key, file, num)
+		"PathName=? and VersionNum=?;", key, dbPathName(ctx, file), num)
 	if err != nil {
 		return handle("Error in updating db entry.", err)
 	}
+	if c := cachedVersions(ctx, file); c != nil {
+		c.set(file, num, true)
+	}
 	return err
 }
 
+// dbUnarchiveFile clears the archive reference of a file version so that it is
+// current again. Used to undo dbArchiveFile.
+func dbUnarchiveFile(ctx *context, file string, num int) error {
+	_, err := ctx.db.Exec("update entries set ArchiveKey=NULL where "+
+		"PathName=? and VersionNum=?;", dbPathName(ctx, file), num)
+	if err != nil {
+		return handle("Error in updating db entry.", err)
+	}
+	if c := cachedVersions(ctx, file); c != nil {
+		c.set(file, num, false)
+	}
+	return err
+}
+
+// dbDeleteEntry removes the db entry of a file version.
+func dbDeleteEntry(ctx *context, file string, num int) error {
+	_, err := ctx.db.Exec("delete from entries where PathName=? and "+
+		"VersionNum=?;", dbPathName(ctx, file), num)
+	if err != nil {
+		return handle("Error in deleting db entry.", err)
+	}
+	if c := cachedVersions(ctx, file); c != nil {
+		delete(c[file], num)
+	}
+	return err
+}
+
+// dbArchiveKeyUsed reports whether an entry of any source refers to an
+// archived object, either by its key or by the checksum of a legacy key.
+func dbArchiveKeyUsed(ctx *context, key string) (bool, error) {
+	legacy := key
+	if i := strings.LastIndex(key, "archive/"); i >= 0 &&
+		legacyArchiveKey.MatchString(key[i+len("archive/"):]) {
+		legacy = key[i+len("archive/"):]
+	}
+	var num int
+	err := ctx.db.QueryRow("select count(*) from entries where "+
+		"ArchiveKey=? or ArchiveKey=?;", key, legacy).Scan(&num)
+	if err != nil {
+		return false, handle("Error in checking entries of "+key, err)
+	}
+	return num > 0, err
+}
+
 // dbGetModTime gets the modified time for the latest file version recorded in
 // the database.
 func dbGetModTime(ctx *context, file string) (string, error) {
 	var res string
 	err := ctx.db.QueryRow("select DateModified from entries "+
 		"where PathName=? and DateModified is not null order by VersionNum desc",
-		file).Scan(&res)
+		dbPathName(ctx, file)).Scan(&res)
 	switch {
 	case err == sql.ErrNoRows:
 		log.Print("No entries found for: " + file)
@@ -79,15 +204,84 @@ func dbGetModTime(ctx *context, file string) (string, error) {
 	case err != nil:
 		return "", handle("Error in querying database.", err)
 	}
+	return normalizeDbTime(res), err
+}
+
+// dbModTimes gets the modified time of the latest version of every file
+// under a path in one query. Like dbGetModTime, versions without a modified
+// time are skipped.
+func dbModTimes(ctx *context, path string) (map[string]string, error) {
+	res := make(map[string]string)
+	entries, err := dbEntries(ctx, path)
+	if err != nil {
+		return res, handle("Error in getting entries.", err)
+	}
+	// Entries are ordered by version, so later ones win.
+	for _, e := range entries {
+		if e.modTime != "" {
+			res[e.pathName] = e.modTime
+		}
+	}
 	return res, err
 }
 
+// A versionCache represents the version numbers of the files under the
+// syncFolders of a source, loaded in bulk, and whether each is archived.
+type versionCache map[string]map[int]bool
+
+// dbLoadVersions loads the version numbers of every file under the
+// syncFolders of the current source with one query per folder.
+func dbLoadVersions(ctx *context) (versionCache, error) {
+	res := versionCache{}
+	for _, folder := range ctx.syncFolders {
+		entries, err := dbEntries(ctx, folder.sourcePath)
+		if err != nil {
+			return res, handle("Error in loading versions.", err)
+		}
+		for _, e := range entries {
+			res.set(e.pathName, e.versionNum, e.archiveKey != "")
+		}
+	}
+	return res, nil
+}
+
+// set records a version of a file.
+func (c versionCache) set(file string, num int, archived bool) {
+	if c[file] == nil {
+		c[file] = make(map[int]bool)
+	}
+	c[file][num] = archived
+}
+
+// last gets the latest version number of a file, optionally leaving out
+// archived versions. Returns -1 if there is none.
+func (c versionCache) last(file string, inclArchive bool) int {
+	res := -1
+	for num, archived := range c[file] {
+		if num > res && (inclArchive || !archived) {
+			res = num
+		}
+	}
+	return res
+}
+
+// cachedVersions gets the version cache of the current run if it covers a
+// file. Files under a loaded syncFolder without entries have no versions.
+func cachedVersions(ctx *context, file string) versionCache {
+	if ctx.versions == nil || folderOf(ctx, file).sourcePath == "" {
+		return nil
+	}
+	return ctx.versions
+}
+
 // dbNewVersion handles one file with a new version on disk. Sets the version
 // number for the new entry. Gets the datetime modified from the FTP server as
 // a workaround for the lack of original date modified times after syncing to
-// S3. Adds the new entry into the db.
+// S3. Adds the new entry into the db with details of the upload in one query,
+// so that a version is never recorded without its checksums. Returns the new
+// version number.
 func dbNewVersion(ctx *context, pathName string,
-	cache map[string]map[string]string) error {
+	cache map[string]map[string]string, info uploadInfo) (int, error) {
 	var err error
 	log.Print("Handling new version of: " + pathName)
 
@@ -100,28 +294,81 @@ func dbNewVersion(ctx *context, pathName string,
 	}
 
 	// Set datetime modified using directory listing cache
-	modTime := getModTime(pathName, cache)
+	modTime := getModTime(ctx, pathName, cache)
 
-	// Insert into database
-	if modTime != "" {
-		_, err = ctx.db.Exec("insert into entries(PathName, "+
-			"VersionNum, DateModified) values(?, ?, ?)", pathName,
-			versionNum, modTime)
-	} else {
-		_, err = ctx.db.Exec("insert into entries(PathName, "+
-			"VersionNum) values(?, ?)", pathName, versionNum)
+	// Insert into database. Empty files have a size once they are hashed.
+	size := sql.NullInt64{Int64: int64(info.size),
+		Valid: info.size > 0 || info.sha256 != ""}
+	_, err = ctx.db.Exec("insert into entries(PathName, VersionNum, "+
+		"DateModified, VersionId, Size, Md5, Sha256) values(?, ?, ?, ?, ?, "+
+		"?, ?)", dbPathName(ctx, pathName), versionNum, nullString(modTime),
+		nullString(info.versionId), size, nullString(info.md5),
+		nullString(info.sha256))
+	if err != nil {
+		return versionNum, handle("Error in new version insertion query", err)
 	}
+	if c := cachedVersions(ctx, pathName); c != nil {
+		c.set(pathName, versionNum, false)
+	}
+	return versionNum, err
+}
+
+// nullString gets a NULL for an empty string value.
+func nullString(str string) sql.NullString {
+	return sql.NullString{String: str, Valid: str != ""}
+}
+
+// dbSetVersionId records the S3 VersionId of a file version.
+func dbSetVersionId(ctx *context, file string, num int, id string) error {
+	_, err := ctx.db.Exec("update entries set VersionId=? where "+
+		"PathName=? and VersionNum=?;", id, dbPathName(ctx, file), num)
 	if err != nil {
-		return handle("Error in new version insertion query", err)
+		return handle("Error in setting VersionId.", err)
 	}
 	return err
 }
 
+// dbVersionLocation gets the S3 key and VersionId where a file version is
+// stored. The current version is at the current key. Archived versions are at
+// their ArchiveKey, and on a versioned bucket are resolved by VersionId.
+func dbVersionLocation(ctx *context, file string, num int) (string, string,
+	error) {
+	var archive, versionId sql.NullString
+	err := ctx.db.QueryRow("select ArchiveKey, VersionId from entries "+
+		"where PathName=? and VersionNum=?", dbPathName(ctx, file),
+		num).Scan(&archive, &versionId)
+	if err != nil {
+		return "", "", handle("Error in querying version location.", err)
+	}
+	if !archive.Valid {
+		return objectKey(ctx, file), versionId.String, err
+	}
+	return resolveArchiveKey(ctx, archive.String), versionId.String, err
+}
+
+// dbVersionInfo gets the upstream modified time and size of a file version.
+func dbVersionInfo(ctx *context, file string, num int) (string, int, error) {
+	var modTime sql.NullString
+	var size sql.NullInt64
+	err := ctx.db.QueryRow("select DateModified, Size from entries where "+
+		"PathName=? and VersionNum=?", dbPathName(ctx, file),
+		num).Scan(&modTime, &size)
+	if err != nil {
+		return "", 0, handle("Error in querying version info.", err)
+	}
+	return normalizeDbTime(modTime.String), int(size.Int64), err
+}
+
 // dbLastVersionNum finds the latest version number of the file in the db.
+// Uses the versions loaded for the current run if there are any.
 func dbLastVersionNum(ctx *context, file string, inclArchive bool) int {
+	if c := cachedVersions(ctx, file); c != nil {
+		return c.last(file, inclArchive)
+	}
 	num := -1
 	var err error
 	var rows *sql.Rows
+	file = dbPathName(ctx, file)
 
 	// Query
 	if inclArchive {
@@ -151,3 +398,55 @@ func dbLastVersionNum(ctx *context, file string, inclArchive bool) int {
 	}
 	return num
 }
+
+// An entry represents one file version recorded in the db. The path name is
+// the file path on the source.
+type entry struct {
+	pathName   string
+	versionNum int
+	modTime    string // Empty if unknown
+	archiveKey string // Empty for current versions
+	versionId  string // S3 VersionId if the bucket is versioned
+	size       int    // Size in bytes. 0 if unknown.
+	md5        string // Hex MD5 of the content. Empty if unknown.
+	sha256     string // Hex SHA-256 of the content. Empty if unknown.
+}
+
+// dbEntries gets the entries of the current source for the file or the files
+// under a path, ordered by path name and version number.
+func dbEntries(ctx *context, path string) ([]entry, error) {
+	res := []entry{}
+	exact, pattern := dbPathMatch(ctx, path)
+	rows, err := ctx.db.Query("select PathName, VersionNum, DateModified, "+
+		"ArchiveKey, VersionId, Size, Md5, Sha256 from entries where "+
+		"(PathName=? or PathName like ?) order by PathName, VersionNum",
+		exact, pattern)
+	if err != nil {
+		return res, handle("Error in querying entries.", err)
+	}
+	defer func() {
+		if err = rows.Close(); err != nil {
+			errOut("Error in closing rows", err)
+		}
+	}()
+
+	for rows.Next() {
+		var name string
+		var num int
+		var modTime, archive, versionId, md5, sha256 sql.NullString
+		var size sql.NullInt64
+		if err = rows.Scan(&name, &num, &modTime, &archive, &versionId,
+			&size, &md5, &sha256); err != nil {
+			return res, handle("Error scanning row.", err)
+		}
+		// LIKE also matches wildcards in the path, so check the prefix.
+		file, ok := fileOfDbPath(ctx, name)
+		if !ok || !underPath(file, path) {
+			continue
+		}
+		res = append(res, entry{file, num, normalizeDbTime(modTime.String),
+			archive.String,
+			versionId.String, int(size.Int64), md5.String, sha256.String})
+	}
+	return res, rows.Err()
+}
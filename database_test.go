@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/DATA-DOG/go-sqlmock.v1"
 	"testing"
@@ -19,6 +20,42 @@ func TestSetupDatabase(t *testing.T) {
 func TestCreateTable(t *testing.T) {
 	mock, ctx := testSetup(t)
 	mock.ExpectExec("CREATE TABLE IF NOT EXISTS").WillReturnResult(testResult)
+	mock.ExpectQuery("select COLUMN_NAME, COLUMN_TYPE from information_schema.COLUMNS").WithArgs("entries").WillReturnRows(sqlmock.NewRows([]string{"COLUMN_NAME", "COLUMN_TYPE"}).
+		AddRow("PathName", "varchar(500)").AddRow("ArchiveKey", "varchar(32)").AddRow("VersionId", "varchar(1024)"))
+	mock.ExpectExec("ALTER TABLE entries MODIFY ArchiveKey").WillReturnResult(testResult)
+	mock.ExpectExec("ALTER TABLE entries ADD COLUMN Size").WillReturnResult(testResult)
+	mock.ExpectExec("ALTER TABLE entries ADD COLUMN Md5").WillReturnError(errors.New("Error 1060: Duplicate column name 'Md5'"))
+	mock.ExpectExec("ALTER TABLE entries ADD COLUMN Sha256").WillReturnResult(testResult)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS snapshots").WillReturnResult(testResult)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS snapshot_entries").WillReturnResult(testResult)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS derived_objects").WillReturnResult(testResult)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS derived_runs").WillReturnResult(testResult)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS sync_runs").WillReturnResult(testResult)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS hook_runs").WillReturnResult(testResult)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS leases").WillReturnResult(testResult)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS archive_storage").WillReturnResult(testResult)
+	dbCreateTable(ctx)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateTableCurrent(t *testing.T) {
+	mock, ctx := testSetup(t)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS entries").WillReturnResult(testResult)
+	columns := sqlmock.NewRows([]string{"COLUMN_NAME", "COLUMN_TYPE"})
+	for _, c := range [][]string{{"PathName", "varchar(500)"}, {"VersionNum", "int(11)"}, {"DateModified", "datetime"}, {"ArchiveKey", "varchar(1000)"},
+		{"VersionId", "varchar(1024)"}, {"Size", "bigint(20)"}, {"Md5", "varchar(32)"}, {"Sha256", "varchar(64)"}} {
+		columns.AddRow(c[0], c[1])
+	}
+	mock.ExpectQuery("select COLUMN_NAME").WithArgs("entries").WillReturnRows(columns)
+	// No ALTER TABLE when the schema is up to date.
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS snapshots").WillReturnResult(testResult)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS snapshot_entries").WillReturnResult(testResult)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS derived_objects").WillReturnResult(testResult)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS derived_runs").WillReturnResult(testResult)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS sync_runs").WillReturnResult(testResult)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS hook_runs").WillReturnResult(testResult)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS leases").WillReturnResult(testResult)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS archive_storage").WillReturnResult(testResult)
 	dbCreateTable(ctx)
 	assert.Nil(t, mock.ExpectationsWereMet())
 }
@@ -56,3 +93,91 @@ func TestMoveOldFileDb(t *testing.T) {
 		t.Fatal("Unfulfilled expections: ", err)
 	}
 }
+
+func TestDbEntries(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.src.prefix = "mirror"
+	rows := sqlmock.NewRows([]string{"PathName", "VersionNum", "DateModified", "ArchiveKey", "VersionId", "Size", "Md5", "Sha256"}).
+		AddRow("/mirror/pub/taxonomy/a", 1, "2017-08-01 10:00:00", "0123456789abcdef0123456789abcdef", nil, nil, nil, nil).
+		AddRow("/mirror/pub/taxonomy/a", 2, "2017-08-04 10:00:00", nil, nil, nil, nil, nil).
+		AddRow("/mirror/pub/taxonomyX/b", 1, nil, nil, nil, nil, nil, nil)
+	mock.ExpectQuery("select PathName, VersionNum").WithArgs("/mirror/pub/taxonomy", "/mirror/pub/taxonomy/%").WillReturnRows(rows)
+	res, err := dbEntries(ctx, "/pub/taxonomy/")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, entry{"/pub/taxonomy/a", 1, "2017-08-01 10:00:00", "0123456789abcdef0123456789abcdef", "", 0, "", ""}, res[0])
+	assert.Equal(t, "", res[1].archiveKey)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestDbVersionLocation(t *testing.T) {
+	mock, ctx := testSetup(t)
+	rows := sqlmock.NewRows([]string{"ArchiveKey", "VersionId"}).AddRow(nil, "v2")
+	mock.ExpectQuery("select ArchiveKey, VersionId").WithArgs("/pub/a", 2).WillReturnRows(rows)
+	key, id, err := dbVersionLocation(ctx, "/pub/a", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "pub/a", key)
+	assert.Equal(t, "v2", id)
+
+	rows = sqlmock.NewRows([]string{"ArchiveKey", "VersionId"}).AddRow("0123456789abcdef0123456789abcdef", nil)
+	mock.ExpectQuery("select ArchiveKey, VersionId").WithArgs("/pub/a", 1).WillReturnRows(rows)
+	key, id, err = dbVersionLocation(ctx, "/pub/a", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "archive/0123456789abcdef0123456789abcdef", key)
+	assert.Equal(t, "", id)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestDbUnarchiveFile(t *testing.T) {
+	mock, ctx := testSetup(t)
+	mock.ExpectExec("update entries set ArchiveKey=NULL").WithArgs("/pub/a", 2).WillReturnResult(testResult)
+	assert.Nil(t, dbUnarchiveFile(ctx, "/pub/a", 2))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestDbModTimes(t *testing.T) {
+	mock, ctx := testSetup(t)
+	rows := sqlmock.NewRows([]string{"PathName", "VersionNum", "DateModified", "ArchiveKey", "VersionId", "Size", "Md5", "Sha256"}).
+		AddRow("/pub/taxonomy/a", 1, "2017-08-01 10:00:00", "0123456789abcdef0123456789abcdef", nil, nil, nil, nil).
+		AddRow("/pub/taxonomy/a", 2, "2017-08-04 10:00:00", nil, nil, nil, nil, nil).
+		AddRow("/pub/taxonomy/b", 1, "2017-08-02 10:00:00", nil, nil, nil, nil, nil).
+		AddRow("/pub/taxonomy/b", 2, nil, nil, nil, nil, nil, nil)
+	mock.ExpectQuery("select PathName, VersionNum").WithArgs("/pub/taxonomy", "/pub/taxonomy/%").WillReturnRows(rows)
+	res, err := dbModTimes(ctx, "/pub/taxonomy/")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"/pub/taxonomy/a": "2017-08-04 10:00:00",
+		"/pub/taxonomy/b": "2017-08-02 10:00:00",
+	}, res)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestVersionCache(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.syncFolders = []syncFolder{{sourcePath: "/pub/taxonomy"}}
+	rows := sqlmock.NewRows([]string{"PathName", "VersionNum", "DateModified", "ArchiveKey", "VersionId", "Size", "Md5", "Sha256"}).
+		AddRow("/pub/taxonomy/a", 1, nil, "0123456789abcdef0123456789abcdef", nil, nil, nil, nil).
+		AddRow("/pub/taxonomy/a", 2, nil, nil, nil, nil, nil, nil)
+	mock.ExpectQuery("select PathName, VersionNum").WithArgs("/pub/taxonomy", "/pub/taxonomy/%").WillReturnRows(rows)
+	versions, err := dbLoadVersions(ctx)
+	assert.Nil(t, err)
+	ctx.versions = versions
+
+	// Lookups are answered without queries.
+	assert.Equal(t, 2, dbLastVersionNum(ctx, "/pub/taxonomy/a", true))
+	assert.Equal(t, -1, dbLastVersionNum(ctx, "/pub/taxonomy/new", true))
+
+	mock.ExpectExec("update entries set ArchiveKey").WithArgs("key", "/pub/taxonomy/a", 2).WillReturnResult(testResult)
+	assert.Nil(t, dbArchiveFile(ctx, "/pub/taxonomy/a", "key", 2))
+	assert.Equal(t, -1, dbLastVersionNum(ctx, "/pub/taxonomy/a", false))
+	assert.Equal(t, 2, dbLastVersionNum(ctx, "/pub/taxonomy/a", true))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestUnderPath(t *testing.T) {
+	assert.True(t, underPath("/pub/taxonomy/a", "/pub/taxonomy"))
+	assert.True(t, underPath("/pub/taxonomy/a", "/pub/taxonomy/"))
+	assert.True(t, underPath("/pub/taxonomy", "/pub/taxonomy"))
+	assert.True(t, underPath("/pub/taxonomy", "/"))
+	assert.False(t, underPath("/pub/taxonomy_old/a", "/pub/taxonomy"))
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/smallfish/simpleyaml"
+	"github.com/spf13/afero"
+	"io"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Derived run statuses.
+const (
+	derivedRunning = "running"
+	derivedDone    = "done"
+	derivedFailed  = "failed"
+)
+
+// maxDeriveAttempts is how many times a sync run tries a processor on one
+// file version. The derive command can retry beyond it.
+const maxDeriveAttempts = 3
+
+// A processor represents a registered step that derives objects from synced
+// files matching a pattern. Run reads the source file from local disk and
+// writes its outputs to an output dir. Each output is uploaded under
+// derived/<processor>/<path>/v<version>/.
+type processor struct {
+	name    string
+	pattern *regexp.Regexp
+	run     func(ctx *context, in string, outDir string) error
+}
+
+// processors holds the registered processors by name.
+var processors = map[string]processor{}
+
+// registerProcessor makes a processor available to the config.
+func registerProcessor(p processor) {
+	processors[p.name] = p
+}
+
+func init() {
+	registerProcessor(processor{
+		name:    "tar-index",
+		pattern: regexp.MustCompile(`\.(tar\.gz|tgz)$`),
+		run:     tarIndex,
+	})
+}
+
+// A derivedRun represents the latest attempt of a processor on a file
+// version.
+type derivedRun struct {
+	processor string
+	path      string
+	version   int
+	status    string
+	attempts  int
+	err       string
+}
+
+// A derivedObject represents an object derived from a file version.
+type derivedObject struct {
+	processor string
+	path      string
+	version   int
+	key       string
+}
+
+// dbCreateDerivedTables creates the tables linking derived objects to their
+// source versions and tracking processor runs, if not present.
+func dbCreateDerivedTables(ctx *context) {
+	queries := []string{
+		"CREATE TABLE IF NOT EXISTS derived_objects (" +
+			"Processor VARCHAR(100) NOT NULL, " +
+			"PathName VARCHAR(500) NOT NULL, " +
+			"VersionNum INT NOT NULL, " +
+			"Name VARCHAR(255) NOT NULL, " +
+			"DerivedKey VARCHAR(1000) NOT NULL, " +
+			"PRIMARY KEY (Processor, PathName, VersionNum, Name));",
+		"CREATE TABLE IF NOT EXISTS derived_runs (" +
+			"Processor VARCHAR(100) NOT NULL, " +
+			"PathName VARCHAR(500) NOT NULL, " +
+			"VersionNum INT NOT NULL, " +
+			"Status VARCHAR(20) NOT NULL, " +
+			"Attempts INT NOT NULL, " +
+			"Error VARCHAR(2000), " +
+			"DateUpdated DATETIME, " +
+			"PRIMARY KEY (Processor, PathName, VersionNum));",
+	}
+	for _, query := range queries {
+		if _, err := ctx.db.Exec(dbCreateQuery(ctx, query)); err != nil {
+			log.Print(err)
+			log.Fatal("Failed to find or create derived tables.")
+		}
+	}
+}
+
+// loadProcessors loads the optional names of the processors to run.
+// Ex: processors: [tar-index]
+func loadProcessors(yml *simpleyaml.Yaml) []string {
+	res := []string{}
+	items, err := yml.Get("processors").Array()
+	if err != nil {
+		return res
+	}
+	for _, item := range items {
+		name := fmt.Sprint(item)
+		if _, present := processors[name]; !present {
+			log.Fatal("Unknown processor " + name + ".")
+		}
+		res = append(res, name)
+	}
+	return res
+}
+
+// deriveStage runs the processors of the current source on the synced files
+// they match, then retries earlier failures. Versions already processed are
+// skipped. Returns the number of processor runs that failed.
+func deriveStage(ctx *context, files []string) int {
+	if len(ctx.src.processors) == 0 {
+		return 0
+	}
+	log.Print("Beginning derive stage.")
+	failed := 0
+	tried := make(map[string]bool)
+	try := func(p processor, file string, num int) {
+		id := fmt.Sprintf("%s %s %d", p.name, file, num)
+		if tried[id] {
+			return
+		}
+		tried[id] = true
+		if err := deriveFile(ctx, p, file, num); err != nil {
+			errOut("Error in running "+id, err)
+			failed++
+		}
+	}
+
+	for _, name := range ctx.src.processors {
+		p := processors[name]
+		for _, file := range files {
+			if !p.pattern.MatchString(file) {
+				continue
+			}
+			num := lastVersionNum(ctx, file, false)
+			if num < 1 {
+				continue // Not synced
+			}
+			run, err := dbDerivedRun(ctx, p.name, file, num)
+			if err != nil {
+				errOut("Error in checking derived run", err)
+				continue
+			}
+			if run.status != derivedDone {
+				try(p, file, num)
+			}
+		}
+	}
+
+	runs, err := dbFailedDerived(ctx)
+	if err != nil {
+		errOut("Error in getting failed derived runs", err)
+	}
+	for _, run := range runs {
+		p, present := processors[run.processor]
+		if present && enabledProcessor(ctx, run.processor) &&
+			run.attempts < maxDeriveAttempts {
+			try(p, run.path, run.version)
+		}
+	}
+	log.Printf("Derive stage ran %d processors with %d failures.", len(tried),
+		failed)
+	return failed
+}
+
+// enabledProcessor reports whether the current source runs a processor.
+func enabledProcessor(ctx *context, name string) bool {
+	for _, p := range ctx.src.processors {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// deriveFile runs a processor on one file version and records the outcome.
+// Outputs of earlier attempts are replaced.
+func deriveFile(ctx *context, p processor, file string, num int) error {
+	if err := dbStartDerived(ctx, p.name, file, num); err != nil {
+		return handle("Error in recording derived run.", err)
+	}
+	err := runProcessor(ctx, p, file, num)
+	status, msg := derivedDone, ""
+	if err != nil {
+		status, msg = derivedFailed, err.Error()
+	}
+	if dbErr := dbFinishDerived(ctx, p.name, file, num, status,
+		msg); dbErr != nil && err == nil {
+		err = handle("Error in recording derived run.", dbErr)
+	}
+	return err
+}
+
+// runProcessor downloads the exact file version to staging, runs a processor
+// on it, and uploads each output.
+func runProcessor(ctx *context, p processor, file string, num int) error {
+	key, versionId, err := dbVersionLocation(ctx, file, num)
+	if err != nil {
+		return handle("Error in finding stored copy.", err)
+	}
+	dir := fmt.Sprintf("%s/derived/%s%s/v%d", ctx.temp, p.name, file, num)
+	defer func() {
+		errOut("Error in cleaning up derived files", ctx.os.RemoveAll(dir))
+	}()
+	in := dir + "/source/" + path.Base(file)
+	if _, err = downloadObject(ctx, key, versionId, in); err != nil {
+		return handle("Error in downloading source.", err)
+	}
+	outDir := dir + "/out"
+	if err = ctx.os.MkdirAll(outDir, os.ModePerm); err != nil {
+		return handle("Couldn't make output dir.", err)
+	}
+	if err = p.run(ctx, in, outDir); err != nil {
+		return handle("Error in processor "+p.name, err)
+	}
+
+	return afero.Walk(ctx.os, outDir, func(local string, info os.FileInfo,
+		err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name := strings.TrimPrefix(local, outDir+"/")
+		key := derivedKey(ctx, p.name, file, num, name)
+		if err = uploadDerived(ctx, local, key); err != nil {
+			return handle("Error in uploading "+key, err)
+		}
+		log.Printf("Derived %s from %s v%d.", key, file, num)
+		return dbAddDerived(ctx, derivedObject{p.name, file, num, key}, name)
+	})
+}
+
+// derivedKey gets the key of a derived object.
+// Ex: derived/tar-index/pub/taxonomy/taxdump.tar.gz/v3/index.tsv
+func derivedKey(ctx *context, name string, file string, num int,
+	output string) string {
+	return withPrefix(ctx, fmt.Sprintf("derived/%s%s/v%d/%s", name, file, num,
+		output))
+}
+
+// uploadDerived uploads a derived output from local disk.
+func uploadDerived(ctx *context, local string, key string) error {
+	file, err := ctx.os.Open(local)
+	if err != nil {
+		return handle("Error in opening "+local, err)
+	}
+	defer func() {
+		errOut("Error in closing "+local, file.Close())
+	}()
+	_, err = ctx.svcS3.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(ctx.bucket),
+		Key:    aws.String(key),
+		Body:   file,
+	})
+	return err
+}
+
+// tarIndex writes the name, size, and modified time of every member of a
+// gzipped tar archive to index.tsv.
+func tarIndex(ctx *context, in string, outDir string) error {
+	file, err := ctx.os.Open(in)
+	if err != nil {
+		return handle("Error in opening "+in, err)
+	}
+	defer func() {
+		errOut("Error in closing "+in, file.Close())
+	}()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return handle("Error in reading gzip.", err)
+	}
+	out, err := ctx.os.Create(outDir + "/index.tsv")
+	if err != nil {
+		return handle("Error in creating index.", err)
+	}
+	defer func() {
+		errOut("Error in closing index", out.Close())
+	}()
+
+	reader := tar.NewReader(gz)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return handle("Error in reading tar.", err)
+		}
+		if _, err = fmt.Fprintf(out, "%s\t%d\t%s\n", header.Name, header.Size,
+			header.ModTime.UTC().Format("2006-01-02 15:04:05")); err != nil {
+			return handle("Error in writing index.", err)
+		}
+	}
+}
+
+// dbDerivedRun gets the latest run of a processor on a file version. The
+// status is empty if it never ran.
+func dbDerivedRun(ctx *context, name string, file string,
+	num int) (derivedRun, error) {
+	res := derivedRun{processor: name, path: file, version: num}
+	var msg sql.NullString
+	err := ctx.db.QueryRow("select Status, Attempts, Error from derived_runs "+
+		"where Processor=? and PathName=? and VersionNum=?;", name,
+		dbPathName(ctx, file), num).Scan(&res.status, &res.attempts, &msg)
+	if err == sql.ErrNoRows {
+		return res, nil
+	}
+	res.err = msg.String
+	return res, err
+}
+
+// dbStartDerived marks a processor run as started and removes the outputs of
+// earlier attempts.
+func dbStartDerived(ctx *context, name string, file string, num int) error {
+	pathName := dbPathName(ctx, file)
+	updated := dbTime(now())
+	res, err := ctx.db.Exec("update derived_runs set Status=?, "+
+		"Attempts=Attempts+1, Error=NULL, DateUpdated=? where Processor=? "+
+		"and PathName=? and VersionNum=?;", derivedRunning, updated, name,
+		pathName, num)
+	if err != nil {
+		return handle("Error in updating derived run.", err)
+	}
+	if rows, err := res.RowsAffected(); err != nil || rows == 0 {
+		_, err = ctx.db.Exec("insert into derived_runs (Processor, PathName, "+
+			"VersionNum, Status, Attempts, DateUpdated) values (?, ?, ?, ?, 1, "+
+			"?);", name, pathName, num, derivedRunning, updated)
+		if err != nil {
+			return handle("Error in inserting derived run.", err)
+		}
+	}
+	_, err = ctx.db.Exec("delete from derived_objects where Processor=? and "+
+		"PathName=? and VersionNum=?;", name, pathName, num)
+	if err != nil {
+		return handle("Error in removing earlier derived objects.", err)
+	}
+	return err
+}
+
+// dbFinishDerived records the outcome of a processor run.
+func dbFinishDerived(ctx *context, name string, file string, num int,
+	status string, msg string) error {
+	errMsg := sql.NullString{String: msg, Valid: msg != ""}
+	_, err := ctx.db.Exec("update derived_runs set Status=?, Error=?, "+
+		"DateUpdated=? where Processor=? and PathName=? and VersionNum=?;",
+		status, errMsg, dbTime(now()), name,
+		dbPathName(ctx, file), num)
+	return err
+}
+
+// dbAddDerived records a derived object against its source version.
+func dbAddDerived(ctx *context, obj derivedObject, name string) error {
+	_, err := ctx.db.Exec("insert into derived_objects (Processor, PathName, "+
+		"VersionNum, Name, DerivedKey) values (?, ?, ?, ?, ?);", obj.processor,
+		dbPathName(ctx, obj.path), obj.version, name, obj.key)
+	if err != nil {
+		return handle("Error in inserting derived object.", err)
+	}
+	return err
+}
+
+// dbFailedDerived gets the failed processor runs of the current source.
+func dbFailedDerived(ctx *context) ([]derivedRun, error) {
+	res := []derivedRun{}
+	rows, err := ctx.db.Query("select Processor, PathName, VersionNum, "+
+		"Attempts, Error from derived_runs where Status=? order by PathName, "+
+		"VersionNum;", derivedFailed)
+	if err != nil {
+		return res, handle("Error in querying derived runs.", err)
+	}
+	defer func() {
+		if err = rows.Close(); err != nil {
+			errOut("Error in closing rows", err)
+		}
+	}()
+	for rows.Next() {
+		run := derivedRun{status: derivedFailed}
+		var name string
+		var msg sql.NullString
+		if err = rows.Scan(&run.processor, &name, &run.version, &run.attempts,
+			&msg); err != nil {
+			return res, handle("Error scanning row.", err)
+		}
+		file, ok := fileOfDbPath(ctx, name)
+		if !ok {
+			continue
+		}
+		run.path = file
+		run.err = msg.String
+		res = append(res, run)
+	}
+	return res, rows.Err()
+}
+
+// dbDerivedObjects gets the objects derived from files under a path of the
+// current source.
+func dbDerivedObjects(ctx *context, path string) ([]derivedObject, error) {
+	res := []derivedObject{}
+	exact, pattern := dbPathMatch(ctx, path)
+	rows, err := ctx.db.Query("select Processor, PathName, VersionNum, "+
+		"DerivedKey from derived_objects where (PathName=? or PathName like "+
+		"?) order by PathName, VersionNum, DerivedKey;", exact, pattern)
+	if err != nil {
+		return res, handle("Error in querying derived objects.", err)
+	}
+	defer func() {
+		if err = rows.Close(); err != nil {
+			errOut("Error in closing rows", err)
+		}
+	}()
+	for rows.Next() {
+		obj := derivedObject{}
+		var name string
+		if err = rows.Scan(&obj.processor, &name, &obj.version,
+			&obj.key); err != nil {
+			return res, handle("Error scanning row.", err)
+		}
+		file, ok := fileOfDbPath(ctx, name)
+		if !ok || !underPath(file, path) {
+			continue
+		}
+		obj.path = file
+		res = append(res, obj)
+	}
+	return res, rows.Err()
+}
+
+// runDerive is the derive command. Runs the processors of a source on the
+// current versions under a path, or retries failed runs.
+func runDerive(ctx *context, args []string) error {
+	flags, name := newFlagSet("derive")
+	dir := flags.String("path", "", "Run on the current versions of the "+
+		"files under this path.")
+	retry := flags.Bool("retry", false, "Retry every failed run.")
+	if err := flags.Parse(args); err != nil {
+		return handle("Error in parsing flags.", err)
+	}
+	srcCtx, err := contextForSource(ctx, *name)
+	if err != nil {
+		return handle("Error in finding source.", err)
+	}
+	if *dir == "" && !*retry {
+		return errors.New("Set -path or -retry.")
+	}
+
+	failed := 0
+	if *dir != "" {
+		entries, err := dbEntries(srcCtx, *dir)
+		if err != nil {
+			return handle("Error in getting entries.", err)
+		}
+		files := []string{}
+		for _, e := range entries {
+			if e.archiveKey == "" {
+				files = append(files, e.pathName)
+			}
+		}
+		failed += deriveStage(srcCtx, files)
+	}
+	if *retry {
+		runs, err := dbFailedDerived(srcCtx)
+		if err != nil {
+			return handle("Error in getting failed runs.", err)
+		}
+		for _, run := range runs {
+			p, present := processors[run.processor]
+			if !present {
+				log.Print("Skipping unknown processor " + run.processor)
+				continue
+			}
+			if err = deriveFile(srcCtx, p, run.path, run.version); err != nil {
+				errOut("Error in retrying "+run.path, err)
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d processor runs failed", failed)
+	}
+	return nil
+}
+
+// runListDerived is the list-derived command. Prints the objects derived from
+// files under a path, or the failed runs.
+func runListDerived(ctx *context, args []string) error {
+	flags, name := newFlagSet("list-derived")
+	dir := flags.String("path", "/", "List objects derived from files under "+
+		"this path.")
+	failed := flags.Bool("failed", false, "List failed runs instead.")
+	if err := flags.Parse(args); err != nil {
+		return handle("Error in parsing flags.", err)
+	}
+	srcCtx, err := contextForSource(ctx, *name)
+	if err != nil {
+		return handle("Error in finding source.", err)
+	}
+	if *failed {
+		runs, err := dbFailedDerived(srcCtx)
+		if err != nil {
+			return handle("Error in getting failed runs.", err)
+		}
+		for _, run := range runs {
+			fmt.Printf("%s\t%s\tv%d\t%d attempts\t%s\n", run.processor,
+				run.path, run.version, run.attempts, run.err)
+		}
+		return nil
+	}
+	objects, err := dbDerivedObjects(srcCtx, *dir)
+	if err != nil {
+		return handle("Error in getting derived objects.", err)
+	}
+	for _, obj := range objects {
+		fmt.Printf("%s\tv%d\t%s\t%s\n", obj.path, obj.version, obj.processor,
+			obj.key)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"github.com/smallfish/simpleyaml"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"testing"
+)
+
+// tarGz makes a gzipped tar archive with one member.
+func tarGz(t *testing.T, name string, body string) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644,
+		Size: int64(len(body))}))
+	tw.Write([]byte(body))
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, gz.Close())
+	return buf.String()
+}
+
+func TestDeriveFile(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.bucket = "bucket"
+	ctx.temp = "/synctemp"
+	file := "/pub/taxonomy/taxdump.tar.gz"
+	p := processors["tar-index"]
+	key := "derived/tar-index/pub/taxonomy/taxdump.tar.gz/v3/index.tsv"
+
+	mock.ExpectExec("update derived_runs set Status=\\?, Attempts").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("insert into derived_runs").WithArgs("tar-index", file, 3, derivedRunning, sqlmock.AnyArg()).WillReturnResult(testResult)
+	mock.ExpectExec("delete from derived_objects").WithArgs("tar-index", file, 3).WillReturnResult(testResult)
+	mock.ExpectQuery("select ArchiveKey, VersionId").WithArgs(file, 3).WillReturnRows(
+		sqlmock.NewRows([]string{"ArchiveKey", "VersionId"}).AddRow(nil, "v3"))
+	testServer.Response(200, nil, tarGz(t, "names.dmp", "12345"))
+	testServer.Response(200, nil, "")
+	mock.ExpectExec("insert into derived_objects").WithArgs("tar-index", file, 3, "index.tsv", key).WillReturnResult(testResult)
+	mock.ExpectExec("update derived_runs set Status=\\?, Error").WithArgs(derivedDone, nil, sqlmock.AnyArg(), "tar-index", file, 3).WillReturnResult(testResult)
+
+	assert.Nil(t, deriveFile(ctx, p, file, 3))
+	reqs := testServer.WaitRequests(2)
+	assert.Equal(t, "versionId=v3", reqs[0].URL.RawQuery)
+	assert.Equal(t, "/bucket/"+key, reqs[1].URL.Path)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	// Staged copies are cleaned up.
+	exists, _ := afero.Exists(ctx.os, "/synctemp/derived/tar-index"+file+"/v3")
+	assert.False(t, exists)
+}
+
+func TestDeriveFileFailed(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.bucket = "bucket"
+	ctx.temp = "/synctemp"
+	file := "/pub/taxonomy/taxdump.tar.gz"
+
+	mock.ExpectExec("update derived_runs set Status=\\?, Attempts").WillReturnResult(testResult)
+	mock.ExpectExec("delete from derived_objects").WillReturnResult(testResult)
+	mock.ExpectQuery("select ArchiveKey, VersionId").WithArgs(file, 2).WillReturnRows(
+		sqlmock.NewRows([]string{"ArchiveKey", "VersionId"}).AddRow(nil, nil))
+	testServer.Response(200, nil, "not a tarball")
+	mock.ExpectExec("update derived_runs set Status=\\?, Error").WithArgs(derivedFailed, sqlmock.AnyArg(), sqlmock.AnyArg(), "tar-index", file, 2).WillReturnResult(testResult)
+
+	assert.NotNil(t, deriveFile(ctx, processors["tar-index"], file, 2))
+	testServer.WaitRequest()
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestLoadProcessors(t *testing.T) {
+	yml, _ := simpleyaml.NewYaml([]byte("processors: [tar-index]\n"))
+	assert.Equal(t, []string{"tar-index"}, loadProcessors(yml))
+	yml, _ = simpleyaml.NewYaml([]byte("bucket: test\n"))
+	assert.Empty(t, loadProcessors(yml))
+}
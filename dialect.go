@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A dialect represents the differences between the SQL databases supported.
+// Queries are written for MySQL with ? placeholders and are adapted to the
+// other databases.
+type dialect struct {
+	driver  string            // database/sql driver name
+	types   *strings.Replacer // Maps MySQL column types
+	modify  string            // Changes a column type. Empty if not needed.
+	columns string            // Lists the names and types of a table's columns
+}
+
+// dialects holds the supported databases by their config name.
+var dialects = map[string]dialect{
+	"mysql": {
+		driver: "mysql",
+		types:  strings.NewReplacer(),
+		modify: "ALTER TABLE %s MODIFY %s %s;",
+		columns: "select COLUMN_NAME, COLUMN_TYPE from " +
+			"information_schema.COLUMNS where TABLE_SCHEMA=DATABASE() and " +
+			"TABLE_NAME=?;",
+	},
+	"postgres": {
+		driver: "postgres-qmark",
+		types:  strings.NewReplacer("DATETIME", "TIMESTAMP"),
+		modify: "ALTER TABLE %s ALTER COLUMN %s TYPE %s;",
+		columns: "select column_name, case when character_maximum_length " +
+			"is null then data_type else 'varchar(' || " +
+			"character_maximum_length || ')' end from " +
+			"information_schema.columns where table_schema=current_schema() " +
+			"and table_name=?;",
+	},
+	// SQLite doesn't enforce column types, so they never need changing.
+	"sqlite": {
+		driver:  "sqlite3",
+		types:   strings.NewReplacer(),
+		columns: "select name, type from pragma_table_info(?);",
+	},
+}
+
+func init() {
+	sql.Register("postgres-qmark", qmarkDriver{pq.Driver{}})
+}
+
+// dialectOf gets the dialect of the configured database. MySQL is the
+// default.
+func dialectOf(ctx *context) dialect {
+	if d, present := dialects[ctx.database.driver]; present {
+		return d
+	}
+	return dialects["mysql"]
+}
+
+// validDatabase reports whether a database name from the config is
+// supported. Empty means the default.
+func validDatabase(name string) bool {
+	_, present := dialects[name]
+	return name == "" || present
+}
+
+// dataSourceName gets the connection string for the configured database.
+// MySQL and PostgreSQL are set up from the RDS_* environment variables.
+// SQLite uses a local file.
+func dataSourceName(ctx *context) string {
+	host := os.Getenv("RDS_HOSTNAME")
+	port := os.Getenv("RDS_PORT")
+	name := os.Getenv("RDS_DB_NAME")
+	username := os.Getenv("RDS_USERNAME")
+	password := os.Getenv("RDS_PASSWORD")
+	switch ctx.database.driver {
+	case "postgres":
+		sslMode := os.Getenv("RDS_SSLMODE")
+		if sslMode == "" {
+			sslMode = "require"
+		}
+		return fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s "+
+			"sslmode=%s", host, port, name, username, password, sslMode)
+	case "sqlite":
+		if ctx.database.path != "" {
+			return ctx.database.path
+		}
+		return ctx.local + "/sync.db"
+	}
+	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", username, password, host, port,
+		name)
+}
+
+// dbCreateQuery adapts a CREATE TABLE query to the configured database.
+func dbCreateQuery(ctx *context, query string) string {
+	return dialectOf(ctx).types.Replace(query)
+}
+
+// dbModifyColumn changes the type of a column on databases that enforce
+// column types.
+func dbModifyColumn(ctx *context, table string, column string,
+	columnType string) error {
+	d := dialectOf(ctx)
+	if d.modify == "" {
+		return nil
+	}
+	_, err := ctx.db.Exec(fmt.Sprintf(d.modify, table, column,
+		d.types.Replace(columnType)))
+	return err
+}
+
+// dbColumns gets the lowercase types of the columns of a table, keyed by
+// lowercase column name. Ex: archivekey: varchar(1000)
+func dbColumns(ctx *context, table string) (map[string]string, error) {
+	res := make(map[string]string)
+	rows, err := ctx.db.Query(dialectOf(ctx).columns, table)
+	if err != nil {
+		return res, handle("Error in querying columns.", err)
+	}
+	defer func() {
+		if err = rows.Close(); err != nil {
+			errOut("Error in closing rows", err)
+		}
+	}()
+	for rows.Next() {
+		var name, columnType string
+		if err = rows.Scan(&name, &columnType); err != nil {
+			return res, handle("Error scanning row.", err)
+		}
+		res[strings.ToLower(name)] = strings.ToLower(columnType)
+	}
+	return res, rows.Err()
+}
+
+// isDuplicateColumn reports whether an error is from adding a column that
+// already exists.
+func isDuplicateColumn(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "duplicate column") ||
+		strings.Contains(msg, "already exists")
+}
+
+// isDuplicateKey reports whether an error is from inserting a row whose
+// unique or primary key is already taken.
+func isDuplicateKey(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "duplicate entry") ||
+		strings.Contains(msg, "duplicate key") ||
+		strings.Contains(msg, "unique constraint")
+}
+
+// normalizeDbTime formats a datetime read from any of the databases the way
+// MySQL returns it. Ex: 2017-08-04 22:08:41
+func normalizeDbTime(str string) string {
+	t, err := parseDbTime(str)
+	if err != nil {
+		return str
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// A qmarkDriver wraps a driver that uses numbered placeholders ($1, $2) so
+// that queries can be written with ? placeholders.
+type qmarkDriver struct {
+	driver.Driver
+}
+
+func (d qmarkDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return qmarkConn{conn}, nil
+}
+
+// A qmarkConn represents a connection that rewrites placeholders.
+type qmarkConn struct {
+	driver.Conn
+}
+
+func (c qmarkConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(numberPlaceholders(query))
+}
+
+// numberPlaceholders replaces the ? placeholders of a query with $1, $2, and
+// so on. Question marks in quoted strings are kept.
+func numberPlaceholders(query string) string {
+	res := make([]byte, 0, len(query)+8)
+	num := 0
+	quoted := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			num++
+			res = append(res, '$')
+			res = strconv.AppendInt(res, int64(num), 10)
+			continue
+		}
+		res = append(res, c)
+	}
+	return string(res)
+}
+
+// openDatabase opens the configured database and checks the connection.
+func openDatabase(ctx *context, dsn string) error {
+	var err error
+	d := dialectOf(ctx)
+	if ctx.db, err = sql.Open(d.driver, dsn); err != nil {
+		return handle("Failed to set up database opener", err)
+	}
+	if d.driver == "sqlite3" {
+		// SQLite allows one writer at a time.
+		ctx.db.SetMaxOpenConns(1)
+	}
+	if err = ctx.db.Ping(); err != nil {
+		return handle("Failed to ping database", err)
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNumberPlaceholders(t *testing.T) {
+	assert.Equal(t, "update entries set ArchiveKey=$1 where PathName=$2 and "+
+		"VersionNum=$3;", numberPlaceholders("update entries set ArchiveKey=? "+
+		"where PathName=? and VersionNum=?;"))
+	assert.Equal(t, "select '?' from a where b=$1",
+		numberPlaceholders("select '?' from a where b=?"))
+}
+
+func TestDataSourceName(t *testing.T) {
+	ctx := &context{local: "/syncmount"}
+	assert.Contains(t, dataSourceName(ctx), "@tcp(")
+	ctx.database.driver = "postgres"
+	assert.Contains(t, dataSourceName(ctx), "sslmode=require")
+	ctx.database.driver = "sqlite"
+	assert.Equal(t, "/syncmount/sync.db", dataSourceName(ctx))
+	ctx.database.path = "/tmp/a.db"
+	assert.Equal(t, "/tmp/a.db", dataSourceName(ctx))
+	assert.True(t, validDatabase(""))
+	assert.False(t, validDatabase("oracle"))
+}
+
+func TestSqliteEntries(t *testing.T) {
+	ctx := &context{database: dbConfig{driver: "sqlite", path: ":memory:"}}
+	assert.Nil(t, openDatabase(ctx, dataSourceName(ctx)))
+	defer ctx.db.Close()
+	tmp := getModTime
+	getModTime = FakeGetModTime
+	defer func() { getModTime = tmp }()
+
+	// Setting up twice is fine.
+	dbCreateTable(ctx)
+	dbCreateTable(ctx)
+
+	cache := make(map[string]map[string]string)
+	file := "/pub/taxonomy/taxdump.tar.gz"
+	num, err := dbNewVersion(ctx, file, cache, uploadInfo{size: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, num)
+	assert.Equal(t, 1, dbLastVersionNum(ctx, file, false))
+	assert.Nil(t, dbArchiveFile(ctx, file, "archive/one", 1))
+	_, err = dbNewVersion(ctx, file, cache, uploadInfo{versionId: "v2", size: 12})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, dbLastVersionNum(ctx, file, true))
+
+	modTime, err := dbGetModTime(ctx, file)
+	assert.Nil(t, err)
+	assert.Equal(t, "2017-08-02 22:20:26", modTime)
+	res, err := dbEntries(ctx, "/pub")
+	assert.Nil(t, err)
+	assert.Equal(t, []entry{
+		{file, 1, "2017-08-02 22:20:26", "archive/one", "", 10, "", ""},
+		{file, 2, "2017-08-02 22:20:26", "", "v2", 12, "", ""}}, res)
+
+	// Siblings sharing the prefix are left out.
+	_, err = dbNewVersion(ctx, "/pub/taxonomy_old/a", cache, uploadInfo{})
+	assert.Nil(t, err)
+	res, err = dbEntries(ctx, "/pub/taxonomy")
+	assert.Nil(t, err)
+	assert.Len(t, res, 2)
+	res, err = dbEntries(ctx, file)
+	assert.Nil(t, err)
+	assert.Len(t, res, 2)
+}
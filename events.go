@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/smallfish/simpleyaml"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Change event types.
+const (
+	eventNewVersion = "new-version"
+	eventArchived   = "archived"
+	eventDeleted    = "deleted"
+)
+
+// A changeEvent represents one change to the stored files. Archived and
+// deleted events describe the version that was replaced or removed.
+type changeEvent struct {
+	Type    string `json:"type"`
+	Source  string `json:"source"`
+	RunId   string `json:"runId,omitempty"`
+	Path    string `json:"path"`
+	Version int    `json:"version"`
+	Key     string `json:"key"`
+	Size    int    `json:"size"`
+	ModTime string `json:"modTime,omitempty"` // Upstream modified time
+	Md5     string `json:"md5,omitempty"`     // Hex checksums of new versions
+	Sha256  string `json:"sha256,omitempty"`
+	Time    string `json:"time"` // When the change was made
+}
+
+// A publisher represents a destination for change events.
+type publisher interface {
+	publish(ctx *context, e changeEvent) error
+}
+
+// An snsPublisher publishes events to an SNS topic.
+type snsPublisher struct {
+	svc   *sns.SNS
+	topic string
+}
+
+func (p snsPublisher) publish(ctx *context, e changeEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = p.svc.Publish(&sns.PublishInput{
+		TopicArn: aws.String(p.topic),
+		Message:  aws.String(string(body)),
+		MessageAttributes: map[string]*sns.MessageAttributeValue{
+			"type": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(e.Type),
+			},
+		},
+	})
+	return err
+}
+
+// An sqsPublisher sends events to an SQS queue.
+type sqsPublisher struct {
+	svc   *sqs.SQS
+	queue string
+}
+
+func (p sqsPublisher) publish(ctx *context, e changeEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = p.svc.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:    aws.String(p.queue),
+		MessageBody: aws.String(string(body)),
+	})
+	return err
+}
+
+// An httpPublisher posts events as JSON to an endpoint. Any 2xx response
+// counts as delivered.
+type httpPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func (p httpPublisher) publish(ctx *context, e changeEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Post(p.url, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	errOut("Error in closing response", resp.Body.Close())
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", p.url, resp.Status)
+	}
+	return nil
+}
+
+// A filePublisher appends events as JSON lines to a local file.
+type filePublisher struct {
+	path  string
+	mutex *sync.Mutex
+}
+
+func (p filePublisher) publish(ctx *context, e changeEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err = ctx.os.MkdirAll(filepath.Dir(p.path), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := ctx.os.OpenFile(p.path,
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(body, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// loadPublishers loads the optional change event destinations.
+// Ex: events: [{type: sns, topic: arn:aws:sns:...}, {type: file, path: ...}]
+func loadPublishers(yml *simpleyaml.Yaml) []publisher {
+	res := []publisher{}
+	size, err := yml.Get("events").GetArraySize()
+	if err != nil {
+		return res
+	}
+	for i := 0; i < size; i++ {
+		item := yml.Get("events").GetIndex(i)
+		kind := optionalString(item, "type", "")
+		var p publisher
+		switch kind {
+		case "sns":
+			p = snsPublisher{sns.New(session.Must(session.NewSession())),
+				requiredString(item, "topic", kind)}
+		case "sqs":
+			p = sqsPublisher{sqs.New(session.Must(session.NewSession())),
+				requiredString(item, "queue", kind)}
+		case "http":
+			p = httpPublisher{requiredString(item, "url", kind),
+				&http.Client{Timeout: 30 * time.Second}}
+		case "file":
+			p = filePublisher{requiredString(item, "path", kind), &sync.Mutex{}}
+		default:
+			log.Fatal("Unknown event publisher type " + kind + ".")
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+// requiredString gets a string setting of an event publisher.
+func requiredString(yml *simpleyaml.Yaml, key string, kind string) string {
+	str := optionalString(yml, key, "")
+	if str == "" {
+		log.Fatalf("No %s set for %s event publisher.", key, kind)
+	}
+	return str
+}
+
+// publishEvent sends an event to every publisher of the current source.
+// Failures are logged and don't fail the change.
+func publishEvent(ctx *context, e changeEvent) {
+	if len(ctx.src.publishers) == 0 {
+		return
+	}
+	e.Source = ctx.src.name
+	e.RunId = ctx.runId
+	e.Time = now().UTC().Format(time.RFC3339)
+	for _, p := range ctx.src.publishers {
+		if err := p.publish(ctx, e); err != nil {
+			errOut(fmt.Sprintf("Error in publishing %s event for %s", e.Type,
+				e.Path), err)
+		}
+	}
+}
+
+// publishNewVersion publishes the latest version of a file after it was
+// stored, with the size and checksums of the upload.
+func publishNewVersion(ctx *context, file string,
+	cache map[string]map[string]string, info uploadInfo) {
+	if len(ctx.src.publishers) == 0 {
+		return
+	}
+	publishEvent(ctx, changeEvent{
+		Type:    eventNewVersion,
+		Path:    file,
+		Version: lastVersionNum(ctx, file, true),
+		Key:     objectKey(ctx, file),
+		Size:    info.size,
+		ModTime: getModTime(ctx, file, cache),
+		Md5:     info.md5,
+		Sha256:  info.sha256,
+	})
+}
+
+// publishVersionChange publishes an archived or deleted event for a version
+// of a file. The size and modified time are looked up in the db.
+func publishVersionChange(ctx *context, kind string, file string, num int,
+	key string) {
+	if len(ctx.src.publishers) == 0 {
+		return
+	}
+	e := changeEvent{Type: kind, Path: file, Version: num, Key: key}
+	var err error
+	if e.ModTime, e.Size, err = dbVersionInfo(ctx, file, num); err != nil {
+		errOut("Error in getting version info", err)
+	}
+	publishEvent(ctx, e)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/smallfish/simpleyaml"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFilePublisher(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.src.name = "ncbi"
+	ctx.runId = "ncbi-20170804T220841Z"
+	ctx.src.publishers = []publisher{filePublisher{"/events/changes.jsonl", &sync.Mutex{}}}
+	rows := sqlmock.NewRows([]string{"DateModified", "Size"}).AddRow("2017-08-01 10:00:00", 10)
+	mock.ExpectQuery("select DateModified, Size from entries").WithArgs("/pub/a", 1).WillReturnRows(rows)
+
+	publishVersionChange(ctx, eventArchived, "/pub/a", 1, "archive/abc")
+	publishEvent(ctx, changeEvent{Type: eventNewVersion, Path: "/pub/a", Version: 2, Key: "pub/a", Size: 12})
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	data, err := afero.ReadFile(ctx.os, "/events/changes.jsonl")
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, 2, len(lines))
+	e := changeEvent{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &e))
+	assert.Equal(t, eventArchived, e.Type)
+	assert.Equal(t, "ncbi", e.Source)
+	assert.Equal(t, ctx.runId, e.RunId)
+	assert.Equal(t, "archive/abc", e.Key)
+	assert.Equal(t, 10, e.Size)
+	assert.Equal(t, "2017-08-01 10:00:00", e.ModTime)
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &e))
+	assert.Equal(t, 2, e.Version)
+}
+
+func TestHTTPPublisher(t *testing.T) {
+	_, ctx := testSetup(t)
+	p := httpPublisher{testServer.URL + "/hooks", &http.Client{Timeout: 5 * time.Second}}
+	testServer.Response(204, nil, "")
+	assert.Nil(t, p.publish(ctx, changeEvent{Type: eventDeleted, Path: "/pub/a"}))
+	req := testServer.WaitRequest()
+	assert.Equal(t, "POST", req.Method)
+	assert.Equal(t, "/hooks", req.URL.Path)
+	body, _ := ioutil.ReadAll(req.Body)
+	assert.Contains(t, string(body), `"type":"deleted"`)
+
+	testServer.Response(500, nil, "")
+	assert.NotNil(t, p.publish(ctx, changeEvent{Type: eventDeleted, Path: "/pub/a"}))
+	testServer.WaitRequest()
+}
+
+func TestSNSPublisher(t *testing.T) {
+	_, ctx := testSetup(t)
+	sess := session.Must(session.NewSession())
+	svc := sns.New(sess)
+	svc.Endpoint = testServer.URL
+	p := snsPublisher{svc, "arn:aws:sns:us-west-2:123456789012:changes"}
+	testServer.Response(200, nil, "<PublishResponse><PublishResult><MessageId>1</MessageId></PublishResult></PublishResponse>")
+	assert.Nil(t, p.publish(ctx, changeEvent{Type: eventNewVersion, Path: "/pub/a"}))
+	req := testServer.WaitRequest()
+	assert.Equal(t, "Publish", req.Form.Get("Action"))
+	assert.Equal(t, "arn:aws:sns:us-west-2:123456789012:changes", req.Form.Get("TopicArn"))
+	assert.Contains(t, req.Form.Get("Message"), `"path":"/pub/a"`)
+}
+
+func TestLoadPublishers(t *testing.T) {
+	yml, _ := simpleyaml.NewYaml([]byte(`
+events:
+  - type: http
+    url: http://localhost/hooks
+  - type: file
+    path: /tmp/events.jsonl
+`))
+	res := loadPublishers(yml)
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, "http://localhost/hooks", res[0].(httpPublisher).url)
+	assert.Equal(t, "/tmp/events.jsonl", res[1].(filePublisher).path)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"github.com/smallfish/simpleyaml"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A fileFilters represents the selection rules of a syncFolder that are
+// applied to the remote listing. Zero values mean no rule.
+type fileFilters struct {
+	minSize    int
+	maxSize    int
+	match      *regexp.Regexp // Paths must match
+	exclude    *regexp.Regexp // Paths must not match
+	after      time.Time      // Modified after
+	before     time.Time      // Modified before
+	latestDirs int            // Latest dated subdirectories to keep
+}
+
+// A filterDecision represents whether a file was kept and the rule that
+// decided it. Kept files list every rule they passed.
+type filterDecision struct {
+	kept bool
+	rule string
+}
+
+func (d filterDecision) String() string {
+	switch {
+	case !d.kept:
+		return "dropped by " + d.rule
+	case d.rule == "":
+		return "kept, no rule applies"
+	}
+	return "kept by " + d.rule
+}
+
+// datedDir matches directory names with a date. Ex: 2017-08-04, v5_20170804
+var datedDir = regexp.MustCompile(`(\d{4})[-_.]?(\d{2})[-_.]?(\d{2})`)
+
+// loadFilters loads the optional filters of a folder. Sizes take K, M, or G
+// suffixes and dates are in UTC.
+// Ex: filters: {minSize: 1K, match: '\.gz$', latestDirs: 2}
+func loadFilters(folder *simpleyaml.Yaml) fileFilters {
+	res := fileFilters{}
+	item := folder.Get("filters")
+	if !item.IsFound() {
+		return res
+	}
+	res.minSize = loadSize(item, "minSize")
+	res.maxSize = loadSize(item, "maxSize")
+	res.match = loadRegexp(item, "match")
+	res.exclude = loadRegexp(item, "exclude")
+	res.after = loadDate(item, "modifiedAfter")
+	res.before = loadDate(item, "modifiedBefore")
+	if n, err := item.Get("latestDirs").Int(); err == nil {
+		res.latestDirs = n
+	}
+	return res
+}
+
+// loadSize loads an optional size in bytes. Sizes use the same suffixes as
+// bandwidth rates.
+func loadSize(yml *simpleyaml.Yaml, key string) int {
+	if n, err := yml.Get(key).Int(); err == nil {
+		return n
+	}
+	str := optionalString(yml, key, "")
+	if str == "" {
+		return 0
+	}
+	size, err := parseRate(str)
+	if err != nil {
+		log.Fatal("Error in loading filter "+key+". ", err)
+	}
+	return size
+}
+
+// loadRegexp loads an optional regular expression. Returns nil if not set.
+func loadRegexp(yml *simpleyaml.Yaml, key string) *regexp.Regexp {
+	str := optionalString(yml, key, "")
+	if str == "" {
+		return nil
+	}
+	res, err := regexp.Compile(str)
+	if err != nil {
+		log.Fatal("Error in loading filter "+key+". ", err)
+	}
+	return res
+}
+
+// loadDate loads an optional date or time. A date without a time means the
+// start of that day.
+func loadDate(yml *simpleyaml.Yaml, key string) time.Time {
+	str := optionalString(yml, key, "")
+	if str == "" {
+		return time.Time{}
+	}
+	res, err := time.Parse("2006-01-02", str)
+	if err != nil {
+		if res, err = parseDbTime(str); err != nil {
+			log.Fatal("Error in loading filter "+key+". ", err)
+		}
+	}
+	return res
+}
+
+// active reports whether any filter is set.
+func (f fileFilters) active() bool {
+	return f.minSize > 0 || f.maxSize > 0 || f.match != nil ||
+		f.exclude != nil || !f.after.IsZero() || !f.before.IsZero() ||
+		f.latestDirs > 0
+}
+
+// filterFiles applies the filters of a folder to the files listed on the
+// remote. Returns the decision for each file, or nothing if the folder has
+// no filters.
+func filterFiles(folder syncFolder,
+	files map[string]fInfo) map[string]filterDecision {
+	res := make(map[string]filterDecision)
+	f := folder.filters
+	if !f.active() {
+		return res
+	}
+	latest := latestDatedDirs(folder.sourcePath, files, f.latestDirs)
+	for name, info := range files {
+		res[name] = f.decide(folder.sourcePath, info, latest)
+	}
+	return res
+}
+
+// decide checks a file against each rule in turn. The first rule it fails
+// drops it.
+func (f fileFilters) decide(base string, info fInfo,
+	latest map[string]bool) filterDecision {
+	passed := []string{}
+	dropped := ""
+	test := func(applies bool, ok bool, rule string) {
+		if !applies || dropped != "" {
+			return
+		}
+		if ok {
+			passed = append(passed, rule)
+		} else {
+			dropped = rule
+		}
+	}
+
+	test(f.minSize > 0, info.size >= f.minSize,
+		fmt.Sprintf("minSize %d", f.minSize))
+	test(f.maxSize > 0, info.size <= f.maxSize,
+		fmt.Sprintf("maxSize %d", f.maxSize))
+	test(f.match != nil, f.match != nil && f.match.MatchString(info.name),
+		fmt.Sprintf("match %s", f.match))
+	test(f.exclude != nil, f.exclude != nil &&
+		!f.exclude.MatchString(info.name), fmt.Sprintf("exclude %s", f.exclude))
+	// Files with unknown modified times aren't dropped by date.
+	modTime, err := parseDbTime(info.modTime)
+	test(!f.after.IsZero() && err == nil, modTime.After(f.after),
+		"modifiedAfter "+f.after.Format(time.RFC3339))
+	test(!f.before.IsZero() && err == nil, modTime.Before(f.before),
+		"modifiedBefore "+f.before.Format(time.RFC3339))
+	// Files outside dated subdirectories aren't dropped by latestDirs.
+	dir := datedDirOf(base, info.name)
+	test(f.latestDirs > 0 && dir != "", latest[dir],
+		fmt.Sprintf("latestDirs %d (%s)", f.latestDirs, dir))
+
+	if dropped != "" {
+		return filterDecision{false, dropped}
+	}
+	return filterDecision{true, strings.Join(passed, ", ")}
+}
+
+// datedDirOf gets the subdirectory of a folder that a file is in if its name
+// has a date. Returns "" otherwise.
+func datedDirOf(base string, file string) string {
+	rel := strings.TrimPrefix(file, strings.TrimSuffix(base, "/")+"/")
+	parts := strings.SplitN(rel, "/", 2)
+	if len(parts) < 2 || !datedDir.MatchString(parts[0]) {
+		return ""
+	}
+	return parts[0]
+}
+
+// byDate sorts dated directory names by their dates, latest first.
+type byDate []string
+
+func (d byDate) Len() int      { return len(d) }
+func (d byDate) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d byDate) Less(i, j int) bool {
+	return dateOfDir(d[i]) > dateOfDir(d[j])
+}
+
+// dateOfDir gets the date in a directory name as YYYYMMDD.
+func dateOfDir(name string) string {
+	m := datedDir.FindStringSubmatch(name)
+	if m == nil {
+		return ""
+	}
+	return m[1] + m[2] + m[3]
+}
+
+// latestDatedDirs finds the latest n dated subdirectories of a folder among
+// the files listed.
+func latestDatedDirs(base string, files map[string]fInfo,
+	n int) map[string]bool {
+	res := make(map[string]bool)
+	if n < 1 {
+		return res
+	}
+	seen := make(map[string]bool)
+	dirs := []string{}
+	for name := range files {
+		if dir := datedDirOf(base, name); dir != "" && !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	sort.Stable(byDate(dirs))
+	for i := 0; i < n && i < len(dirs); i++ {
+		res[dirs[i]] = true
+	}
+	return res
+}
+
+// logFilterDecisions logs the files dropped by filters and how many were
+// kept.
+func logFilterDecisions(decisions map[string]filterDecision) {
+	if len(decisions) == 0 {
+		return
+	}
+	names := []string{}
+	for name := range decisions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	kept := 0
+	for _, name := range names {
+		if decisions[name].kept {
+			kept++
+			continue
+		}
+		log.Printf("Filtered out %s: %s", name, decisions[name])
+	}
+	log.Printf("Filters kept %d of %d files.", kept, len(names))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/smallfish/simpleyaml"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestLoadFilters(t *testing.T) {
+	yml, err := simpleyaml.NewYaml([]byte(`
+filters:
+  minSize: 1K
+  maxSize: 2048
+  match: '\.gz$'
+  modifiedAfter: 2017-08-01
+  latestDirs: 2
+`))
+	assert.Nil(t, err)
+	res := loadFilters(yml)
+	assert.Equal(t, 1024, res.minSize)
+	assert.Equal(t, 2048, res.maxSize)
+	assert.Equal(t, `\.gz$`, res.match.String())
+	assert.Nil(t, res.exclude)
+	assert.Equal(t, time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), res.after)
+	assert.True(t, res.before.IsZero())
+	assert.Equal(t, 2, res.latestDirs)
+
+	yml, _ = simpleyaml.NewYaml([]byte("name: /pub"))
+	assert.False(t, loadFilters(yml).active())
+}
+
+func TestFilterFiles(t *testing.T) {
+	folder := syncFolder{
+		sourcePath: "/blast/db",
+		filters: fileFilters{
+			minSize:    10,
+			exclude:    regexp.MustCompile(`\.md5$`),
+			before:     time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC),
+			latestDirs: 2,
+		},
+	}
+	files := map[string]fInfo{
+		"/blast/db/README":            {"/blast/db/README", "2017-08-04T10:00:00", 100},
+		"/blast/db/tiny":              {"/blast/db/tiny", "2017-08-04T10:00:00", 5},
+		"/blast/db/nt.tar.gz.md5":     {"/blast/db/nt.tar.gz.md5", "2017-08-04T10:00:00", 50},
+		"/blast/db/new":               {"/blast/db/new", "2017-09-04T10:00:00", 50},
+		"/blast/db/2017-06-01/nt.gz":  {"/blast/db/2017-06-01/nt.gz", "2017-06-01T10:00:00", 50},
+		"/blast/db/2017-07-01/nt.gz":  {"/blast/db/2017-07-01/nt.gz", "2017-07-01T10:00:00", 50},
+		"/blast/db/v5_20170801/nt.gz": {"/blast/db/v5_20170801/nt.gz", "2017-08-01T10:00:00", 50},
+		"/blast/db/unknown/nt.gz":     {"/blast/db/unknown/nt.gz", "", 50},
+	}
+	res := filterFiles(folder, files)
+	assert.Equal(t, len(files), len(res))
+	assert.Equal(t, "kept by minSize 10, exclude \\.md5$, modifiedBefore 2017-09-01T00:00:00Z",
+		res["/blast/db/README"].String())
+	assert.Equal(t, "dropped by minSize 10", res["/blast/db/tiny"].String())
+	assert.Equal(t, "dropped by exclude \\.md5$", res["/blast/db/nt.tar.gz.md5"].String())
+	assert.Equal(t, "dropped by modifiedBefore 2017-09-01T00:00:00Z", res["/blast/db/new"].String())
+	assert.Equal(t, "dropped by latestDirs 2 (2017-06-01)", res["/blast/db/2017-06-01/nt.gz"].String())
+	assert.True(t, res["/blast/db/2017-07-01/nt.gz"].kept)
+	assert.True(t, res["/blast/db/v5_20170801/nt.gz"].kept)
+	assert.True(t, res["/blast/db/unknown/nt.gz"].kept)
+
+	assert.Empty(t, filterFiles(syncFolder{sourcePath: "/blast/db"}, files))
+}
+
+func TestDatedDirOf(t *testing.T) {
+	assert.Equal(t, "2017-08-04", datedDirOf("/pub", "/pub/2017-08-04/a"))
+	assert.Equal(t, "", datedDirOf("/pub", "/pub/2017-08-04"))
+	assert.Equal(t, "", datedDirOf("/pub", "/pub/latest/a"))
+	assert.Equal(t, "20170804", dateOfDir("release_2017.08.04"))
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"github.com/jlaffaye/ftp"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -13,15 +14,15 @@ var getModTime = getModTimeFTP
 
 // getServerListing gets a listing of files and modified times from the FTP
 // server. Returns a map of the file pathName to the modTime.
-func getServerListing(dir string) (map[string]string, error) {
+func getServerListing(ctx *context, dir string) (map[string]string, error) {
 	// Open FTP connection
 	FileToTime := make(map[string]string)
-	client, err := connectToServer()
+	client, err := connectToServer(ctx)
 	if err != nil {
 		return FileToTime, handle("Error in connecting to FTP server.", err)
 	}
 	defer func() {
-		if err = client.Quit(); err != nil {
+		if err = quitServer(client); err != nil {
 			errOut("Error in quitting FTP connection", err)
 		}
 	}()
@@ -44,31 +45,54 @@ func clientListFtp(client *ftp.ServerConn, dir string) ([]*ftp.Entry, error) {
 	return client.List(dir)
 }
 
-// connectToServer connects to the FTP server and returns the client
-// connection.
-func connectToServer() (*ftp.ServerConn, error) {
-	addr := "ftp.ncbi.nih.gov:21"
+// serverHost gets the host of the current source's server without a scheme
+// or trailing slash.
+func serverHost(ctx *context) string {
+	host := ctx.server
+	if host == "" {
+		host = "ftp.ncbi.nih.gov"
+	}
+	if i := strings.Index(host, "://"); i > -1 {
+		host = host[i+3:]
+	}
+	return strings.TrimSuffix(host, "/")
+}
+
+// connectToServer connects to the FTP server of the current source and
+// returns the client connection. Logs in anonymously unless the source has
+// credentials.
+func connectToServer(ctx *context) (*ftp.ServerConn, error) {
+	addr := serverHost(ctx)
+	if !strings.Contains(addr, ":") {
+		addr += ":21"
+	}
 	client, err := ftp.Dial(addr)
 	if err != nil {
 		return nil, handle("Error in dialing FTP server.", err)
 	}
-	err = client.Login("anonymous", "test@test.com")
+	user, pass := "anonymous", "test@test.com"
+	if ctx.src.username != "" {
+		user, pass = ctx.src.username, ctx.src.password
+	}
+	err = client.Login(user, pass)
 	if err != nil {
 		return nil, handle("Error in logging in to FTP server.", err)
 	}
+	trackConn(client)
 	return client, err
 }
 
 // getModTimeFTP gets the date modified times from the FTP server utilizing a
 // directory listing cache.
-func getModTimeFTP(path string, cache map[string]map[string]string) string {
+func getModTimeFTP(ctx *context, path string,
+	cache map[string]map[string]string) string {
 	var err error
 	dir := filepath.Dir(path)
 	file := filepath.Base(path)
 	_, present := cache[dir]
 	if !present {
 		// Get listing from server
-		cache[dir], err = getServerListing(dir)
+		cache[dir], err = getServerListing(ctx, dir)
 		if err != nil {
 			errOut("Error in getting listing from FTP server.", err)
 		}
@@ -11,7 +11,7 @@ func FakeClientList(client *ftp.ServerConn, dir string) ([]*ftp.Entry, error) {
 	return []*ftp.Entry{&res}, nil
 }
 
-func FakeGetModTime(pathName string,
+func FakeGetModTime(ctx *context, pathName string,
 	cache map[string]map[string]string) string {
 	return "2017-08-02T22:20:26"
 }
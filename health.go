@@ -0,0 +1,229 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/smallfish/simpleyaml"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Health check defaults. Runs are scheduled every 12 hours.
+const (
+	defaultStaleAfter = 26 * time.Hour
+	defaultStuckAfter = 6 * time.Hour
+	checkTimeout      = 5 * time.Second
+)
+
+// daemonStarted is when the process started. Folders that haven't synced
+// yet are as old as the process.
+var daemonStarted = time.Now()
+
+// dialRemote connects to a remote server. Replaced in tests.
+var dialRemote = net.DialTimeout
+
+// A healthConfig represents the thresholds of the health endpoints. Runs
+// making no progress for stuckAfter fail liveness. Folders without a
+// successful run for staleAfter fail readiness.
+type healthConfig struct {
+	staleAfter time.Duration
+	stuckAfter time.Duration
+}
+
+// A healthReport represents the state of the daemon. Checks are "ok" or an
+// error message.
+type healthReport struct {
+	Status  string            `json:"status"`
+	Checks  map[string]string `json:"checks,omitempty"`
+	Sources []sourceHealth    `json:"sources"`
+}
+
+// A sourceHealth represents the run state of a source.
+type sourceHealth struct {
+	Name         string         `json:"name"`
+	Running      bool           `json:"running"`
+	Stage        string         `json:"stage,omitempty"`
+	Current      int            `json:"current,omitempty"`
+	Total        int            `json:"total,omitempty"`
+	RunStarted   string         `json:"runStarted,omitempty"`
+	LastProgress string         `json:"lastProgress,omitempty"`
+	LastSuccess  string         `json:"lastSuccess,omitempty"`
+	LastError    string         `json:"lastError,omitempty"`
+	Stuck        bool           `json:"stuck,omitempty"`
+	Folders      []folderHealth `json:"folders"`
+}
+
+// A folderHealth represents how long ago a folder last synced without
+// failures.
+type folderHealth struct {
+	Path         string `json:"path"`
+	LastSuccess  string `json:"lastSuccess,omitempty"`
+	SinceSuccess string `json:"sinceSuccess"`
+	Stale        bool   `json:"stale,omitempty"`
+}
+
+// loadHealthConfig loads the optional health thresholds.
+// Ex: health: {staleAfter: 26h, stuckAfter: 6h}
+func loadHealthConfig(yml *simpleyaml.Yaml) healthConfig {
+	item := yml.Get("health")
+	return healthConfig{
+		staleAfter: loadDuration(item, "staleAfter", defaultStaleAfter),
+		stuckAfter: loadDuration(item, "stuckAfter", defaultStuckAfter),
+	}
+}
+
+// loadDuration loads an optional duration. Ex: 26h, 90m
+func loadDuration(yml *simpleyaml.Yaml, key string,
+	fallback time.Duration) time.Duration {
+	str := optionalString(yml, key, "")
+	if str == "" {
+		return fallback
+	}
+	res, err := time.ParseDuration(str)
+	if err != nil {
+		log.Fatal("Error in loading "+key+". ", err)
+	}
+	return res
+}
+
+// sourceState reports the run state of a source and the age of the last
+// successful run of each of its folders.
+func sourceState(ctx *context, src source) sourceHealth {
+	stats := statsFor(ctx, src.name)
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	cur := now()
+	res := sourceHealth{
+		Name:        src.name,
+		Running:     stats.running,
+		Stage:       stats.stage,
+		Current:     stats.current,
+		Total:       stats.total,
+		LastSuccess: formatTime(stats.lastSuccess),
+		Folders:     []folderHealth{},
+	}
+	if stats.running {
+		res.RunStarted = formatTime(stats.lastStart)
+		res.LastProgress = formatTime(stats.lastProgress)
+		res.Stuck = cur.Sub(stats.lastProgress) > ctx.health.stuckAfter
+	}
+	if stats.lastErr != nil {
+		res.LastError = stats.lastErr.Error()
+	}
+	for _, folder := range src.syncFolders {
+		last := stats.folderSuccess[folder.sourcePath]
+		since := daemonStarted
+		if !last.IsZero() {
+			since = last
+		}
+		limit := ctx.health.staleAfter
+		if folder.staleAfter > 0 {
+			limit = folder.staleAfter
+		}
+		age := cur.Sub(since)
+		res.Folders = append(res.Folders, folderHealth{
+			Path:         folder.sourcePath,
+			LastSuccess:  formatTime(last),
+			SinceSuccess: age.String(),
+			Stale:        age > limit,
+		})
+	}
+	return res
+}
+
+// formatTime formats a time for reports. Zero times are empty.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// liveness reports the run state of every source. Fails if a run has made
+// no progress for too long.
+func liveness(ctx *context) healthReport {
+	res := healthReport{Status: "ok"}
+	for _, src := range syncSources(ctx) {
+		state := sourceState(ctx, src)
+		if state.Stuck {
+			res.Status = "failing"
+		}
+		res.Sources = append(res.Sources, state)
+	}
+	return res
+}
+
+// readiness checks the db, the buckets, and the remote servers in addition
+// to the run state. Fails if any is unreachable or a folder is stale.
+func readiness(ctx *context) healthReport {
+	res := liveness(ctx)
+	res.Checks = make(map[string]string)
+	check := func(name string, err error) {
+		res.Checks[name] = "ok"
+		if err != nil {
+			res.Checks[name] = err.Error()
+			res.Status = "failing"
+		}
+	}
+	check("database", ctx.db.Ping())
+	for _, src := range syncSources(ctx) {
+		if _, present := res.Checks["bucket "+src.bucket]; !present {
+			_, err := ctx.svcS3.HeadBucket(&s3.HeadBucketInput{
+				Bucket: aws.String(src.bucket),
+			})
+			check("bucket "+src.bucket, err)
+		}
+		for _, addr := range remoteAddrs(sourceContext(ctx, src)) {
+			if _, present := res.Checks["remote "+addr]; present {
+				continue
+			}
+			conn, err := dialRemote("tcp", addr, checkTimeout)
+			if err == nil {
+				errOut("Error in closing connection", conn.Close())
+			}
+			check("remote "+addr, err)
+		}
+	}
+	for _, state := range res.Sources {
+		for _, folder := range state.Folders {
+			if folder.Stale {
+				res.Status = "failing"
+			}
+		}
+	}
+	return res
+}
+
+// remoteAddrs gets the hosts and ports the current source is synced from.
+// Folders are listed over rsync and files are downloaded over the source's
+// protocol. A port set on the server is used for both, as when syncing.
+func remoteAddrs(ctx *context) []string {
+	host := serverHost(ctx)
+	if strings.Contains(host, ":") {
+		return []string{host}
+	}
+	port := "21"
+	switch ctx.src.protocol {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	}
+	return []string{host + ":873", host + ":" + port}
+}
+
+// handleHealth answers a health endpoint with a report. Failing reports get
+// a 503 so that orchestrators act on them.
+func handleHealth(ctx *context, report func(*context) healthReport) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := report(ctx)
+		status := http.StatusOK
+		if res.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, res)
+	}
+}
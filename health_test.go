@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLiveness(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.health = healthConfig{staleAfter: time.Hour, stuckAfter: time.Hour}
+	src := source{name: "ncbi", syncFolders: []syncFolder{
+		{sourcePath: "/pub/taxonomy"},
+		{sourcePath: "/blast/db", staleAfter: 100 * time.Hour},
+	}}
+	ctx.sources = []source{src}
+
+	stats := statsFor(ctx, "ncbi")
+	stats.start()
+	stats.setStage(stageFiles, 4)
+	stats.advance()
+	stats.fileFailed("/blast/db")
+	stats.finish(sourceContext(ctx, src), syncResult{newF: []string{"/pub/taxonomy/a"}}, 1)
+	stats.start()
+	stats.advance()
+
+	res := liveness(ctx)
+	assert.Equal(t, "ok", res.Status)
+	state := res.Sources[0]
+	assert.True(t, state.Running)
+	assert.Equal(t, stageDryRun, state.Stage)
+	assert.Equal(t, 1, state.Current)
+	assert.NotEmpty(t, state.Folders[0].LastSuccess)
+	assert.False(t, state.Folders[0].Stale)
+	// Never synced without failures, so as old as the process.
+	assert.Empty(t, state.Folders[1].LastSuccess)
+	assert.False(t, state.Folders[1].Stale)
+
+	// A run without progress is stuck.
+	stats.lastProgress = time.Now().Add(-2 * time.Hour)
+	res = liveness(ctx)
+	assert.Equal(t, "failing", res.Status)
+	assert.True(t, res.Sources[0].Stuck)
+}
+
+func TestReadiness(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.health = healthConfig{staleAfter: time.Hour, stuckAfter: time.Hour}
+	ctx.sources = []source{{name: "ncbi", server: "ftp.ncbi.nih.gov", bucket: "bucket",
+		syncFolders: []syncFolder{{sourcePath: "/pub"}}}}
+	statsFor(ctx, "ncbi").finish(sourceContext(ctx, ctx.sources[0]), syncResult{}, 0)
+	tmp := dialRemote
+	defer func() { dialRemote = tmp }()
+	dialed := []string{}
+	dialRemote = func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return nil, errors.New("connection refused")
+	}
+
+	testServer.Response(200, nil, "")
+	rec := httptest.NewRecorder()
+	apiHandler(ctx).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	testServer.WaitRequest()
+	assert.Equal(t, 503, rec.Code)
+	assert.Equal(t, []string{"ftp.ncbi.nih.gov:873", "ftp.ncbi.nih.gov:21"}, dialed)
+	res := healthReport{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, "ok", res.Checks["database"])
+	assert.Equal(t, "ok", res.Checks["bucket bucket"])
+	assert.Equal(t, "connection refused", res.Checks["remote ftp.ncbi.nih.gov:21"])
+	assert.False(t, res.Sources[0].Folders[0].Stale)
+
+	rec = httptest.NewRecorder()
+	apiHandler(ctx).ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 200, rec.Code)
+}
+
+func TestRemoteAddrs(t *testing.T) {
+	ctx := &context{server: "rsync://ftp.ncbi.nih.gov/"}
+	assert.Equal(t, []string{"ftp.ncbi.nih.gov:873", "ftp.ncbi.nih.gov:21"}, remoteAddrs(ctx))
+	ctx = &context{server: "ftp.ebi.ac.uk", src: source{protocol: "https"}}
+	assert.Equal(t, []string{"ftp.ebi.ac.uk:873", "ftp.ebi.ac.uk:443"}, remoteAddrs(ctx))
+	ctx = &context{server: "rsync://mirror.example.org:8873"}
+	assert.Equal(t, []string{"mirror.example.org:8873"}, remoteAddrs(ctx))
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/smallfish/simpleyaml"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultHookTimeout is how long a hook may run if its config doesn't say.
+const defaultHookTimeout = 5 * time.Minute
+
+// maxHookOutput is how many bytes of a hook's output are recorded.
+const maxHookOutput = 64 * 1024
+
+// A hook represents a command run after the file operations of a run that
+// changed files in its folder.
+type hook struct {
+	command string
+	timeout time.Duration
+}
+
+// A hookChange represents one changed file passed to hooks.
+type hookChange struct {
+	Path    string `json:"path"`
+	Version int    `json:"version"`
+	Key     string `json:"key"`
+}
+
+// A hookPayload represents the changes of a folder in a run. It is written
+// to the stdin of hooks as JSON.
+type hookPayload struct {
+	RunId    string       `json:"runId"`
+	Source   string       `json:"source"`
+	Folder   string       `json:"folder"`
+	New      []hookChange `json:"new"`
+	Modified []hookChange `json:"modified"`
+	Deleted  []hookChange `json:"deleted"`
+}
+
+// A hookResult represents the outcome of running a hook.
+type hookResult struct {
+	exitStatus int // -1 if the hook didn't exit on its own
+	timedOut   bool
+	output     string // Combined stdout and stderr
+	started    time.Time
+	ended      time.Time
+}
+
+// loadHooks loads the optional onChange hooks of a folder. Each is a command,
+// or a command with a timeout.
+// Ex: onChange: [{command: reindex.sh, timeout: 10m}]
+func loadHooks(folder *simpleyaml.Yaml) []hook {
+	res := []hook{}
+	size, err := folder.Get("onChange").GetArraySize()
+	if err != nil {
+		return res
+	}
+	for i := 0; i < size; i++ {
+		item := folder.Get("onChange").GetIndex(i)
+		h := hook{timeout: defaultHookTimeout}
+		if str, err := item.String(); err == nil {
+			h.command = str
+		} else {
+			h.command = optionalString(item, "command", "")
+			if str = optionalString(item, "timeout", ""); str != "" {
+				if h.timeout, err = time.ParseDuration(str); err != nil {
+					log.Fatal("Error in loading hook timeout. ", err)
+				}
+			}
+		}
+		if h.command == "" {
+			log.Fatal("No command set for onChange hook.")
+		}
+		res = append(res, h)
+	}
+	return res
+}
+
+// hookStage runs the onChange hooks of each folder with changes in a run.
+// Outcomes are recorded against the run. Returns the number of hooks that
+// failed or timed out.
+func hookStage(ctx *context, res syncResult) int {
+	failed := 0
+	for _, folder := range ctx.syncFolders {
+		if len(folder.onChange) == 0 {
+			continue
+		}
+		payload := folderChanges(ctx, folder, res)
+		if len(payload.New)+len(payload.Modified)+len(payload.Deleted) == 0 {
+			continue
+		}
+		for i, h := range folder.onChange {
+			log.Printf("Running onChange hook for %s: %s", folder.sourcePath,
+				h.command)
+			result, err := runHook(h, payload)
+			if err != nil {
+				errOut("Error in running hook "+h.command, err)
+			}
+			if err != nil || result.exitStatus != 0 {
+				failed++
+			}
+			if err = dbAddHookRun(ctx, folder.sourcePath, i, h,
+				result); err != nil {
+				errOut("Error in recording hook run", err)
+			}
+		}
+	}
+	return failed
+}
+
+// folderChanges gets the changes of a run within a folder with their latest
+// versions and keys.
+func folderChanges(ctx *context, folder syncFolder,
+	res syncResult) hookPayload {
+	payload := hookPayload{
+		RunId:    ctx.runId,
+		Source:   ctx.src.name,
+		Folder:   folder.sourcePath,
+		New:      []hookChange{},
+		Modified: []hookChange{},
+		Deleted:  []hookChange{},
+	}
+	changes := func(files []string) []hookChange {
+		list := []hookChange{}
+		for _, file := range files {
+			if folderOf(ctx, file).sourcePath != folder.sourcePath {
+				continue
+			}
+			change := hookChange{Path: file, Key: objectKey(ctx, file)}
+			change.Version = lastVersionNum(ctx, file, true)
+			if change.Version > 0 {
+				key, _, err := dbVersionLocation(ctx, file, change.Version)
+				if err == nil {
+					change.Key = key
+				}
+			}
+			list = append(list, change)
+		}
+		return list
+	}
+	payload.New = changes(res.newF)
+	payload.Modified = changes(res.modified)
+	payload.Deleted = changes(res.deleted)
+	return payload
+}
+
+// hookEnv gets the environment variables describing changes to hooks. Each
+// kind of change has newline separated lists of paths, versions, and keys in
+// the same order. Ex: SYNC_NEW_PATHS, SYNC_NEW_VERSIONS, SYNC_NEW_KEYS
+func hookEnv(payload hookPayload) []string {
+	res := []string{
+		"SYNC_RUN_ID=" + payload.RunId,
+		"SYNC_SOURCE=" + payload.Source,
+		"SYNC_FOLDER=" + payload.Folder,
+	}
+	add := func(kind string, changes []hookChange) {
+		var paths, versions, keys []string
+		for _, c := range changes {
+			paths = append(paths, c.Path)
+			versions = append(versions, strconv.Itoa(c.Version))
+			keys = append(keys, c.Key)
+		}
+		res = append(res,
+			"SYNC_"+kind+"_PATHS="+strings.Join(paths, "\n"),
+			"SYNC_"+kind+"_VERSIONS="+strings.Join(versions, "\n"),
+			"SYNC_"+kind+"_KEYS="+strings.Join(keys, "\n"))
+	}
+	add("NEW", payload.New)
+	add("MODIFIED", payload.Modified)
+	add("DELETED", payload.Deleted)
+	return res
+}
+
+// runHook runs a hook command with the payload as JSON on stdin and in the
+// environment. The command is killed after the hook's timeout.
+func runHook(h hook, payload hookPayload) (hookResult, error) {
+	res := hookResult{exitStatus: -1, started: now()}
+	input, err := json.Marshal(payload)
+	if err != nil {
+		return res, handle("Error in encoding hook payload.", err)
+	}
+	cmd := exec.Command("sh", "-c", h.command)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = append(os.Environ(), hookEnv(payload)...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// Run the hook in its own process group so that children are killed too.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err = cmd.Start(); err != nil {
+		return res, handle("Error in starting hook.", err)
+	}
+	timer := time.AfterFunc(h.timeout, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err = cmd.Wait()
+	// The timer already fired if it can't be stopped.
+	res.timedOut = !timer.Stop()
+	res.ended = now()
+	res.output = output.String()
+	if len(res.output) > maxHookOutput {
+		res.output = res.output[len(res.output)-maxHookOutput:]
+	}
+
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok &&
+		status.Exited() {
+		res.exitStatus = status.ExitStatus()
+	}
+	if res.timedOut {
+		return res, fmt.Errorf("hook timed out after %s", h.timeout)
+	}
+	if _, exited := err.(*exec.ExitError); exited {
+		log.Printf("Hook exited with status %d: %s", res.exitStatus,
+			res.output)
+		return res, nil
+	}
+	return res, err
+}
+
+// dbAddHookRun records the outcome of a hook against the current run.
+func dbAddHookRun(ctx *context, folder string, num int, h hook,
+	res hookResult) error {
+	timedOut := 0
+	if res.timedOut {
+		timedOut = 1
+	}
+	_, err := ctx.db.Exec("insert into hook_runs (RunId, Folder, HookNum, "+
+		"Command, ExitStatus, TimedOut, Output, DateStarted, DateEnded) "+
+		"values (?, ?, ?, ?, ?, ?, ?, ?, ?);", ctx.runId, folder, num,
+		h.command, res.exitStatus, timedOut, res.output, dbTime(res.started),
+		dbTime(res.ended))
+	if err != nil {
+		return handle("Error in inserting hook run.", err)
+	}
+	return err
+}
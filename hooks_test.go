@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/smallfish/simpleyaml"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadHooks(t *testing.T) {
+	yml, err := simpleyaml.NewYaml([]byte(`
+onChange:
+  - reindex.sh
+  - command: invalidate.sh
+    timeout: 30s
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, []hook{
+		{"reindex.sh", defaultHookTimeout},
+		{"invalidate.sh", 30 * time.Second},
+	}, loadHooks(yml))
+
+	yml, _ = simpleyaml.NewYaml([]byte("name: /pub"))
+	assert.Empty(t, loadHooks(yml))
+}
+
+func TestRunHook(t *testing.T) {
+	payload := hookPayload{
+		RunId:  "ncbi-20170804T220841Z",
+		Folder: "/pub/taxonomy",
+		New: []hookChange{
+			{"/pub/taxonomy/a", 1, "pub/taxonomy/a"},
+			{"/pub/taxonomy/b", 2, "pub/taxonomy/b"},
+		},
+	}
+	h := hook{"cat; echo; echo \"$SYNC_NEW_VERSIONS\"; exit 3", time.Minute}
+	res, err := runHook(h, payload)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, res.exitStatus)
+	assert.False(t, res.timedOut)
+	lines := strings.Split(res.output, "\n")
+	assert.Contains(t, lines[0], `"runId":"ncbi-20170804T220841Z"`)
+	assert.Contains(t, lines[0], `{"path":"/pub/taxonomy/b","version":2,"key":"pub/taxonomy/b"}`)
+	assert.Equal(t, []string{"1", "2"}, lines[1:3])
+
+	res, err = runHook(hook{"echo started; sleep 10", 100 * time.Millisecond}, payload)
+	assert.NotNil(t, err)
+	assert.True(t, res.timedOut)
+	assert.Equal(t, -1, res.exitStatus)
+	assert.Equal(t, "started\n", res.output)
+}
+
+func TestHookEnv(t *testing.T) {
+	env := hookEnv(hookPayload{
+		RunId:   "run",
+		Deleted: []hookChange{{"/pub/a", 3, "pub/a"}},
+	})
+	assert.Contains(t, env, "SYNC_RUN_ID=run")
+	assert.Contains(t, env, "SYNC_DELETED_PATHS=/pub/a")
+	assert.Contains(t, env, "SYNC_DELETED_VERSIONS=3")
+	assert.Contains(t, env, "SYNC_NEW_KEYS=")
+}
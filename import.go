@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"log"
+	"time"
+)
+
+// importObjects creates version 1 db entries for objects under a path that
+// have no entries, e.g. when a bucket was populated outside of this tool.
+// DateModified is taken from the remote listing if useRemote is set and the
+// file is found there, and from the object's LastModified otherwise. Files
+// with entries are skipped, so imports can be re-run. Returns the number of
+// files imported.
+func importObjects(ctx *context, path string, useRemote bool,
+	dryRun bool) (int, error) {
+	entries, err := dbEntries(ctx, path)
+	if err != nil {
+		return 0, handle("Error in getting entries.", err)
+	}
+	tracked := make(map[string]bool)
+	for _, e := range entries {
+		tracked[e.pathName] = true
+	}
+	objects, err := listFolderObjects(ctx, func(folder syncFolder) string {
+		return objectKey(ctx, folder.sourcePath)
+	})
+	if err != nil {
+		return 0, handle("Error in listing objects.", err)
+	}
+
+	bases := currentKeyBases(ctx)
+	cache := make(map[string]map[string]string)
+	imported, failed := 0, 0
+	for _, key := range sortedObjectKeys(objects) {
+		obj := objects[key]
+		file := fileOfKey(key, bases)
+		// Zero-byte keys are folder placeholders.
+		if tracked[file] || aws.Int64Value(obj.Size) == 0 ||
+			!underPath(file, path) {
+			continue
+		}
+		modTime := ""
+		if useRemote {
+			modTime = getModTime(ctx, file, cache)
+		}
+		if modTime == "" && obj.LastModified != nil {
+			modTime = obj.LastModified.UTC().Format("2006-01-02T15:04:05")
+		}
+		log.Printf("Importing %s modified %s.", file, modTime)
+		if dryRun {
+			imported++
+			continue
+		}
+		err = dbImportVersion(ctx, file, modTime, int(aws.Int64Value(obj.Size)))
+		if err != nil {
+			errOut("Error in importing "+file, err)
+			failed++
+			continue
+		}
+		imported++
+	}
+	log.Printf("Imported %d files with %d failures.", imported, failed)
+	if failed > 0 {
+		return imported, fmt.Errorf("%d files failed to import", failed)
+	}
+	return imported, nil
+}
+
+// dbImportVersion adds the first version of a file stored before it was
+// tracked in the db.
+func dbImportVersion(ctx *context, file string, modTime string,
+	size int) error {
+	_, err := ctx.db.Exec("insert into entries(PathName, VersionNum, "+
+		"DateModified, Size) values(?, ?, ?, ?)", dbPathName(ctx, file), 1,
+		modTime, size)
+	if err != nil {
+		return handle("Error in inserting imported version.", err)
+	}
+	return err
+}
+
+// runImport is the import command. Bootstraps the db from objects already
+// on the bucket.
+func runImport(ctx *context, args []string) error {
+	flags, name := newFlagSet("import")
+	path := flags.String("path", "/", "Only import files under this path.")
+	useRemote := flags.Bool("remote", true, "Get modified times from the "+
+		"remote server listing.")
+	dryRun := flags.Bool("dry", false, "Only log what would be imported.")
+	if err := flags.Parse(args); err != nil {
+		return handle("Error in parsing flags.", err)
+	}
+	srcCtx, err := contextForSource(ctx, *name)
+	if err != nil {
+		return handle("Error in finding source.", err)
+	}
+	start := time.Now()
+	imported, err := importObjects(srcCtx, *path, *useRemote, *dryRun)
+	log.Printf("Import of %d files took %s.", imported, time.Since(start))
+	return err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"testing"
+)
+
+func TestImportObjects(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.bucket = "bucket"
+	ctx.syncFolders = []syncFolder{{sourcePath: "/pub/taxonomy"}}
+	listing := "<ListBucketResult>" +
+		"<Contents><Key>pub/taxonomy/a</Key><Size>8</Size></Contents>" +
+		"<Contents><Key>pub/taxonomy/b</Key><Size>3</Size>" +
+		"<LastModified>2017-08-04T10:00:00.000Z</LastModified></Contents>" +
+		"<Contents><Key>pub/taxonomy/dir/</Key><Size>0</Size></Contents>" +
+		"</ListBucketResult>"
+	rows := sqlmock.NewRows([]string{"PathName", "VersionNum", "DateModified", "ArchiveKey", "VersionId", "Size", "Md5", "Sha256"}).
+		AddRow("/pub/taxonomy/a", 1, nil, nil, nil, 8, nil, nil)
+	mock.ExpectQuery("select PathName, VersionNum").WithArgs("", "/%").WillReturnRows(rows)
+	testServer.Response(200, nil, listing)
+	mock.ExpectExec("insert into entries").WithArgs("/pub/taxonomy/b", 1, "2017-08-04T10:00:00", 3).WillReturnResult(testResult)
+
+	imported, err := importObjects(ctx, "/", false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, imported)
+	testServer.WaitRequest()
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Dry runs don't insert.
+	rows = sqlmock.NewRows([]string{"PathName", "VersionNum", "DateModified", "ArchiveKey", "VersionId", "Size", "Md5", "Sha256"})
+	mock.ExpectQuery("select PathName, VersionNum").WithArgs("/pub/taxonomy/b", "/pub/taxonomy/b/%").WillReturnRows(rows)
+	testServer.Response(200, nil, listing)
+	imported, err = importObjects(ctx, "/pub/taxonomy/b", false, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, imported)
+	testServer.WaitRequest()
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"hash"
+	"io"
+	"strings"
+)
+
+// A checksums represents the digests of bytes written to it. MD5s of each
+// upload part are kept for predicting the ETag of multipart uploads.
+type checksums struct {
+	md5      hash.Hash
+	sha256   hash.Hash
+	part     hash.Hash
+	partSize int
+	inPart   int
+	parts    [][]byte
+	n        int
+}
+
+// newChecksums returns checksums for an upload split into parts of partSize.
+func newChecksums(partSize int) *checksums {
+	return &checksums{md5: md5.New(), sha256: sha256.New(), part: md5.New(),
+		partSize: partSize}
+}
+
+func (c *checksums) Write(p []byte) (int, error) {
+	n := len(p)
+	c.md5.Write(p)
+	c.sha256.Write(p)
+	c.n += n
+	for len(p) > 0 {
+		chunk := p
+		if left := c.partSize - c.inPart; len(chunk) > left {
+			chunk = chunk[:left]
+		}
+		c.part.Write(chunk)
+		c.inPart += len(chunk)
+		p = p[len(chunk):]
+		if c.inPart == c.partSize {
+			c.endPart()
+		}
+	}
+	return n, nil
+}
+
+// endPart finishes the digest of the current part.
+func (c *checksums) endPart() {
+	c.parts = append(c.parts, c.part.Sum(nil))
+	c.part.Reset()
+	c.inPart = 0
+}
+
+// etags gets the ETags S3 may give the object. Single part uploads get the
+// MD5 of the object. Multipart uploads get the MD5 of the part MD5s and the
+// number of parts. Streams of exactly one part may be uploaded either way.
+// Ex: 9b2cf535f27731c974343645a3985328-3
+func (c *checksums) etags() []string {
+	parts := c.parts
+	if c.inPart > 0 {
+		parts = append(parts, c.part.Sum(nil))
+	}
+	all := md5.New()
+	for _, p := range parts {
+		all.Write(p)
+	}
+	multi := fmt.Sprintf("%s-%d", hex.EncodeToString(all.Sum(nil)),
+		len(parts))
+	if len(parts) > 1 {
+		return []string{multi}
+	}
+	return []string{hex.EncodeToString(c.md5.Sum(nil)), multi}
+}
+
+// verify checks the ETag S3 returned for an upload against the transferred
+// bytes.
+func (c *checksums) verify(etag *string) error {
+	if etag == nil {
+		return nil
+	}
+	got := strings.Trim(*etag, "\"")
+	expected := c.etags()
+	for _, e := range expected {
+		if got == e {
+			return nil
+		}
+	}
+	return fmt.Errorf("ETag %s doesn't match expected %s", got, expected[0])
+}
+
+// setInfo records the size and hex checksums on upload details.
+func (c *checksums) setInfo(info *uploadInfo) {
+	info.size = c.n
+	info.md5 = hex.EncodeToString(c.md5.Sum(nil))
+	info.sha256 = hex.EncodeToString(c.sha256.Sum(nil))
+}
+
+// uploadPartSize gets the part size the uploader uses for an object of the
+// given size. Unknown sizes are -1. The part size grows for objects that would
+// take too many parts.
+func uploadPartSize(size int) int {
+	partSize := int(s3manager.DefaultUploadPartSize)
+	if size > 0 && size/partSize >= s3manager.MaxUploadParts {
+		partSize = size/s3manager.MaxUploadParts + 1
+	}
+	return partSize
+}
+
+// hashFile computes the checksums of a file on local disk.
+func hashFile(ctx *context, path string) (*checksums, error) {
+	file, err := ctx.os.Open(path)
+	if err != nil {
+		return nil, handle("Error in opening file on disk.", err)
+	}
+	defer func() {
+		errOut("Error in closing local file", file.Close())
+	}()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, handle("Error in getting local file size.", err)
+	}
+	sums := newChecksums(uploadPartSize(int(stat.Size())))
+	if _, err = io.Copy(sums, file); err != nil {
+		return nil, handle("Error in reading file on disk.", err)
+	}
+	return sums, nil
+}
+
+// setChecksumHeaders sends the checksums with a single part upload so that
+// S3 rejects a corrupted body. Multipart uploads are checked by ETag after.
+func setChecksumHeaders(input *s3manager.UploadInput, info uploadInfo,
+	partSize int) {
+	if info.size >= partSize {
+		return
+	}
+	input.ContentMD5 = aws.String(base64Hex(info.md5))
+	input.ChecksumSHA256 = aws.String(base64Hex(info.sha256))
+}
+
+// base64Hex converts a hex digest to base64, as checksum headers take them.
+func base64Hex(digest string) string {
+	raw, err := hex.DecodeString(digest)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// discardUpload removes an upload that failed verification. On a versioned
+// bucket only the new version is removed, so the previous one stays current.
+func discardUpload(ctx *context, key string, versionId string) error {
+	input := &s3.DeleteObjectInput{
+		Bucket: aws.String(ctx.bucket),
+		Key:    aws.String(key),
+	}
+	if versionId != "" {
+		input.VersionId = aws.String(versionId)
+	}
+	output, err := ctx.svcS3.DeleteObject(input)
+	awsOutput(output.GoString())
+	if err != nil {
+		return handle("Error in deleting upload.", err)
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestChecksums(t *testing.T) {
+	sums := newChecksums(4)
+	sums.Write([]byte("abc"))
+	sums.Write([]byte("defghij"))
+	info := uploadInfo{}
+	sums.setInfo(&info)
+	assert.Equal(t, 10, info.size)
+	assert.Equal(t, "a925576942e94b2ef57a066101b48876", info.md5)
+	assert.Equal(t, "72399361da6a7754fec986dca5b7cbaf1c810a28ded4abaf56b2106d06cb78b0", info.sha256)
+
+	// Multipart ETag is the MD5 of the part MD5s.
+	all := md5.New()
+	for _, part := range []string{"abcd", "efgh", "ij"} {
+		sum := md5.Sum([]byte(part))
+		all.Write(sum[:])
+	}
+	etag := hex.EncodeToString(all.Sum(nil)) + "-3"
+	assert.Equal(t, []string{etag}, sums.etags())
+	assert.Nil(t, sums.verify(aws.String("\""+etag+"\"")))
+	assert.Nil(t, sums.verify(nil))
+	assert.NotNil(t, sums.verify(aws.String(info.md5)))
+
+	// A single part may be uploaded whole or as one part.
+	single := newChecksums(4)
+	single.Write([]byte("abcd"))
+	assert.Equal(t, "e2fc714c4727ee9395f324cd2e7f331f", single.etags()[0])
+	assert.Len(t, single.etags(), 2)
+	assert.Nil(t, single.verify(aws.String("e2fc714c4727ee9395f324cd2e7f331f")))
+}
+
+func TestUploadPartSize(t *testing.T) {
+	assert.Equal(t, int(s3manager.DefaultUploadPartSize), uploadPartSize(-1))
+	assert.Equal(t, int(s3manager.DefaultUploadPartSize), uploadPartSize(100))
+	huge := int(s3manager.DefaultUploadPartSize) * s3manager.MaxUploadParts * 2
+	assert.True(t, uploadPartSize(huge)*s3manager.MaxUploadParts >= huge)
+}
+
+func TestSetChecksumHeaders(t *testing.T) {
+	info := uploadInfo{size: 4, md5: "de5949721e6352f01dfef317c3e898a8",
+		sha256: "1a5afeda973d776e31d1d7266f184468f84d99bed311d88d3dcb67015934f9f9"}
+	input := &s3manager.UploadInput{}
+	setChecksumHeaders(input, info, 10)
+	assert.Equal(t, "3llJch5jUvAd/vMXw+iYqA==", aws.StringValue(input.ContentMD5))
+	assert.Equal(t, "Glr+2pc9d24x0dcmbxhEaPhNmb7TEdiNPctnAVk0+fk=", aws.StringValue(input.ChecksumSHA256))
+
+	// Multipart uploads are checked by ETag instead.
+	input = &s3manager.UploadInput{}
+	setChecksumHeaders(input, info, 4)
+	assert.Nil(t, input.ContentMD5)
+}
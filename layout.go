@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Default key layouts. Current copies are stored at the raw path and archived
+// versions under archive/ by their checksum.
+const defaultCurrentLayout = "{path}"
+const defaultArchiveLayout = "archive/{hash}"
+
+// A keyLayout represents the templates for the S3 keys of current copies and
+// archived versions of files in a syncFolder. Templates may use {path} (the
+// file path without the leading slash), {name} (the base name), {version}
+// (the version number), and {hash} (the checksum of path and version).
+type keyLayout struct {
+	current string
+	archive string
+}
+
+// layoutOf gets the key layout of a folder, filling in defaults.
+func layoutOf(folder syncFolder) keyLayout {
+	res := folder.layout
+	if res.current == "" {
+		res.current = defaultCurrentLayout
+	}
+	if res.archive == "" {
+		res.archive = defaultArchiveLayout
+	}
+	return res
+}
+
+// validateLayout checks that a layout can be used for syncing. The current
+// copy must end in the path so that a folder can be listed by prefix, and
+// archived versions must be stored outside of that listing.
+func validateLayout(layout keyLayout) error {
+	cur := layout.current
+	if !strings.HasSuffix(cur, "{path}") || strings.Count(cur, "{") > 1 {
+		return errors.New("current layout must end in {path} and have no " +
+			"other fields: " + cur)
+	}
+	if !strings.Contains(layout.archive, "{version}") &&
+		!strings.Contains(layout.archive, "{hash}") {
+		return errors.New("archive layout must have {version} or {hash}: " +
+			layout.archive)
+	}
+	curBase := layoutBase(cur)
+	archiveBase := layoutBase(layout.archive)
+	if archiveBase == "" || (curBase != "" &&
+		strings.HasPrefix(archiveBase, curBase)) {
+		return errors.New("archive layout must start with a folder outside " +
+			"of the current layout: " + layout.archive)
+	}
+	return nil
+}
+
+// layoutBase gets the literal part of a layout before its first field.
+func layoutBase(layout string) string {
+	if i := strings.Index(layout, "{"); i > -1 {
+		return layout[:i]
+	}
+	return layout
+}
+
+// renderLayout fills in the fields of a layout template for one file version.
+func renderLayout(layout string, file string, num int, hash string) string {
+	path := strings.TrimPrefix(file, "/")
+	name := path[strings.LastIndex(path, "/")+1:]
+	r := strings.NewReplacer(
+		"{path}", path,
+		"{name}", name,
+		"{version}", strconv.Itoa(num),
+		"{hash}", hash,
+	)
+	return r.Replace(layout)
+}
+
+// folderOf gets the syncFolder that a file belongs to. Returns an empty
+// folder with default settings if none match.
+func folderOf(ctx *context, file string) syncFolder {
+	res := syncFolder{}
+	for _, folder := range ctx.syncFolders {
+		path := folder.sourcePath
+		if !underPath(file, path) {
+			continue
+		}
+		if len(path) > len(res.sourcePath) {
+			res = folder
+		}
+	}
+	return res
+}
+
+// folderKey adds the source and folder destination prefixes to a rendered
+// key.
+func folderKey(ctx *context, folder syncFolder, key string) string {
+	if folder.prefix != "" {
+		key = folder.prefix + "/" + key
+	}
+	return withPrefix(ctx, key)
+}
+
+// currentKeyBase gets the part of the current copy keys of a folder that
+// comes before the file path.
+func currentKeyBase(ctx *context, folder syncFolder) string {
+	return folderKey(ctx, folder, layoutBase(layoutOf(folder).current))
+}
+
+// stagingKey gets the S3 key where a new copy of a file is uploaded before it
+// replaces the current copy. Staged copies are outside of folder listings.
+func stagingKey(ctx *context, file string) string {
+	return withPrefix(ctx, ".staging/"+strings.TrimPrefix(file, "/"))
+}
+
+// archiveKey gets the S3 key for an archived version of a file from its
+// folder's layout.
+func archiveKey(ctx *context, file string, num int) (string, error) {
+	hash, err := generateChecksum(file, num)
+	if err != nil {
+		return "", handle("Error in generating checksum", err)
+	}
+	folder := folderOf(ctx, file)
+	key := renderLayout(layoutOf(folder).archive, file, num, hash)
+	return folderKey(ctx, folder, key), err
+}
+
+// legacyArchiveKey matches the ArchiveKey of older entries, which only
+// recorded the checksum of a blob under archive/.
+var legacyArchiveKey = regexp.MustCompile("^[0-9a-f]{32}$")
+
+// resolveArchiveKey gets the S3 key of an archived version from the
+// ArchiveKey recorded in the db.
+func resolveArchiveKey(ctx *context, stored string) string {
+	if !legacyArchiveKey.MatchString(stored) {
+		return stored
+	}
+	return withPrefix(ctx, fmt.Sprintf("archive/%s", stored))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRenderLayout(t *testing.T) {
+	res := renderLayout("versions/{path}/{version}", "/pub/taxonomy/taxdump.tar.gz", 3, "")
+	assert.Equal(t, "versions/pub/taxonomy/taxdump.tar.gz/3", res)
+	res = renderLayout("archive/{hash}", "/pub/taxonomy/taxdump.tar.gz", 3, "abc")
+	assert.Equal(t, "archive/abc", res)
+	res = renderLayout("old/{name}.v{version}", "/pub/taxonomy/taxdump.tar.gz", 2, "")
+	assert.Equal(t, "old/taxdump.tar.gz.v2", res)
+}
+
+func TestValidateLayout(t *testing.T) {
+	assert.Nil(t, validateLayout(layoutOf(syncFolder{})))
+	assert.Nil(t, validateLayout(keyLayout{"current/{path}", "versions/{path}/{version}"}))
+	assert.NotNil(t, validateLayout(keyLayout{"{path}/latest", "archive/{hash}"}))
+	assert.NotNil(t, validateLayout(keyLayout{"current/{path}", "current/old/{hash}"}))
+	assert.NotNil(t, validateLayout(keyLayout{"{path}", "{path}.{version}"}))
+	assert.NotNil(t, validateLayout(keyLayout{"{path}", "archive/{path}"}))
+}
+
+func TestLayoutKeys(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.syncFolders = []syncFolder{
+		{sourcePath: "/pub"},
+		{sourcePath: "/pub/taxonomy", prefix: "taxonomy",
+			layout: keyLayout{"current/{path}", "versions/{path}/{version}"}},
+	}
+	file := "/pub/taxonomy/taxdump.tar.gz"
+	assert.Equal(t, "taxonomy/current/pub/taxonomy/taxdump.tar.gz", objectKey(ctx, file))
+	key, err := archiveKey(ctx, file, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "taxonomy/versions/pub/taxonomy/taxdump.tar.gz/2", key)
+	assert.Equal(t, "pub/README", objectKey(ctx, "/pub/README"))
+	key, _ = archiveKey(ctx, "/pub/README", 1)
+	assert.Regexp(t, "^archive/[0-9a-f]{32}$", key)
+
+	assert.Equal(t, ".staging/pub/README", stagingKey(ctx, "/pub/README"))
+
+	ctx.src.prefix = "mirror"
+	assert.Equal(t, "mirror/taxonomy/current/", currentKeyBase(ctx, ctx.syncFolders[1]))
+	assert.Equal(t, "mirror/.staging/pub/README", stagingKey(ctx, "/pub/README"))
+	assert.Equal(t, "mirror/archive/0123456789abcdef0123456789abcdef", resolveArchiveKey(ctx, "0123456789abcdef0123456789abcdef"))
+	assert.Equal(t, "mirror/versions/a/1", resolveArchiveKey(ctx, "mirror/versions/a/1"))
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultLeaseTTL is how long a lease lasts without a heartbeat if the config
+// doesn't say. Holders renew it every third of that.
+const defaultLeaseTTL = 2 * time.Minute
+
+// instanceId identifies this process as a lease holder.
+var instanceId = instanceName()
+
+// A lease represents a lock held by this process in the leases table. It is
+// renewed by heartbeats until released. A holder that crashes stops renewing
+// and the lease expires.
+type lease struct {
+	name  string
+	ttl   time.Duration
+	mutex sync.Mutex
+	lost  bool
+	done  chan struct{}
+}
+
+// instanceName gets the host name and process id. Ex: sync-7f9c-4012
+func instanceName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// dbCreateLeaseTable creates the table of leases, if not present.
+func dbCreateLeaseTable(ctx *context) {
+	query := "CREATE TABLE IF NOT EXISTS leases (" +
+		"Name VARCHAR(500) NOT NULL, " +
+		"Holder VARCHAR(255) NOT NULL, " +
+		"Expires DATETIME NOT NULL, " +
+		"PRIMARY KEY (Name));"
+	if _, err := ctx.db.Exec(dbCreateQuery(ctx, query)); err != nil {
+		log.Print(err)
+		log.Fatal("Failed to find or create lease table.")
+	}
+}
+
+// runLeaseName gets the name of the lease taken for each run of a source.
+func runLeaseName(src string) string {
+	return "run:" + src
+}
+
+// folderLeaseName gets the name of the lease on a folder's objects. Sources
+// writing to the same place in a bucket share it.
+func folderLeaseName(ctx *context, folder syncFolder) string {
+	return "folder:" + ctx.bucket + ":" + withPrefix(ctx, folder.prefix) +
+		folder.sourcePath
+}
+
+// acquireLease takes a lease if it is free, expired, or already held by this
+// process, and starts its heartbeats. Returns nil and the current holder if
+// another process holds it.
+func acquireLease(ctx *context, name string) (*lease, string, error) {
+	ttl := ctx.leaseTTL
+	if ttl <= 0 {
+		ttl = defaultLeaseTTL
+	}
+	cur := now()
+	expires := dbTime(cur.Add(ttl))
+	// Take over a lease that expired or is ours.
+	res, err := ctx.db.Exec("update leases set Holder=?, Expires=? where "+
+		"Name=? and (Holder=? or Expires<?);", instanceId, expires, name,
+		instanceId, dbTime(cur))
+	if err != nil {
+		return nil, "", handle("Error in taking over lease.", err)
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows > 0 {
+		return startLease(ctx, name, ttl), "", nil
+	}
+
+	var holder string
+	err = ctx.db.QueryRow("select Holder from leases where Name=?",
+		name).Scan(&holder)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = ctx.db.Exec("insert into leases (Name, Holder, Expires) "+
+			"values (?, ?, ?);", name, instanceId, expires)
+		if err != nil && isDuplicateKey(err) {
+			// Another process inserted it first.
+			return nil, "another instance", nil
+		} else if err != nil {
+			return nil, "", handle("Error in inserting lease.", err)
+		}
+		return startLease(ctx, name, ttl), "", nil
+	case err != nil:
+		return nil, "", handle("Error in querying lease.", err)
+	}
+	return nil, holder, nil
+}
+
+// startLease starts renewing a lease just taken.
+func startLease(ctx *context, name string, ttl time.Duration) *lease {
+	l := &lease{name: name, ttl: ttl, done: make(chan struct{})}
+	go l.heartbeat(ctx)
+	return l
+}
+
+// heartbeat renews the lease every third of its ttl until it is released.
+// The lease is lost if renewing finds another holder or fails for longer than
+// the ttl.
+func (l *lease) heartbeat(ctx *context) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	renewed := now()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+		held, err := dbRenewLease(ctx, l.name, l.ttl)
+		if err != nil {
+			errOut("Error in renewing lease "+l.name, err)
+			if now().Sub(renewed) < l.ttl {
+				continue
+			}
+		}
+		if !held || err != nil {
+			log.Printf("Lost lease %s.", l.name)
+			l.mutex.Lock()
+			l.lost = true
+			l.mutex.Unlock()
+			return
+		}
+		renewed = now()
+	}
+}
+
+// dbRenewLease extends a lease held by this process. Returns false if it is
+// no longer held.
+func dbRenewLease(ctx *context, name string, ttl time.Duration) (bool, error) {
+	res, err := ctx.db.Exec("update leases set Expires=? where Name=? and "+
+		"Holder=?;", dbTime(now().Add(ttl)), name, instanceId)
+	if err != nil {
+		return false, handle("Error in updating lease.", err)
+	}
+	rows, err := res.RowsAffected()
+	return rows > 0, err
+}
+
+// isLost reports whether the lease expired or was taken by another process.
+func (l *lease) isLost() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.lost
+}
+
+// release stops the heartbeats and frees the lease for other processes.
+func (l *lease) release(ctx *context) {
+	close(l.done)
+	_, err := ctx.db.Exec("delete from leases where Name=? and Holder=?;",
+		l.name, instanceId)
+	errOut("Error in releasing lease "+l.name, err)
+}
+
+// releaseLeases releases the leases of the current run.
+func releaseLeases(ctx *context) {
+	for _, l := range ctx.leases {
+		l.release(ctx)
+	}
+	ctx.leases = nil
+}
+
+// leaseLost reports whether any lease of the current run was lost. The run
+// then stops before its next file.
+func leaseLost(ctx *context) bool {
+	for _, l := range ctx.leases {
+		if l.isLost() {
+			return true
+		}
+	}
+	return false
+}
+
+// lockFolders takes the lease of each folder of the current source. Changes
+// in folders held by other processes are left for a later run. Returns the
+// changes in the folders taken.
+func lockFolders(ctx *context, res syncResult) syncResult {
+	held := make(map[string]bool)
+	for _, folder := range ctx.syncFolders {
+		l, holder, err := acquireLease(ctx, folderLeaseName(ctx, folder))
+		if err != nil {
+			errOut("Error in taking lease on "+folder.sourcePath, err)
+		}
+		if l == nil {
+			if holder != "" {
+				log.Printf("Folder %s is being synced by %s. Skipping.",
+					folder.sourcePath, holder)
+			}
+			held[folder.sourcePath] = true
+			continue
+		}
+		ctx.leases = append(ctx.leases, l)
+	}
+	if len(held) == 0 {
+		return res
+	}
+	keep := func(files []string) []string {
+		list := []string{}
+		for _, file := range files {
+			if !held[folderOf(ctx, file).sourcePath] {
+				list = append(list, file)
+			}
+		}
+		return list
+	}
+	res.newF = keep(res.newF)
+	res.modified = keep(res.modified)
+	res.deleted = keep(res.deleted)
+	return res
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"testing"
+	"time"
+)
+
+func TestAcquireLease(t *testing.T) {
+	mock, ctx := testSetup(t)
+	clock := time.Date(2017, 8, 4, 22, 0, 0, 0, time.UTC)
+	tmp := now
+	now = func() time.Time { return clock }
+	defer func() { now = tmp }()
+	ctx.leaseTTL = time.Hour
+
+	// Free lease is inserted.
+	mock.ExpectExec("update leases set Holder").WithArgs(instanceId, "2017-08-04 23:00:00", "run:ncbi", instanceId, "2017-08-04 22:00:00").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select Holder from leases").WithArgs("run:ncbi").WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("insert into leases").WithArgs("run:ncbi", instanceId, "2017-08-04 23:00:00").WillReturnResult(testResult)
+	l, holder, err := acquireLease(ctx, "run:ncbi")
+	assert.Nil(t, err)
+	assert.Equal(t, "", holder)
+	assert.NotNil(t, l)
+	assert.False(t, l.isLost())
+	ctx.leases = []*lease{l}
+	assert.False(t, leaseLost(ctx))
+
+	// Held by another instance.
+	mock.ExpectExec("update leases set Holder").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select Holder from leases").WithArgs("run:ncbi").WillReturnRows(sqlmock.NewRows([]string{"Holder"}).AddRow("other-1"))
+	other, holder, err := acquireLease(ctx, "run:ncbi")
+	assert.Nil(t, err)
+	assert.Nil(t, other)
+	assert.Equal(t, "other-1", holder)
+
+	mock.ExpectExec("delete from leases").WithArgs("run:ncbi", instanceId).WillReturnResult(testResult)
+	releaseLeases(ctx)
+	assert.Empty(t, ctx.leases)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestAcquireLeaseInsertError(t *testing.T) {
+	mock, ctx := testSetup(t)
+
+	// Lost the race to insert the lease.
+	mock.ExpectExec("update leases set Holder").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select Holder from leases").WithArgs("run:ncbi").WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("insert into leases").WillReturnError(errors.New("UNIQUE constraint failed: leases.Name"))
+	l, holder, err := acquireLease(ctx, "run:ncbi")
+	assert.Nil(t, err)
+	assert.Nil(t, l)
+	assert.Equal(t, "another instance", holder)
+
+	// Any other failure is returned.
+	mock.ExpectExec("update leases set Holder").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select Holder from leases").WithArgs("run:ncbi").WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("insert into leases").WillReturnError(errors.New("no such table: leases"))
+	l, holder, err = acquireLease(ctx, "run:ncbi")
+	assert.NotNil(t, err)
+	assert.Nil(t, l)
+	assert.Equal(t, "", holder)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestIsDuplicateKey(t *testing.T) {
+	assert.True(t, isDuplicateKey(errors.New("Error 1062: Duplicate entry 'run:ncbi' for key 'PRIMARY'")))
+	assert.True(t, isDuplicateKey(errors.New(`pq: duplicate key value violates unique constraint "leases_pkey"`)))
+	assert.True(t, isDuplicateKey(errors.New("UNIQUE constraint failed: leases.Name")))
+	assert.False(t, isDuplicateKey(errors.New("connection refused")))
+}
+
+func TestLeaseHeartbeat(t *testing.T) {
+	mock, ctx := testSetup(t)
+	l := &lease{name: "run:ncbi", ttl: 30 * time.Millisecond,
+		done: make(chan struct{})}
+	ctx.leases = []*lease{l}
+
+	// Renewing finds another holder.
+	mock.ExpectExec("update leases set Expires").WithArgs(sqlmock.AnyArg(), "run:ncbi", instanceId).WillReturnResult(sqlmock.NewResult(0, 0))
+	l.heartbeat(ctx)
+	assert.True(t, leaseLost(ctx))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestLockFolders(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.bucket = "bucket"
+	ctx.syncFolders = []syncFolder{{sourcePath: "/pub/a"}, {sourcePath: "/pub/b"}}
+	ctx.leaseTTL = time.Hour
+
+	mock.ExpectExec("update leases set Holder").WithArgs(instanceId, sqlmock.AnyArg(), "folder:bucket:/pub/a", instanceId, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("update leases set Holder").WithArgs(instanceId, sqlmock.AnyArg(), "folder:bucket:/pub/b", instanceId, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select Holder from leases").WithArgs("folder:bucket:/pub/b").WillReturnRows(sqlmock.NewRows([]string{"Holder"}).AddRow("other-1"))
+	res := lockFolders(ctx, syncResult{
+		newF:     []string{"/pub/a/1", "/pub/b/2"},
+		modified: []string{"/pub/b/3"},
+	})
+	assert.Equal(t, []string{"/pub/a/1"}, res.newF)
+	assert.Empty(t, res.modified)
+	assert.Len(t, ctx.leases, 1)
+
+	mock.ExpectExec("delete from leases").WithArgs("folder:bucket:/pub/a", instanceId).WillReturnResult(testResult)
+	releaseLeases(ctx)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -7,24 +7,71 @@ import (
 	"io"
 	"log"
 	"os"
+	"time"
 )
 
 // A context holds application state variables.
 type context struct {
-	db          *sql.DB
-	os          afero.Fs
-	server      string       `yaml:"server"`
-	bucket      string       `yaml:"bucket"`
-	syncFolders []syncFolder `yaml:"syncFolders"`
-	local       string       // Set as /syncmount
-	temp        string       // Set as /syncmount/synctemp
-	svcS3       *s3.S3
+	db            *sql.DB
+	os            afero.Fs
+	server        string       `yaml:"server"`
+	bucket        string       `yaml:"bucket"`
+	syncFolders   []syncFolder `yaml:"syncFolders"`
+	sources       []source     `yaml:"sources"`
+	src           source       // Source handled by the current run
+	local         string       // Set as /syncmount
+	temp          string       // Set as /syncmount/synctemp
+	svcS3         *s3.S3
+	stats         map[string]*sourceStats
+	limits        transferLimits // Bandwidth caps shared by all sources
+	database      dbConfig
+	versions      versionCache  // Version numbers loaded for the current run
+	runId         string        // Id of the current sync run of the source
+	health        healthConfig  // Thresholds of the health endpoints
+	shutdownGrace time.Duration // How long runs get to finish on shutdown
+	leaseTTL      time.Duration // How long leases last without heartbeats
+	leases        []*lease      // Leases held by the current run
 }
 
-// A syncFolder represents a folder path to sync and rsync flags as strings.
+// A dbConfig represents the database to use. Driver is mysql, postgres, or
+// sqlite. Path is the file of a SQLite database.
+type dbConfig struct {
+	driver string
+	path   string
+}
+
+// A source represents one upstream server with its own credentials, folders
+// to sync, and destination in S3.
+type source struct {
+	name        string
+	server      string
+	protocol    string // Download protocol. Defaults to ftp.
+	username    string
+	password    string
+	bucket      string
+	prefix      string      // Destination key prefix within the bucket
+	versioning  bool        // Keep old versions with S3 bucket versioning
+	streaming   bool        // Pipe downloads into uploads without local disk
+	snapshots   bool        // Take a snapshot after each successful run
+	manifests   string      // Run manifest format, jsonl or tsv. Empty for none.
+	processors  []string    // Names of the processors to run on synced files
+	publishers  []publisher // Destinations of change events
+	syncFolders []syncFolder
+	limits      transferLimits // Bandwidth caps of this source only
+}
+
+// A syncFolder represents a folder path to sync and rsync flags as strings,
+// with the destination prefix and key layout of its objects, and filters
+// applied to its listing and hooks run on changes.
 type syncFolder struct {
 	sourcePath string
 	flags      []string
+	prefix     string
+	layout     keyLayout
+	filters    fileFilters
+	onChange   []hook        // Commands run after changes in the folder
+	staleAfter time.Duration // Overrides the readiness threshold if set
+	storage    storagePolicy // Storage classes and encryption of objects
 }
 
 // Entry point for the entire sync workflow with remote server.
@@ -61,6 +108,17 @@ func main() {
 		}
 	}()
 
+	// One-off commands run instead of the sync daemon.
+	if args := commandArgs(); args != nil {
+		if err = runCommand(&ctx, args); err != nil {
+			log.Fatal("Error in running command: ", err)
+		}
+		return
+	}
+
+	handleSignals(&ctx)
+	go serveAPI(&ctx, apiAddr())
+
 	// Run immediately to start with. Next run is scheduled after completion.
 	if err = callSyncFlow(&ctx, true); err != nil {
 		errOut("Error in calling sync flow", err)
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"log"
+	"strings"
+	"time"
+)
+
+// Manifest formats
+const (
+	manifestJSONL = "jsonl"
+	manifestTSV   = "tsv"
+)
+
+// A manifestRow represents one current file in a run manifest. Checksums are
+// the MD5 and SHA-256 of the content recorded in the db. Versions recorded
+// without them have the S3 ETag instead, which is only the MD5 of objects
+// uploaded in a single part without KMS.
+type manifestRow struct {
+	Path    string `json:"path"`
+	Version int    `json:"version"`
+	ModTime string `json:"modTime"`
+	Size    int    `json:"size"`
+	Md5     string `json:"md5,omitempty"`
+	Sha256  string `json:"sha256,omitempty"`
+	ETag    string `json:"etag,omitempty"`
+	Key     string `json:"key"`
+}
+
+// validManifestFormat reports whether a manifest format is supported. Empty
+// means no manifests.
+func validManifestFormat(format string) bool {
+	switch format {
+	case "", manifestJSONL, manifestTSV:
+		return true
+	}
+	return false
+}
+
+// writeRunManifests writes a manifest of every current file under each
+// syncFolder of the current source. Each run's manifest is kept, and the
+// latest is also copied to a fixed key. Ex: manifests/pub/taxonomy/latest.tsv
+func writeRunManifests(ctx *context, runTime time.Time) error {
+	format := ctx.src.manifests
+	var failed error
+	for _, folder := range ctx.syncFolders {
+		rows, err := manifestRows(ctx, folder)
+		if err != nil {
+			errOut("Error in building manifest of "+folder.sourcePath, err)
+			failed = err
+			continue
+		}
+		body := formatManifest(rows, format)
+		base := manifestBase(ctx, folder)
+		stamp := runTime.UTC().Format("20060102T150405Z")
+		for _, key := range []string{base + stamp + "." + format,
+			base + "latest." + format} {
+			if err = putManifest(ctx, key, body, format); err != nil {
+				errOut("Error in writing manifest "+key, err)
+				failed = err
+			}
+		}
+		log.Printf("Wrote manifest of %d files for %s.", len(rows),
+			folder.sourcePath)
+	}
+	return failed
+}
+
+// manifestBase gets the key prefix of the manifests of a folder.
+func manifestBase(ctx *context, folder syncFolder) string {
+	return withPrefix(ctx, "manifests/"+strings.Trim(folder.sourcePath, "/")+
+		"/")
+}
+
+// manifestRows gets the current files of a folder from the entries table
+// joined with the object listing, ordered by path.
+func manifestRows(ctx *context, folder syncFolder) ([]manifestRow, error) {
+	res := []manifestRow{}
+	entries, err := dbEntries(ctx, folder.sourcePath)
+	if err != nil {
+		return res, handle("Error in getting entries.", err)
+	}
+	objects, err := listObjects(ctx, objectKey(ctx, folder.sourcePath))
+	if err != nil {
+		return res, handle("Error in listing objects.", err)
+	}
+	byKey := make(map[string]*s3.Object)
+	for _, obj := range objects {
+		byKey[aws.StringValue(obj.Key)] = obj
+	}
+
+	for _, e := range entries {
+		if e.archiveKey != "" {
+			continue
+		}
+		key := objectKey(ctx, e.pathName)
+		obj, present := byKey[key]
+		if !present {
+			log.Print("No current object for " + e.pathName)
+			continue
+		}
+		row := manifestRow{
+			Path:    e.pathName,
+			Version: e.versionNum,
+			ModTime: e.modTime,
+			Size:    int(aws.Int64Value(obj.Size)),
+			Md5:     e.md5,
+			Sha256:  e.sha256,
+			Key:     key,
+		}
+		if e.md5 == "" && e.sha256 == "" {
+			row.ETag = strings.Trim(aws.StringValue(obj.ETag), "\"")
+		}
+		res = append(res, row)
+	}
+	return res, err
+}
+
+// formatManifest formats manifest rows as JSON lines or as TSV with a header.
+func formatManifest(rows []manifestRow, format string) []byte {
+	var buf bytes.Buffer
+	if format == manifestTSV {
+		buf.WriteString("path\tversion\tmodTime\tsize\tmd5\tsha256\tetag\tkey\n")
+	}
+	for _, row := range rows {
+		if format == manifestTSV {
+			fmt.Fprintf(&buf, "%s\t%d\t%s\t%d\t%s\t%s\t%s\t%s\n", row.Path,
+				row.Version, row.ModTime, row.Size, row.Md5, row.Sha256, row.ETag,
+				row.Key)
+			continue
+		}
+		line, _ := json.Marshal(row)
+		buf.Write(line)
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+// putManifest uploads a manifest to a key on the bucket.
+func putManifest(ctx *context, key string, body []byte, format string) error {
+	contentType := "application/x-ndjson"
+	if format == manifestTSV {
+		contentType = "text/tab-separated-values"
+	}
+	_, err := ctx.svcS3.PutObject(&s3.PutObjectInput{
+		Body:        bytes.NewReader(body),
+		Bucket:      aws.String(ctx.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return handle("Error in uploading manifest.", err)
+	}
+	return err
+}
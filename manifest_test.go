@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"testing"
+)
+
+func TestManifestRows(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.bucket = "bucket"
+	rows := sqlmock.NewRows([]string{"PathName", "VersionNum", "DateModified", "ArchiveKey", "VersionId", "Size", "Md5", "Sha256"}).
+		AddRow("/pub/taxonomy/a", 1, "2017-08-01 10:00:00", "archive/0123456789abcdef0123456789abcdef", nil, nil, nil, nil).
+		AddRow("/pub/taxonomy/a", 2, "2017-08-04 10:00:00", nil, nil, nil, nil, nil).
+		AddRow("/pub/taxonomy/b", 1, nil, nil, nil, 3, "d41d8cd98f00b204e9800998ecf8427e", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855").
+		AddRow("/pub/taxonomy/gone", 1, nil, nil, nil, nil, nil, nil)
+	mock.ExpectQuery("select PathName, VersionNum").WithArgs("/pub/taxonomy", "/pub/taxonomy/%").WillReturnRows(rows)
+	testServer.Response(200, nil, "<ListBucketResult><Contents><Key>pub/taxonomy/a</Key>"+
+		"<Size>5</Size><ETag>\"abc\"</ETag></Contents><Contents><Key>pub/taxonomy/b</Key>"+
+		"<Size>3</Size><ETag>\"abc-2\"</ETag></Contents></ListBucketResult>")
+
+	res, err := manifestRows(ctx, syncFolder{sourcePath: "/pub/taxonomy"})
+	assert.Nil(t, err)
+	assert.Equal(t, []manifestRow{{"/pub/taxonomy/a", 2, "2017-08-04 10:00:00", 5,
+		"", "", "abc", "pub/taxonomy/a"},
+		{"/pub/taxonomy/b", 1, "", 3, "d41d8cd98f00b204e9800998ecf8427e",
+			"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "",
+			"pub/taxonomy/b"}}, res)
+	testServer.WaitRequest()
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestFormatManifest(t *testing.T) {
+	rows := []manifestRow{{"/pub/a", 2, "2017-08-04 10:00:00", 5, "abc", "def", "", "pub/a"}}
+	assert.Equal(t, "path\tversion\tmodTime\tsize\tmd5\tsha256\tetag\tkey\n"+
+		"/pub/a\t2\t2017-08-04 10:00:00\t5\tabc\tdef\t\tpub/a\n",
+		string(formatManifest(rows, manifestTSV)))
+	assert.Equal(t, `{"path":"/pub/a","version":2,"modTime":"2017-08-04 10:00:00",`+
+		`"size":5,"md5":"abc","sha256":"def","key":"pub/a"}`+"\n",
+		string(formatManifest(rows, manifestJSONL)))
+}
+
+func TestManifestBase(t *testing.T) {
+	ctx := &context{src: source{prefix: "mirror"}}
+	assert.Equal(t, "mirror/manifests/pub/taxonomy/",
+		manifestBase(ctx, syncFolder{sourcePath: "/pub/taxonomy"}))
+}
@@ -2,43 +2,76 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log"
 )
 
 // fileOperationStage executes the actual file operations on local disk and S3.
-func fileOperationStage(ctx *context, res syncResult) {
+// Stops before the next file once a shutdown is requested or a lease of the run
+// is lost. Returns the number of files that failed.
+func fileOperationStage(ctx *context, res syncResult) int {
 	log.Print("Beginning file operations stage.")
+	// Look up version numbers in bulk instead of once per file.
+	versions, err := dbLoadVersions(ctx)
+	if err != nil {
+		errOut("Error in loading versions. Will query per file", err)
+	} else {
+		ctx.versions = versions
+		defer func() { ctx.versions = nil }()
+	}
 
 	log.Print("Going to handle new file operations...")
-	newFilesOperations(ctx, res.newF)
+	failed := newFilesOperations(ctx, res.newF, res.sizes)
 	log.Print("Going to handle modified file operations...")
-	modifiedFilesOperations(ctx, res.modified)
+	failed += modifiedFilesOperations(ctx, res.modified, res.sizes)
 	//log.Print("Going to handle deleted file operations...")
 	//deletedFilesOperations(ctx, res.deleted)
+	if used, err := stagingUsage(ctx); err == nil && used > 0 {
+		log.Printf("%d bytes left in staging folder after operations.", used)
+	}
+	return failed
 }
 
 // newFilesOperations executes operations for new files. Copies files from
-// remote server and uploads to S3.
-func newFilesOperations(ctx *context, newF []string) {
-	var err error
+// remote server to S3. Returns the number of files that failed.
+func newFilesOperations(ctx *context, newF []string,
+	sizes map[string]int) int {
+	failed := 0
 	cache := make(map[string]map[string]string)
-	for _, file := range newF {
-		if err = copyFileFromRemote(ctx, file); err != nil {
-			errOut("Error in copying new file from remote.", err)
+	for i, file := range newF {
+		if stopping() || leaseLost(ctx) {
+			log.Printf("Stopping. Skipping %d remaining files.", len(newF)-i)
+			break
+		}
+		trackFile(ctx)
+		waitForWindow(ctx)
+		if err := checkStaging(ctx, sizes[file]); err != nil {
+			errOut("Can't stage "+file, err)
+			failed++
+			trackFailure(ctx, file)
 			continue
 		}
-		if err = putObject(ctx, ctx.temp+file, file); err != nil {
-			errOut("Error in uploading new file to S3.", err)
+		info, err := transferFile(ctx, file, objectKey(ctx, file))
+		if err != nil {
+			errOut("Error in copying new file to S3.", err)
+			failed++
+			trackFailure(ctx, file)
 			continue
 		}
-		if err = dbNewVersion(ctx, file, cache); err != nil {
+		if _, err = dbNewVersion(ctx, file, cache, info); err != nil {
 			errOut("Error in adding new version to db", err)
+			failed++
+			trackFailure(ctx, file)
+			continue
 		}
+		publishNewVersion(ctx, file, cache, info)
 	}
+	return failed
 }
 
 // deletedFilesOperations executes operations for deleted files. Moves old
-// copies to archive and deletes the current copy.
+// copies to archive and deletes the current copy. On a versioned bucket the
+// delete leaves the old copy as a noncurrent version instead.
 func deletedFilesOperations(ctx *context, newF []string) {
 	var err error
 	for _, file := range newF {
@@ -47,66 +80,200 @@ func deletedFilesOperations(ctx *context, newF []string) {
 			err = errors.New("")
 			errOut("No previous unarchived version found in db", err)
 		}
-		key, err := generateChecksum(file, num)
+		key, err := archiveKey(ctx, file, num)
 		if err != nil {
-			errOut("Error in generating checksum", err)
+			errOut("Error in getting archive key", err)
 		}
 
-		if err = moveObject(ctx, file, key); err != nil {
+		if ctx.src.versioning {
+			key = objectKey(ctx, file)
+		} else if err = moveObject(ctx, file, key); err != nil {
 			errOut("Error in moving deleted file to archive.", err)
 		}
 		if err = dbArchiveFile(ctx, file, key, num); err != nil {
 			errOut("Error in archiving file in db", err)
 		}
-		if err = deleteObject(ctx, file); err != nil {
+		if err = deleteObject(ctx, objectKey(ctx, file)); err != nil {
 			errOut("Error in deleting file.", err)
 		}
+		publishVersionChange(ctx, eventDeleted, file, num, key)
 	}
 }
 
 // modifiedFilesOperations calls the operations loop for modified files.
-func modifiedFilesOperations(ctx *context, modified []string) {
+// Returns the number of files that failed.
+func modifiedFilesOperations(ctx *context, modified []string,
+	sizes map[string]int) int {
+	failed := 0
 	cache := make(map[string]map[string]string)
-	for _, file := range modified {
+	for i, file := range modified {
+		if stopping() || leaseLost(ctx) {
+			log.Printf("Stopping. Skipping %d remaining files.", len(modified)-i)
+			break
+		}
+		trackFile(ctx)
+		waitForWindow(ctx)
+		if err := checkStaging(ctx, sizes[file]); err != nil {
+			errOut("Can't stage "+file, err)
+			failed++
+			trackFailure(ctx, file)
+			continue
+		}
 		if err := modifiedFileOperations(ctx, file, cache); err != nil {
 			errOut("Error in modified file operations", err)
+			failed++
+			trackFailure(ctx, file)
 		}
 	}
+	return failed
+}
+
+// checkStaging checks that a file of the given size fits on the staging
+// volume before it is downloaded. Streamed files don't need the space.
+func checkStaging(ctx *context, size int) error {
+	if ctx.src.streaming || size == 0 {
+		return nil
+	}
+	return ensureSpace(ctx, size)
 }
 
 // modifiedFileOperations executes a single file at-a-time flow for modified
-// files. Copies files from remote, moves old files to archive, deletes
-// current copy, uploads new copy, and updates db state.
+// files. Copies the new copy from remote to a staging key. Once the staged
+// copy is verified, archives the old copy, promotes the new copy over the
+// current one, and updates db state. The current copy is never missing or
+// half-written. Completed steps are undone if a later one fails.
 func modifiedFileOperations(ctx *context, file string,
 	cache map[string]map[string]string) error {
 	var err error
-	if err = copyFileFromRemote(ctx, file); err != nil {
-		return handle("Error in copying modified file from remote", err)
-	}
 	num := lastVersionNum(ctx, file, false)
 	if num < 1 {
 		err = errors.New("")
 		return handle("No previous unarchived version found in db", err)
 	}
-	key, err := generateChecksum(file, num)
+	if ctx.src.versioning {
+		return modifiedFileVersioned(ctx, file, num, cache)
+	}
+	key, err := archiveKey(ctx, file, num)
 	if err != nil {
-		return handle("Error in generating checksum", err)
+		return handle("Error in getting archive key", err)
 	}
+	current := objectKey(ctx, file)
+	undo := rollback{}
+	defer func() {
+		if err != nil {
+			undo.run()
+		}
+	}()
 
+	// Stage and verify the new copy.
+	staged, info, err := stageObject(ctx, file)
+	if err != nil {
+		return handle("Error in staging new version of file", err)
+	}
+	undo.add("delete staged copy", func() error {
+		return deleteObject(ctx, staged)
+	})
+
+	// Archive the old copy, then replace the current copy in one request.
 	if err = moveObject(ctx, file, key); err != nil {
 		return handle("Error in moving modified file to archive", err)
 	}
+	undo.add("delete archived copy", func() error {
+		return deleteObject(ctx, key)
+	})
+	opts := policyFor(ctx, file).current()
+	if _, err = copyObjectStored(ctx, staged, current, info.size,
+		opts); err != nil {
+		return handle("Error in promoting staged copy", err)
+	}
+	undo.add("restore old copy", func() error {
+		oldSize, err := fileSizeOnS3(ctx, key, ctx.svcS3)
+		if err != nil {
+			return err
+		}
+		_, err = copyObjectStored(ctx, key, current, oldSize, opts)
+		return err
+	})
+
 	if err = dbArchiveFile(ctx, file, key, num); err != nil {
 		return handle("Error in archiving file in db", err)
 	}
-	if err = deleteObject(ctx, file); err != nil {
-		return handle("Error in deleting old modified file copy", err)
+	undo.add("unarchive old version in db", func() error {
+		return dbUnarchiveFile(ctx, file, num)
+	})
+	// The VersionId of the staged copy doesn't carry over to the current key.
+	info.versionId = ""
+	newNum, err := dbNewVersion(ctx, file, cache, info)
+	if err != nil {
+		return handle("Error in adding new version to db", err)
+	}
+	undo.add("delete new version in db", func() error {
+		return dbDeleteEntry(ctx, file, newNum)
+	})
+	publishVersionChange(ctx, eventArchived, file, num, key)
+	publishNewVersion(ctx, file, cache, info)
+
+	// The staged copy is no longer needed.
+	if err := deleteObject(ctx, staged); err != nil {
+		errOut("Error in deleting staged copy", err)
+	}
+	return nil
+}
+
+// stageObject copies the new copy of a file to its staging key and checks
+// that the staged size matches the transferred size. Returns the staging key
+// and the size and checksums of the transfer.
+func stageObject(ctx *context, file string) (string, uploadInfo, error) {
+	staged := stagingKey(ctx, file)
+	info, err := transferFile(ctx, file, staged)
+	if err != nil {
+		return staged, info, handle("Error in uploading staged copy", err)
+	}
+	stagedSize, err := fileSizeOnS3(ctx, staged, ctx.svcS3)
+	if err != nil {
+		return staged, info, handle("Error in verifying staged copy", err)
+	}
+	if stagedSize != info.size {
+		err = fmt.Errorf("staged %d bytes but expected %d", stagedSize,
+			info.size)
+		return staged, info, handle("Staged copy is incomplete", err)
 	}
-	if err = putObject(ctx, ctx.temp+file, file); err != nil {
+	return staged, info, err
+}
+
+// modifiedFileVersioned replaces a modified file on a versioned bucket. The
+// new copy is uploaded over the current one and S3 keeps the old copy as a
+// noncurrent version. The old db entry is archived under the same key and is
+// resolved by its VersionId. Completed steps are undone if a later one fails.
+func modifiedFileVersioned(ctx *context, file string, num int,
+	cache map[string]map[string]string) error {
+	key := objectKey(ctx, file)
+	info, err := transferFile(ctx, file, key)
+	if err != nil {
 		return handle("Error in uploading new version of file to S3", err)
 	}
-	if err = dbNewVersion(ctx, file, cache); err != nil {
-		errOut("Error in adding new version to db", err)
+	undo := rollback{}
+	defer func() {
+		if err != nil {
+			undo.run()
+		}
+	}()
+	if info.versionId != "" {
+		// Removing the new version makes the old one current again.
+		undo.add("delete new version", func() error {
+			return discardUpload(ctx, key, info.versionId)
+		})
+	}
+	if err = dbArchiveFile(ctx, file, key, num); err != nil {
+		return handle("Error in archiving file in db", err)
+	}
+	undo.add("unarchive old version in db", func() error {
+		return dbUnarchiveFile(ctx, file, num)
+	})
+	if _, err = dbNewVersion(ctx, file, cache, info); err != nil {
+		return handle("Error in adding new version to db", err)
 	}
+	publishVersionChange(ctx, eventArchived, file, num, key)
+	publishNewVersion(ctx, file, cache, info)
 	return err
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"github.com/AdRoll/goamz/testutil"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/spf13/afero"
@@ -32,6 +33,7 @@ func testSetup(t *testing.T) (sqlmock.Sqlmock, *context) {
 	sess := session.Must(session.NewSession())
 	region := "us-west-2"
 	sess.Config.Region = &region
+	sess.Config.S3ForcePathStyle = aws.Bool(true)
 	ctx := &context{
 		os:    afero.NewMemMapFs(),
 		db:    db,
@@ -50,14 +52,14 @@ func serverTesting() (serv *testutil.HTTPServer) {
 }
 
 func TestGetModTimeFTP(t *testing.T) {
-	testSetup(t)
+	_, ctx := testSetup(t)
 	pathName := "testFolder/testFile"
 	cache := make(map[string]map[string]string)
-	res := getModTimeFTP(pathName, cache)
+	res := getModTimeFTP(ctx, pathName, cache)
 	assert.Equal(t, "2017-08-04T22:08:41", res)
 	t2 := "2017-08-15T22:08:41"
 	cache["testFolder"]["testFile"] = t2
-	res = getModTimeFTP(pathName, cache)
+	res = getModTimeFTP(ctx, pathName, cache)
 	assert.Equal(t, t2, res)
 }
 
@@ -67,11 +69,11 @@ func TestDbNewVersion(t *testing.T) {
 	result := sqlmock.NewResult(0, 0)
 
 	mock.ExpectQuery("select VersionNum from entries").WithArgs("apple").WillReturnRows(testRows)
-	mock.ExpectExec("insert into entries").WithArgs("apple", 1).WillReturnResult(result)
+	mock.ExpectExec("insert into entries").WithArgs("apple", 1, nil, nil, nil, nil, nil).WillReturnResult(result)
 
 	// Run test
 	cache := make(map[string]map[string]string)
-	err := dbNewVersion(ctx, "apple", cache)
+	_, err := dbNewVersion(ctx, "apple", cache, uploadInfo{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -109,30 +111,133 @@ func TestGetPreviousStateTrivial(t *testing.T) {
 
 func TestMoveOldFileOperations(t *testing.T) {
 	_, ctx := testSetup(t)
-	expectResponse(testServer, 2)
+	ctx.bucket = "czbiohub-ncbi-store"
 	tmp := fileSizeOnS3
 	fileSizeOnS3 = FakeFileSizeOnS3
 	defer func() { fileSizeOnS3 = tmp }()
-	commandWithOutput = FakeRsync
+	tmp2 := copyPartSize
+	copyPartSize = 1000000000
+	defer func() { copyPartSize = tmp2 }()
+	tmp3 := copyRetries
+	copyRetries = 0
+	defer func() { copyRetries = tmp3 }()
 
-	err := moveObject(ctx, "apple", "12345")
+	expectCopyResponses(testServer, 5)
+	err := moveObject(ctx, "/apple", "archive/12345")
 	assert.Nil(t, err)
+	testServer.WaitRequests(8)
 
-	commandWithOutput = FakeCmdWithError
-	err = moveObject(ctx, "apple", "12345")
+	testServer.Response(200, nil, "")
+	testServer.Response(200, nil, initiatedUpload)
+	testServer.Responses(5, 403, nil, "")
+	testServer.Response(204, nil, "")
+	err = moveObject(ctx, "/apple", "archive/12345")
 	assert.NotNil(t, err)
-	commandWithOutput = commandWithOutputFunc
+	reqs := testServer.WaitRequests(8)
+	assert.Equal(t, "DELETE", reqs[7].Method)
 }
 
-func TestMoveOldFileOperationsLarge(t *testing.T) {
+func TestMoveObjectKeepsCurrent(t *testing.T) {
 	_, ctx := testSetup(t)
-	expectResponse(testServer, 2)
+	ctx.bucket = "czbiohub-ncbi-store"
+	testServer.Response(200, map[string]string{"Content-Length": "5"}, "")
+	expectCopyResponses(testServer, 1)
 
-	err := moveObject(ctx, "apple", "12345")
-	if err != nil {
-		t.Fatal(err)
+	err := moveObject(ctx, "/apple", "archive/12345")
+	assert.Nil(t, err)
+	// The current copy stays until the staged copy replaces it.
+	for _, req := range testServer.WaitRequests(5) {
+		assert.NotEqual(t, "DELETE", req.Method)
 	}
-	testServer.WaitRequest()
+}
+
+func TestModifiedFileRollback(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.bucket = "czbiohub-ncbi-store"
+	ctx.src.streaming = true
+	tmp := openRemote
+	openRemote = FakeOpenRemote
+	defer func() { openRemote = tmp }()
+	tmp2 := lastVersionNum
+	lastVersionNum = FakeLastVersionNum
+	defer func() { lastVersionNum = tmp2 }()
+	tmp3 := getModTime
+	getModTime = FakeGetModTime
+	defer func() { getModTime = tmp3 }()
+	file := "/pub/kiwi"
+	key, _ := archiveKey(ctx, file, 2)
+
+	// Stage, archive, and promote.
+	testServer.Response(200, nil, "")
+	testServer.Response(200, map[string]string{"Content-Length": "4"}, "")
+	testServer.Response(200, map[string]string{"Content-Length": "5"}, "")
+	expectCopyResponses(testServer, 1)
+	expectCopyResponses(testServer, 1)
+	mock.ExpectExec("update entries set ArchiveKey=").WithArgs(key, file, 2).WillReturnResult(testResult)
+	mock.ExpectExec("insert into entries").WithArgs(file, 3, "2017-08-02T22:20:26", nil, 4, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnError(fmt.Errorf("connection reset"))
+	// Undo in reverse.
+	mock.ExpectExec("update entries set ArchiveKey=NULL").WithArgs(file, 2).WillReturnResult(testResult)
+	testServer.Response(200, map[string]string{"Content-Length": "5"}, "")
+	expectCopyResponses(testServer, 1)
+	testServer.Response(204, nil, "")
+	testServer.Response(204, nil, "")
+
+	err := modifiedFileOperations(ctx, file, make(map[string]map[string]string))
+	assert.NotNil(t, err)
+	reqs := testServer.WaitRequests(18)
+	assert.Equal(t, "czbiohub-ncbi-store/.staging/pub/kiwi", reqs[9].Header.Get("X-Amz-Copy-Source"))
+	assert.Equal(t, "czbiohub-ncbi-store/"+key, reqs[14].Header.Get("X-Amz-Copy-Source"))
+	assert.Equal(t, "/czbiohub-ncbi-store/pub/kiwi", reqs[15].URL.Path)
+	assert.Equal(t, "DELETE", reqs[16].Method)
+	assert.Equal(t, "/czbiohub-ncbi-store/"+key, reqs[16].URL.Path)
+	assert.Equal(t, "DELETE", reqs[17].Method)
+	assert.Equal(t, "/czbiohub-ncbi-store/.staging/pub/kiwi", reqs[17].URL.Path)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestModifiedFileVersionedRollback(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.bucket = "czbiohub-ncbi-store"
+	ctx.src.streaming = true
+	ctx.src.versioning = true
+	tmp := openRemote
+	openRemote = FakeOpenRemote
+	defer func() { openRemote = tmp }()
+	tmp2 := lastVersionNum
+	lastVersionNum = FakeLastVersionNum
+	defer func() { lastVersionNum = tmp2 }()
+	tmp3 := getModTime
+	getModTime = FakeGetModTime
+	defer func() { getModTime = tmp3 }()
+	file := "/pub/kiwi"
+
+	testServer.Response(200, map[string]string{"x-amz-version-id": "new"}, "")
+	mock.ExpectExec("update entries set ArchiveKey=").WithArgs("pub/kiwi", file, 2).WillReturnResult(testResult)
+	mock.ExpectExec("insert into entries").WithArgs(file, 3, "2017-08-02T22:20:26", "new", 4, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnError(fmt.Errorf("connection reset"))
+	// Undo in reverse.
+	mock.ExpectExec("update entries set ArchiveKey=NULL").WithArgs(file, 2).WillReturnResult(testResult)
+	testServer.Response(204, nil, "")
+
+	err := modifiedFileOperations(ctx, file, make(map[string]map[string]string))
+	assert.NotNil(t, err)
+	reqs := testServer.WaitRequests(2)
+	assert.Equal(t, "DELETE", reqs[1].Method)
+	assert.Equal(t, "/czbiohub-ncbi-store/pub/kiwi", reqs[1].URL.Path)
+	assert.Equal(t, "new", reqs[1].URL.Query().Get("versionId"))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+const initiatedUpload = "<InitiateMultipartUploadResult><UploadId>up1</UploadId>" +
+	"</InitiateMultipartUploadResult>"
+
+// expectCopyResponses queues responses for a multipart copy in parts,
+// starting with the HEAD of the source.
+func expectCopyResponses(server *testutil.HTTPServer, parts int) {
+	server.Response(200, nil, "")
+	server.Response(200, nil, initiatedUpload)
+	server.Responses(parts, 200, nil, "<CopyPartResult><ETag>\"p\"</ETag></CopyPartResult>")
+	server.Response(200, nil, "<CompleteMultipartUploadResult><ETag>\"c\"</ETag>"+
+		"</CompleteMultipartUploadResult>")
 }
 
 func TestFileOperationStage(t *testing.T) {
@@ -160,12 +265,12 @@ func TestFileOperationStage(t *testing.T) {
 	for _, v := range res.newF {
 		expectInsert(m, v)
 	}
-	expectSet(m, "b072f43c1e66bb2e13e5115df39b7db0", "currant")
+	expectSet(m, "archive/b072f43c1e66bb2e13e5115df39b7db0", "currant")
 	expectInsert(m, "currant")
-	expectSet(m, "f80d7121c31e219bfa56268befb11c43", "coconut")
+	expectSet(m, "archive/f80d7121c31e219bfa56268befb11c43", "coconut")
 	expectInsert(m, "coconut")
-	expectSet(m, "83b00e161b904636d64826336c95ba9f", "durian")
-	expectSet(m, "eb2d7c30e19f867b987928086b7a6e56", "grape")
+	expectSet(m, "archive/83b00e161b904636d64826336c95ba9f", "durian")
+	expectSet(m, "archive/eb2d7c30e19f867b987928086b7a6e56", "grape")
 
 	// Call
 	fileOperationStage(ctx, res)
@@ -174,7 +279,7 @@ func TestFileOperationStage(t *testing.T) {
 }
 
 func expectInsert(mock sqlmock.Sqlmock, name string) {
-	mock.ExpectExec("insert into entries").WithArgs(name, 3, "2017-08-02T22:20:26").WillReturnResult(testResult)
+	mock.ExpectExec("insert into entries").WithArgs(name, 3, "2017-08-02T22:20:26", nil, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(testResult)
 }
 
 func expectSet(mock sqlmock.Sqlmock, blob string, name string) {
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A restoreTarget represents where a restored tree is written. Either a
+// local directory or a bucket and key prefix.
+type restoreTarget struct {
+	dir    string
+	bucket string
+	prefix string
+}
+
+// parseRestoreTarget parses a local directory or an S3 location.
+// Ex: /data/restore, s3://bucket/restore/2017-08-04
+func parseRestoreTarget(str string) (restoreTarget, error) {
+	res := restoreTarget{}
+	if !strings.HasPrefix(str, "s3://") {
+		if str == "" {
+			return res, errors.New("no restore destination")
+		}
+		res.dir = strings.TrimSuffix(str, "/")
+		return res, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(str, "s3://"), "/", 2)
+	res.bucket = parts[0]
+	if len(parts) > 1 {
+		res.prefix = strings.Trim(parts[1], "/")
+	}
+	if res.bucket == "" {
+		return res, errors.New("no bucket in " + str)
+	}
+	return res, nil
+}
+
+// parseDbTime parses a datetime as stored in or returned by the db.
+func parseDbTime(str string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05",
+		"2006-01-02T15:04:05", time.RFC3339} {
+		if t, err := time.Parse(layout, str); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid datetime %q", str)
+}
+
+// parseAsOf parses the date of a restore. A date without a time means the
+// end of that day in UTC.
+func parseAsOf(str string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", str); err == nil {
+		return t.Add(24*time.Hour - time.Second), nil
+	}
+	return parseDbTime(str)
+}
+
+// versionsAsOf picks the version of each file under a path that was current
+// at a time. That is the latest version modified upstream at or before it.
+// Versions with unknown modified times are skipped.
+func versionsAsOf(ctx *context, path string, asOf time.Time) ([]entry,
+	error) {
+	res := []entry{}
+	entries, err := dbEntries(ctx, path)
+	if err != nil {
+		return res, handle("Error in getting entries.", err)
+	}
+	picked := make(map[string]int) // Index in res by file
+	unknown := 0
+	for _, e := range entries {
+		modTime, err := parseDbTime(e.modTime)
+		if err != nil {
+			unknown++
+			continue
+		}
+		if modTime.After(asOf) {
+			continue
+		}
+		// Entries are ordered by version, so later ones win.
+		if i, present := picked[e.pathName]; present {
+			res[i] = e
+			continue
+		}
+		picked[e.pathName] = len(res)
+		res = append(res, e)
+	}
+	if unknown > 0 {
+		log.Printf("Skipped %d versions with unknown modified times.", unknown)
+	}
+	return res, nil
+}
+
+// errThawing is the error of files in cold storage that are still being
+// restored.
+var errThawing = errors.New("still being restored from cold storage")
+
+// restoreTree copies the version of every file under a path as of a time to
+// a target, keeping the original paths. Files are copied in parallel and
+// optionally verified. Files in cold storage are restored first. They are
+// copied once readable if waiting, or left for a later call. Returns the
+// number of files restored.
+func restoreTree(ctx *context, path string, asOf time.Time,
+	target restoreTarget, parallel int, verify bool,
+	thaw thawOptions) (int, error) {
+	versions, err := versionsAsOf(ctx, path, asOf)
+	if err != nil {
+		return 0, handle("Error in picking versions.", err)
+	}
+	log.Printf("Restoring %d files under %s as of %s.", len(versions), path,
+		asOf.Format(time.RFC3339))
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	failed, pending := restoreFiles(ctx, versions, target, parallel, verify,
+		thaw)
+	for thaw.wait && len(pending) > 0 {
+		log.Printf("Waiting for %d files to be restored from cold storage.",
+			len(pending))
+		sleep(restorePoll)
+		var more int
+		more, pending = restoreFiles(ctx, pending, target, parallel, verify,
+			thaw)
+		failed += more
+	}
+
+	restored := len(versions) - failed - len(pending)
+	log.Printf("Restored %d files with %d failures.", restored, failed)
+	if failed > 0 {
+		return restored, fmt.Errorf("%d files failed to restore", failed)
+	}
+	if len(pending) > 0 {
+		return restored, fmt.Errorf("%d files are being restored from cold "+
+			"storage. Run again later to copy them.", len(pending))
+	}
+	return restored, nil
+}
+
+// restoreFiles copies file versions to a target in parallel. Returns the
+// number that failed and the versions still being restored from cold
+// storage.
+func restoreFiles(ctx *context, versions []entry, target restoreTarget,
+	parallel int, verify bool, thaw thawOptions) (int, []entry) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	failed := 0
+	pending := []entry{}
+	sem := make(chan bool, parallel)
+	for _, e := range versions {
+		wg.Add(1)
+		sem <- true
+		go func(e entry) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := restoreFile(ctx, e, target, verify, thaw)
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch {
+			case err == errThawing:
+				pending = append(pending, e)
+			case err != nil:
+				errOut("Error in restoring "+e.pathName, err)
+				failed++
+			}
+		}(e)
+	}
+	wg.Wait()
+	return failed, pending
+}
+
+// restoreFile copies one file version to a target. Versions in cold storage
+// fail with errThawing until they are readable.
+func restoreFile(ctx *context, e entry, target restoreTarget,
+	verify bool, thaw thawOptions) error {
+	key := objectKey(ctx, e.pathName)
+	if e.archiveKey != "" {
+		key = resolveArchiveKey(ctx, e.archiveKey)
+	}
+	head, err := ctx.svcS3.HeadObject(versionInput(ctx, key, e.versionId))
+	if err != nil {
+		return handle("Error in getting stored copy.", err)
+	}
+	size := int(aws.Int64Value(head.ContentLength))
+	state, err := thawObject(ctx, key, e.versionId, head, thaw)
+	if err != nil {
+		return handle("Error in restoring from cold storage.", err)
+	}
+	if state != restoreAvailable {
+		return errThawing
+	}
+
+	if target.dir != "" {
+		sums, err := downloadObject(ctx, key, e.versionId,
+			target.dir+e.pathName)
+		if err != nil || !verify {
+			return err
+		}
+		return verifyRestored(ctx, target.dir+e.pathName, e, sums, size, head)
+	}
+
+	to := strings.TrimPrefix(e.pathName, "/")
+	if target.prefix != "" {
+		to = target.prefix + "/" + to
+	}
+	if _, err = copyObjectToBucket(ctx, key, e.versionId, target.bucket, to,
+		size, policyFor(ctx, e.pathName).current()); err != nil || !verify {
+		return err
+	}
+	copied, err := ctx.svcS3.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(target.bucket),
+		Key:    aws.String(to),
+	})
+	if err != nil {
+		return handle("Error in checking restored copy.", err)
+	}
+	if int(aws.Int64Value(copied.ContentLength)) != size {
+		return fmt.Errorf("restored %d bytes of %s but expected %d",
+			aws.Int64Value(copied.ContentLength), to, size)
+	}
+	log.Printf("Checked the size of %s only. Copies within S3 aren't hashed.",
+		to)
+	return err
+}
+
+// versionInput gets the input for a HEAD request of an object, or one
+// version of it.
+func versionInput(ctx *context, key string, versionId string) *s3.HeadObjectInput {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(ctx.bucket),
+		Key:    aws.String(key),
+	}
+	if versionId != "" {
+		input.VersionId = aws.String(versionId)
+	}
+	return input
+}
+
+// downloadObject downloads an object, or one version of it, to a local file.
+// Returns the checksums of the downloaded bytes.
+func downloadObject(ctx *context, key string, versionId string,
+	dest string) (*checksums, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(ctx.bucket),
+		Key:    aws.String(key),
+	}
+	if versionId != "" {
+		input.VersionId = aws.String(versionId)
+	}
+	output, err := ctx.svcS3.GetObject(input)
+	if err != nil {
+		return nil, handle("Error in downloading "+key, err)
+	}
+	defer func() {
+		errOut("Error in closing download", output.Body.Close())
+	}()
+
+	if err = ctx.os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return nil, handle("Couldn't make dir.", err)
+	}
+	file, err := ctx.os.Create(dest)
+	if err != nil {
+		return nil, handle("Error in creating "+dest, err)
+	}
+	sums := newChecksums(uploadPartSize(-1))
+	_, err = io.Copy(io.MultiWriter(file, sums), output.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, handle("Error in writing "+dest, err)
+	}
+	return sums, err
+}
+
+// verifyRestored checks the size of a restored local file and its checksums
+// against the ones recorded for the version. Versions without recorded
+// checksums are checked against the ETag, unless it isn't an MD5 as with
+// multipart and SSE-KMS objects.
+func verifyRestored(ctx *context, dest string, e entry, sums *checksums,
+	size int, head *s3.HeadObjectOutput) error {
+	stat, err := ctx.os.Stat(dest)
+	if err != nil {
+		return handle("Error in checking restored file.", err)
+	}
+	if int(stat.Size()) != size {
+		return fmt.Errorf("restored %d bytes of %s but expected %d",
+			stat.Size(), dest, size)
+	}
+	md5sum := hex.EncodeToString(sums.md5.Sum(nil))
+	sha256sum := hex.EncodeToString(sums.sha256.Sum(nil))
+	if e.md5 != "" && md5sum != e.md5 {
+		return fmt.Errorf("MD5 of %s is %s but recorded %s", dest, md5sum,
+			e.md5)
+	}
+	if e.sha256 != "" && sha256sum != e.sha256 {
+		return fmt.Errorf("SHA-256 of %s is %s but recorded %s", dest,
+			sha256sum, e.sha256)
+	}
+	if e.md5 != "" || e.sha256 != "" {
+		return nil
+	}
+
+	etag := strings.Trim(aws.StringValue(head.ETag), "\"")
+	kms := aws.StringValue(head.ServerSideEncryption) ==
+		s3.ServerSideEncryptionAwsKms
+	if etag == "" || kms || strings.Contains(etag, "-") {
+		log.Printf("Checked the size of %s only. No checksum was recorded.",
+			dest)
+		return nil
+	}
+	if etag != md5sum {
+		return fmt.Errorf("MD5 of %s is %s but expected %s", dest, md5sum,
+			etag)
+	}
+	return nil
+}
+
+// runRestore is the restore command. Materializes the tree under a path as
+// of a date on local disk or under another bucket prefix.
+func runRestore(ctx *context, args []string) error {
+	flags, name := newFlagSet("restore")
+	path := flags.String("path", "", "Path of the tree to restore. "+
+		"Ex: /blast/db/FASTA")
+	date := flags.String("date", "", "Restore the tree as of this date or "+
+		"time in UTC. Ex: 2017-08-04")
+	to := flags.String("to", "", "Local directory or s3://bucket/prefix "+
+		"to restore to.")
+	parallel := flags.Int("parallel", 8, "Number of files to copy at once.")
+	verify := flags.Bool("verify", true, "Check the sizes and checksums of "+
+		"the restored copies.")
+	days := flags.Int("restoreDays", defaultRestoreDays, "Days that files "+
+		"restored from cold storage stay readable.")
+	tier := flags.String("tier", defaultRestoreTier, "Retrieval tier for "+
+		"files in cold storage. Expedited, Standard, or Bulk.")
+	wait := flags.Bool("wait", false, "Wait for files in cold storage to be "+
+		"restored instead of leaving them for a later run.")
+	if err := flags.Parse(args); err != nil {
+		return handle("Error in parsing flags.", err)
+	}
+	if *path == "" {
+		return errors.New("Set -path to restore.")
+	}
+	asOf, err := parseAsOf(*date)
+	if err != nil {
+		return handle("Error in parsing date.", err)
+	}
+	target, err := parseRestoreTarget(*to)
+	if err != nil {
+		return handle("Error in parsing destination.", err)
+	}
+	srcCtx, err := contextForSource(ctx, *name)
+	if err != nil {
+		return handle("Error in finding source.", err)
+	}
+	_, err = restoreTree(srcCtx, *path, asOf, target, *parallel, *verify,
+		thawOptions{days: *days, tier: *tier, wait: *wait})
+	return err
+}
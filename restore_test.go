@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"testing"
+	"time"
+)
+
+func TestParseRestoreTarget(t *testing.T) {
+	res, err := parseRestoreTarget("s3://bucket/restore/2017/")
+	assert.Nil(t, err)
+	assert.Equal(t, restoreTarget{bucket: "bucket", prefix: "restore/2017"}, res)
+	res, err = parseRestoreTarget("/data/restore/")
+	assert.Nil(t, err)
+	assert.Equal(t, restoreTarget{dir: "/data/restore"}, res)
+	_, err = parseRestoreTarget("s3:///a")
+	assert.NotNil(t, err)
+	_, err = parseRestoreTarget("")
+	assert.NotNil(t, err)
+}
+
+func TestParseAsOf(t *testing.T) {
+	res, err := parseAsOf("2017-08-04")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2017, 8, 4, 23, 59, 59, 0, time.UTC), res)
+	res, err = parseAsOf("2017-08-04T10:00:00")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2017, 8, 4, 10, 0, 0, 0, time.UTC), res)
+	_, err = parseAsOf("yesterday")
+	assert.NotNil(t, err)
+}
+
+func TestVersionsAsOf(t *testing.T) {
+	mock, ctx := testSetup(t)
+	rows := sqlmock.NewRows([]string{"PathName", "VersionNum", "DateModified", "ArchiveKey", "VersionId", "Size", "Md5", "Sha256"}).
+		AddRow("/blast/db/a", 1, "2017-08-01 10:00:00", "archive/0123456789abcdef0123456789abcdef", nil, nil, nil, nil).
+		AddRow("/blast/db/a", 2, "2017-08-03 10:00:00", "archive/abcdef0123456789abcdef0123456789", nil, nil, nil, nil).
+		AddRow("/blast/db/a", 3, "2017-08-05 10:00:00", nil, nil, nil, nil, nil).
+		AddRow("/blast/db/b", 1, "2017-08-06 10:00:00", nil, nil, nil, nil, nil).
+		AddRow("/blast/db/c", 1, nil, nil, nil, nil, nil, nil)
+	mock.ExpectQuery("select PathName, VersionNum").WithArgs("/blast/db", "/blast/db/%").WillReturnRows(rows)
+
+	asOf, _ := parseAsOf("2017-08-04")
+	res, err := versionsAsOf(ctx, "/blast/db", asOf)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, 2, res[0].versionNum)
+	assert.Equal(t, "archive/abcdef0123456789abcdef0123456789", res[0].archiveKey)
+}
+
+func TestRestoreFileLocal(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.bucket = "bucket"
+	// MD5 of "hello"
+	etag := "\"5d41402abc4b2a76b9719d911017c592\""
+	testServer.Response(200, map[string]string{"Content-Length": "5", "ETag": etag}, "")
+	testServer.Response(200, map[string]string{"ETag": etag}, "hello")
+
+	e := entry{"/blast/db/a", 2, "2017-08-03 10:00:00", "archive/abcdef0123456789abcdef0123456789", "", 0, "", ""}
+	err := restoreFile(ctx, e, restoreTarget{dir: "/restore"}, true, thawOptions{})
+	assert.Nil(t, err)
+	reqs := testServer.WaitRequests(2)
+	assert.Equal(t, "/bucket/archive/abcdef0123456789abcdef0123456789", reqs[1].URL.Path)
+	data, err := afero.ReadFile(ctx.os, "/restore/blast/db/a")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// Mismatched checksums fail verification.
+	testServer.Response(200, map[string]string{"Content-Length": "5", "ETag": "\"abc\""}, "")
+	testServer.Response(200, nil, "hello")
+	err = restoreFile(ctx, e, restoreTarget{dir: "/restore"}, true, thawOptions{})
+	assert.NotNil(t, err)
+	testServer.WaitRequests(2)
+
+	// Recorded checksums are used over multipart ETags.
+	e.md5 = "5d41402abc4b2a76b9719d911017c592"
+	e.sha256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	testServer.Response(200, map[string]string{"Content-Length": "5", "ETag": "\"abc-2\""}, "")
+	testServer.Response(200, nil, "hello")
+	err = restoreFile(ctx, e, restoreTarget{dir: "/restore"}, true, thawOptions{})
+	assert.Nil(t, err)
+	testServer.WaitRequests(2)
+
+	e.sha256 = "0000000000000000000000000000000000000000000000000000000000000000"
+	testServer.Response(200, map[string]string{"Content-Length": "5", "ETag": "\"abc-2\""}, "")
+	testServer.Response(200, nil, "hello")
+	err = restoreFile(ctx, e, restoreTarget{dir: "/restore"}, true, thawOptions{})
+	assert.NotNil(t, err)
+	testServer.WaitRequests(2)
+}
+
+func TestRestoreFileBucket(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.bucket = "bucket"
+	ctx.syncFolders = []syncFolder{{sourcePath: "/blast/db",
+		storage: storagePolicy{class: "STANDARD_IA",
+			encryption: s3.ServerSideEncryptionAwsKms, kmsKey: "key-1"}}}
+	testServer.Response(200, map[string]string{"Content-Length": "5"}, "")
+	expectCopyResponses(testServer, 1)
+
+	e := entry{"/blast/db/a", 2, "2017-08-03 10:00:00", "", "v1", 0, "", ""}
+	err := restoreFile(ctx, e, restoreTarget{bucket: "restored", prefix: "old"}, false, thawOptions{})
+	assert.Nil(t, err)
+	reqs := testServer.WaitRequests(5)
+	assert.Equal(t, "/restored/old/blast/db/a", reqs[2].URL.Path)
+	assert.Equal(t, "STANDARD_IA", reqs[2].Header.Get("X-Amz-Storage-Class"))
+	assert.Equal(t, "aws:kms", reqs[2].Header.Get("X-Amz-Server-Side-Encryption"))
+	assert.Equal(t, "key-1", reqs[2].Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+}
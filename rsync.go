@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"github.com/spf13/afero"
 	"gopkg.in/fatih/set.v0"
 	"log"
 	"os"
@@ -11,7 +12,7 @@ import (
 
 // copyFileFromRemote copies one file from remote server to local disk folder.
 func copyFileFromRemote(ctx *context, file string) error {
-	source := fmt.Sprintf("%s%s", ctx.server, file)
+	source := remoteURL(ctx, file)
 	// Ex: $HOME/temp/blast/db
 	log.Print("Local dir to make: " + ctx.temp + filepath.Dir(file))
 	err := ctx.os.MkdirAll(ctx.temp+filepath.Dir(file), os.ModePerm)
@@ -24,6 +25,21 @@ func copyFileFromRemote(ctx *context, file string) error {
 	//	"--copy-links %s %s"
 	template := "wget -S -nv -O %s %s"
 	cmd := fmt.Sprintf(template, dest, source)
+	if ctx.src.username != "" {
+		// Credentials go in a wget config file to keep them out of the log.
+		rc := fmt.Sprintf("user = %s\npassword = %s\n", ctx.src.username,
+			ctx.src.password)
+		rcFile, err := writeCredentialsFile(ctx, "wgetrc", rc)
+		if err != nil {
+			return handle("Couldn't write wget config file.", err)
+		}
+		cmd = fmt.Sprintf("wget --config=%s -S -nv -O %s %s", rcFile, dest,
+			source)
+	}
+	if rate := downloadRate(ctx); rate > 0 {
+		cmd = strings.Replace(cmd, "wget ", fmt.Sprintf("wget --limit-rate=%d ",
+			rate), 1)
+	}
 	_, _, err = commandVerbose(cmd)
 	if err != nil {
 		return handle("Couldn't rsync file to local disk.", err)
@@ -31,6 +47,37 @@ func copyFileFromRemote(ctx *context, file string) error {
 	return err
 }
 
+// remoteURL gets the download URL of a file on the current source using its
+// protocol.
+func remoteURL(ctx *context, file string) string {
+	if ctx.src.protocol == "" {
+		return fmt.Sprintf("%s%s", ctx.server, file)
+	}
+	return fmt.Sprintf("%s://%s%s", ctx.src.protocol, serverHost(ctx), file)
+}
+
+// rsyncSource gets the rsync address of a folder on the current source.
+func rsyncSource(ctx *context, folder string) string {
+	host := serverHost(ctx)
+	if ctx.src.username != "" {
+		host = ctx.src.username + "@" + host
+	}
+	return "rsync://" + host + folder + "/"
+}
+
+// writeCredentialsFile writes a secret for the current source to a file only
+// readable by the running user, so it stays out of logged commands. Returns
+// the file path.
+func writeCredentialsFile(ctx *context, kind string, content string) (string,
+	error) {
+	path := fmt.Sprintf("%s/.%s-%s", ctx.local, kind, ctx.src.name)
+	err := afero.WriteFile(ctx.os, path, []byte(content), 0600)
+	if err != nil {
+		return path, handle("Error in writing credentials file.", err)
+	}
+	return path, err
+}
+
 // listFromRsync gets a list of inspected files from rsync. Used to leverage
 // rsync's built-in filtering capabilities.
 func listFromRsync(out string, base string) *set.Set {
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Sync run statuses.
+const (
+	runRunning     = "running"
+	runDone        = "done"
+	runFailed      = "failed"
+	runInterrupted = "interrupted"
+)
+
+// dbCreateRunTables creates the tables recording sync runs and the hooks run
+// after them, if not present.
+func dbCreateRunTables(ctx *context) {
+	queries := []string{
+		"CREATE TABLE IF NOT EXISTS sync_runs (" +
+			"RunId VARCHAR(255) NOT NULL, " +
+			"Source VARCHAR(255) NOT NULL, " +
+			"DateStarted DATETIME NOT NULL, " +
+			"DateEnded DATETIME, " +
+			"Status VARCHAR(20) NOT NULL, " +
+			"NewFiles INT, " +
+			"Modified INT, " +
+			"Deleted INT, " +
+			"Failed INT, " +
+			"PRIMARY KEY (RunId));",
+		"CREATE TABLE IF NOT EXISTS hook_runs (" +
+			"RunId VARCHAR(255) NOT NULL, " +
+			"Folder VARCHAR(500) NOT NULL, " +
+			"HookNum INT NOT NULL, " +
+			"Command VARCHAR(2000) NOT NULL, " +
+			"ExitStatus INT, " +
+			"TimedOut INT, " +
+			"Output TEXT, " +
+			"DateStarted DATETIME, " +
+			"DateEnded DATETIME, " +
+			"PRIMARY KEY (RunId, Folder, HookNum));",
+	}
+	for _, query := range queries {
+		if _, err := ctx.db.Exec(dbCreateQuery(ctx, query)); err != nil {
+			log.Print(err)
+			log.Fatal("Failed to find or create run tables.")
+		}
+	}
+}
+
+// runIdOf gets the id of a sync run of a source.
+// Ex: ncbi-20170804T220841Z
+func runIdOf(src string, start time.Time) string {
+	return src + "-" + start.UTC().Format("20060102T150405Z")
+}
+
+// dbTime formats a time for a DATETIME column.
+func dbTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// dbStartRun records the start of the current sync run.
+func dbStartRun(ctx *context, start time.Time) error {
+	_, err := ctx.db.Exec("insert into sync_runs (RunId, Source, DateStarted, "+
+		"Status) values (?, ?, ?, ?);", ctx.runId, ctx.src.name, dbTime(start),
+		runRunning)
+	if err != nil {
+		return handle("Error in recording run start.", err)
+	}
+	return err
+}
+
+// dbFinishRun records the outcome of the current sync run and how many files
+// changed.
+func dbFinishRun(ctx *context, end time.Time, status string, res syncResult,
+	failed int) error {
+	_, err := ctx.db.Exec("update sync_runs set DateEnded=?, Status=?, "+
+		"NewFiles=?, Modified=?, Deleted=?, Failed=? where RunId=?;",
+		dbTime(end), status, len(res.newF), len(res.modified),
+		len(res.deleted), failed, ctx.runId)
+	if err != nil {
+		return handle("Error in recording run end.", err)
+	}
+	return err
+}
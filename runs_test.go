@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRunRecords(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.src.name = "ncbi"
+	start := time.Date(2017, 8, 4, 22, 8, 41, 0, time.UTC)
+	ctx.runId = runIdOf(ctx.src.name, start)
+	assert.Equal(t, "ncbi-20170804T220841Z", ctx.runId)
+
+	mock.ExpectExec("insert into sync_runs").WithArgs(ctx.runId, "ncbi", "2017-08-04 22:08:41", runRunning).WillReturnResult(testResult)
+	mock.ExpectExec("update sync_runs").WithArgs("2017-08-04 23:00:00", runDone, 2, 1, 0, 1, ctx.runId).WillReturnResult(testResult)
+	assert.Nil(t, dbStartRun(ctx, start))
+	res := syncResult{newF: []string{"/a", "/b"}, modified: []string{"/c"}}
+	assert.Nil(t, dbFinishRun(ctx, time.Date(2017, 8, 4, 23, 0, 0, 0, time.UTC), runDone, res, 1))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
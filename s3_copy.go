@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings for server-side copies. S3 allows parts of up to 5 GB and at most
+// 10,000 parts per upload.
+var copyPartSize = 512 * 1024 * 1024
+var copyConcurrency = 8
+var copyRetries = 3
+var copyRetryWait = 5 * time.Second
+
+const maxCopyParts = 10000
+
+// copyObjectS3 copies an object, or one version of it, to another key on the
+// same bucket without downloading it. Objects of every size go through a
+// multipart upload with UploadPartCopy. Parts are copied in parallel and
+// retried, and the upload is aborted if any part fails. Returns the VersionId
+// of the new copy if the bucket is versioned.
+func copyObjectS3(ctx *context, from string, versionId string, to string,
+	size int) (string, error) {
+	return copyObjectToBucket(ctx, from, versionId, ctx.bucket, to, size,
+		storageOptions{})
+}
+
+// copyObjectStored copies an object within the bucket of the current source
+// and writes the copy with storage options. See copyObjectS3.
+func copyObjectStored(ctx *context, from string, to string, size int,
+	opts storageOptions) (string, error) {
+	return copyObjectToBucket(ctx, from, "", ctx.bucket, to, size, opts)
+}
+
+// copyObjectToBucket copies an object, or one version of it, from the bucket
+// of the current source to a key on any bucket. See copyObjectS3.
+func copyObjectToBucket(ctx *context, from string, versionId string,
+	bucket string, to string, size int, opts storageOptions) (string, error) {
+	svc := ctx.svcS3
+	source := copySource(ctx.bucket, from, versionId)
+	// Multipart copies don't carry over the type and metadata of the source
+	// like CopyObject does.
+	head, err := svc.HeadObject(versionInput(ctx, from, versionId))
+	if err != nil {
+		return "", handle("Error in getting details of "+from+".", err)
+	}
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(to),
+		ContentType: head.ContentType,
+		Metadata:    head.Metadata,
+	}
+	opts.setCopy(input)
+	create, err := svc.CreateMultipartUpload(input)
+	if err != nil {
+		return "", handle("Error in starting multipart copy.", err)
+	}
+	uploadId := create.UploadId
+
+	parts, err := copyParts(ctx, source, bucket, to, uploadId, size)
+	if err != nil {
+		// Clean up so the parts aren't stored and billed.
+		_, abortErr := svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(to),
+			UploadId: uploadId,
+		})
+		errOut("Error in aborting multipart copy", abortErr)
+		return "", handle(fmt.Sprintf("Error in copying %s on S3.", from), err)
+	}
+
+	output, err := svc.CompleteMultipartUpload(
+		&s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(bucket),
+			Key:             aws.String(to),
+			UploadId:        uploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+	if err != nil {
+		return "", handle("Error in completing multipart copy.", err)
+	}
+	awsOutput(output.GoString())
+	return aws.StringValue(output.VersionId), err
+}
+
+// copySource gets the URL-encoded copy source of an object or one version of
+// it. Ex: czbiohub-ncbi-store/pub/a%20b%2Bc.gz?versionId=v1
+func copySource(bucket string, key string, versionId string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		// QueryEscape also escapes + that S3 would read as a space.
+		segments[i] = strings.Replace(url.QueryEscape(segment), "+", "%20",
+			-1)
+	}
+	res := bucket + "/" + strings.Join(segments, "/")
+	if versionId != "" {
+		res += "?versionId=" + url.QueryEscape(versionId)
+	}
+	return res
+}
+
+// copyParts copies all the parts of an object in parallel. Returns the
+// completed parts in order.
+func copyParts(ctx *context, source string, bucket string, to string,
+	uploadId *string, size int) ([]*s3.CompletedPart, error) {
+	partSize := copyPartSize
+	if size/partSize >= maxCopyParts {
+		partSize = size/maxCopyParts + 1
+	}
+	num := (size + partSize - 1) / partSize
+	if num == 0 {
+		num = 1 // Empty objects still need one part.
+	}
+	if num > 1 {
+		log.Printf("Copying %s in %d parts.", source, num)
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var failed error
+	parts := make([]*s3.CompletedPart, num)
+	sem := make(chan bool, copyConcurrency)
+	for i := 0; i < num; i++ {
+		// Ex: bytes=0-536870911
+		byteRange := ""
+		if size > 0 {
+			end := (i+1)*partSize - 1
+			if end > size-1 {
+				end = size - 1
+			}
+			byteRange = fmt.Sprintf("bytes=%d-%d", i*partSize, end)
+		}
+		wg.Add(1)
+		sem <- true
+		go func(partNum int64, byteRange string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			part, err := copyPart(ctx, source, bucket, to, uploadId, partNum,
+				byteRange)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				failed = err
+				return
+			}
+			parts[partNum-1] = part
+		}(int64(i+1), byteRange)
+	}
+	wg.Wait()
+	return parts, failed
+}
+
+// copyPart copies one part of a multipart copy. Retries on failure.
+func copyPart(ctx *context, source string, bucket string, to string,
+	uploadId *string, partNum int64, byteRange string) (*s3.CompletedPart,
+	error) {
+	input := &s3.UploadPartCopyInput{
+		Bucket:     aws.String(bucket),
+		CopySource: aws.String(source),
+		Key:        aws.String(to),
+		PartNumber: aws.Int64(partNum),
+		UploadId:   uploadId,
+	}
+	if byteRange != "" {
+		input.CopySourceRange = aws.String(byteRange)
+	}
+	var err error
+	var output *s3.UploadPartCopyOutput
+	for attempt := 0; attempt <= copyRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * copyRetryWait)
+			log.Printf("Retrying part %d of %s.", partNum, source)
+		}
+		output, err = ctx.svcS3.UploadPartCopy(input)
+		if err == nil && output.CopyPartResult != nil {
+			return &s3.CompletedPart{
+				ETag:       output.CopyPartResult.ETag,
+				PartNumber: aws.Int64(partNum),
+			}, nil
+		}
+		if err == nil {
+			err = errors.New("no part result returned")
+		}
+		errOut(fmt.Sprintf("Error in copying part %d", partNum), err)
+	}
+	return nil, handle(fmt.Sprintf("Failed to copy part %d.", partNum), err)
+}
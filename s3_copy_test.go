@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"testing"
+)
+
+func TestCopyObjectS3(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.bucket = "czbiohub-ncbi-store"
+	tmp := copyPartSize
+	copyPartSize = 4
+	defer func() { copyPartSize = tmp }()
+
+	expectCopyResponses(testServer, 3)
+	_, err := copyObjectS3(ctx, "pub/a", "v1", "archive/a", 10)
+	assert.Nil(t, err)
+	reqs := testServer.WaitRequests(6)
+	assert.Equal(t, "HEAD", reqs[0].Method)
+	assert.Equal(t, "v1", reqs[0].URL.Query().Get("versionId"))
+	ranges := []string{}
+	for _, req := range reqs[2:5] {
+		assert.Equal(t, "czbiohub-ncbi-store/pub/a?versionId=v1", req.Header.Get("X-Amz-Copy-Source"))
+		ranges = append(ranges, req.Header.Get("X-Amz-Copy-Source-Range"))
+	}
+	sort.Strings(ranges)
+	assert.Equal(t, []string{"bytes=0-3", "bytes=4-7", "bytes=8-9"}, ranges)
+	assert.Contains(t, reqs[5].URL.RawQuery, "uploadId=up1")
+}
+
+func TestCopyObjectS3Details(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.bucket = "czbiohub-ncbi-store"
+	testServer.Response(200, map[string]string{"Content-Type": "application/gzip", "x-amz-meta-origin": "ncbi"}, "")
+	testServer.Response(200, nil, initiatedUpload)
+	testServer.Response(200, nil, "<CopyPartResult><ETag>\"p\"</ETag></CopyPartResult>")
+	testServer.Response(200, nil, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	_, err := copyObjectS3(ctx, "pub/a b+c%?é.gz", "", "archive/a", 0)
+	assert.Nil(t, err)
+	reqs := testServer.WaitRequests(4)
+	assert.Equal(t, "application/gzip", reqs[1].Header.Get("Content-Type"))
+	assert.Equal(t, "ncbi", reqs[1].Header.Get("X-Amz-Meta-Origin"))
+	assert.Equal(t, "czbiohub-ncbi-store/pub/a%20b%2Bc%25%3F%C3%A9.gz", reqs[2].Header.Get("X-Amz-Copy-Source"))
+}
+
+func TestCopySource(t *testing.T) {
+	assert.Equal(t, "bucket/pub/a%2Bb/c%20d.gz?versionId=a%2Bb", copySource("bucket", "pub/a+b/c d.gz", "a+b"))
+	assert.Equal(t, "bucket/pub/a", copySource("bucket", "pub/a", ""))
+}
+
+func TestCopyObjectS3Empty(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.bucket = "czbiohub-ncbi-store"
+	expectCopyResponses(testServer, 1)
+	_, err := copyObjectS3(ctx, "pub/empty", "", "archive/empty", 0)
+	assert.Nil(t, err)
+	reqs := testServer.WaitRequests(4)
+	assert.Equal(t, "", reqs[2].Header.Get("X-Amz-Copy-Source-Range"))
+}
+
+func TestCopyPartRetry(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.bucket = "czbiohub-ncbi-store"
+	tmp := copyRetryWait
+	copyRetryWait = 0
+	defer func() { copyRetryWait = tmp }()
+
+	testServer.Response(403, nil, "")
+	testServer.Response(200, nil, "<CopyPartResult><ETag>\"p\"</ETag></CopyPartResult>")
+	upload := "up1"
+	part, err := copyPart(ctx, "czbiohub-ncbi-store/pub/a", ctx.bucket, "archive/a", &upload, 2, "bytes=0-3")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), *part.PartNumber)
+	assert.Equal(t, "\"p\"", *part.ETag)
+	testServer.WaitRequests(2)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"github.com/jlaffaye/ftp"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultShutdownGrace is how long runs get to finish after a stop signal if
+// the config doesn't say.
+const defaultShutdownGrace = 5 * time.Minute
+
+// errInterrupted is the error of runs stopped by a shutdown.
+var errInterrupted = errors.New("interrupted by shutdown")
+
+// exit ends the process. Replaced in tests.
+var exit = os.Exit
+
+// An activeRun represents a sync run in progress and the changes it found.
+type activeRun struct {
+	ctx       *context
+	res       syncResult
+	filesDone bool // Whether the file operations of every change ended
+}
+
+// A stopState represents the shutdown state of the process. Once a stop is
+// requested no run or file is started. The mutex guards every field.
+type stopState struct {
+	mutex     sync.Mutex
+	requested bool
+	runs      map[string]*activeRun
+	conns     map[*ftp.ServerConn]bool // Open FTP connections
+	wg        sync.WaitGroup           // Runs in progress
+}
+
+var stop = stopState{
+	runs:  make(map[string]*activeRun),
+	conns: make(map[*ftp.ServerConn]bool),
+}
+
+// handleSignals shuts down on SIGTERM or SIGINT.
+func handleSignals(ctx *context) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %s. Shutting down...", sig)
+		exit(shutdown(ctx))
+	}()
+}
+
+// shutdown stops scheduling new files and waits up to the grace period for
+// runs in progress to finish. Runs still going after that are recorded as
+// interrupted. Then closes the FTP and db connections. Returns the exit
+// status, 1 if runs had to be cut off.
+func shutdown(ctx *context) int {
+	requestStop()
+	status := 0
+	if !waitForRuns(ctx.shutdownGrace) {
+		log.Printf("Runs didn't finish within %s.", ctx.shutdownGrace)
+		interruptRuns()
+		status = 1
+	}
+	closeConnections()
+	if err := ctx.db.Close(); err != nil {
+		errOut("db was not closed properly", err)
+	}
+	log.Print("Shutdown complete.")
+	return status
+}
+
+// requestStop asks runs to stop before their next file.
+func requestStop() {
+	stop.mutex.Lock()
+	defer stop.mutex.Unlock()
+	stop.requested = true
+}
+
+// stopping reports whether a shutdown was requested.
+func stopping() bool {
+	stop.mutex.Lock()
+	defer stop.mutex.Unlock()
+	return stop.requested
+}
+
+// beginRun registers the run of the context. Returns false if the process is
+// shutting down and the run shouldn't start.
+func beginRun(ctx *context) bool {
+	stop.mutex.Lock()
+	defer stop.mutex.Unlock()
+	if stop.requested {
+		return false
+	}
+	stop.runs[ctx.runId] = &activeRun{ctx: ctx}
+	stop.wg.Add(1)
+	return true
+}
+
+// setRunChanges records the changes a run is working on, for recording the
+// run if it's cut off.
+func setRunChanges(ctx *context, res syncResult, filesDone bool) {
+	stop.mutex.Lock()
+	defer stop.mutex.Unlock()
+	if run, present := stop.runs[ctx.runId]; present {
+		run.res, run.filesDone = res, filesDone
+	}
+}
+
+// endRun unregisters the run of the context once it's recorded.
+func endRun(ctx *context) {
+	stop.mutex.Lock()
+	defer stop.mutex.Unlock()
+	if _, present := stop.runs[ctx.runId]; present {
+		delete(stop.runs, ctx.runId)
+		stop.wg.Done()
+	}
+}
+
+// waitForRuns waits for the runs in progress to end. Returns false if the
+// grace period ran out first.
+func waitForRuns(grace time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		stop.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(grace):
+		return false
+	}
+}
+
+// interruptRuns records the runs still in progress as interrupted with the
+// files they started.
+func interruptRuns() {
+	stop.mutex.Lock()
+	defer stop.mutex.Unlock()
+	for id, run := range stop.runs {
+		stats := statsFor(run.ctx, run.ctx.src.name)
+		res := run.res
+		if !run.filesDone {
+			res = attempted(res, stats.started())
+		}
+		end := stats.fail(errInterrupted)
+		errOut("Error in recording run", dbFinishRun(run.ctx, end,
+			runInterrupted, res, 0))
+		delete(stop.runs, id)
+		stop.wg.Done()
+	}
+}
+
+// attempted trims the changes of a run to the files it started. New files
+// are handled before modified ones.
+func attempted(res syncResult, started int) syncResult {
+	if started < len(res.newF) {
+		res.newF = res.newF[:started]
+		res.modified = nil
+		return res
+	}
+	started -= len(res.newF)
+	if started < len(res.modified) {
+		res.modified = res.modified[:started]
+	}
+	return res
+}
+
+// trackConn registers an open FTP connection.
+func trackConn(client *ftp.ServerConn) {
+	stop.mutex.Lock()
+	defer stop.mutex.Unlock()
+	stop.conns[client] = true
+}
+
+// quitServer closes an FTP connection and unregisters it.
+func quitServer(client *ftp.ServerConn) error {
+	stop.mutex.Lock()
+	delete(stop.conns, client)
+	stop.mutex.Unlock()
+	return client.Quit()
+}
+
+// closeConnections closes the FTP connections left open by cut off runs.
+func closeConnections() {
+	stop.mutex.Lock()
+	conns := stop.conns
+	stop.conns = make(map[*ftp.ServerConn]bool)
+	stop.mutex.Unlock()
+	for client := range conns {
+		errOut("Error in quitting FTP connection", client.Quit())
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/jlaffaye/ftp"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"testing"
+	"time"
+)
+
+// resetStop clears the shutdown state left by a test.
+func resetStop() {
+	stop.mutex.Lock()
+	defer stop.mutex.Unlock()
+	stop.requested = false
+	stop.runs = make(map[string]*activeRun)
+	stop.conns = make(map[*ftp.ServerConn]bool)
+}
+
+func TestAttempted(t *testing.T) {
+	res := syncResult{newF: []string{"/a", "/b"}, modified: []string{"/c", "/d"}}
+	got := attempted(res, 1)
+	assert.Equal(t, []string{"/a"}, got.newF)
+	assert.Empty(t, got.modified)
+	got = attempted(res, 3)
+	assert.Equal(t, []string{"/a", "/b"}, got.newF)
+	assert.Equal(t, []string{"/c"}, got.modified)
+	got = attempted(res, 4)
+	assert.Equal(t, res, got)
+}
+
+func TestStopSkipsFiles(t *testing.T) {
+	_, ctx := testSetup(t)
+	defer resetStop()
+	ctx.src.name = "ncbi"
+	requestStop()
+	assert.True(t, stopping())
+	assert.Equal(t, 0, newFilesOperations(ctx, []string{"/a"}, nil))
+	assert.Equal(t, 0, modifiedFilesOperations(ctx, []string{"/b"}, nil))
+	assert.Equal(t, 0, statsFor(ctx, "ncbi").started())
+
+	assert.Equal(t, errInterrupted, syncSource(ctx, ctx.src))
+	assert.Equal(t, errInterrupted, statsFor(ctx, "ncbi").lastErr)
+}
+
+func TestShutdownInterruptsRuns(t *testing.T) {
+	mock, ctx := testSetup(t)
+	defer resetStop()
+	ctx.src.name = "ncbi"
+	ctx.runId = "ncbi-20170804T220841Z"
+	ctx.shutdownGrace = 10 * time.Millisecond
+	stats := statsFor(ctx, "ncbi")
+	stats.start()
+	assert.True(t, beginRun(ctx))
+	res := syncResult{newF: []string{"/a", "/b"}, modified: []string{"/c"}}
+	setRunChanges(ctx, res, false)
+	stats.setStage(stageFiles, 3)
+	stats.advance()
+
+	mock.ExpectExec("update sync_runs").WithArgs(sqlmock.AnyArg(), runInterrupted,
+		1, 0, 0, 0, ctx.runId).WillReturnResult(testResult)
+	mock.ExpectClose()
+	assert.Equal(t, 1, shutdown(ctx))
+	assert.False(t, beginRun(ctx))
+	assert.False(t, stats.running)
+	assert.Equal(t, errInterrupted, stats.lastErr)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestShutdownWaitsForRuns(t *testing.T) {
+	mock, ctx := testSetup(t)
+	defer resetStop()
+	ctx.runId = "ncbi-20170804T220841Z"
+	ctx.shutdownGrace = time.Minute
+	assert.True(t, beginRun(ctx))
+	go func() {
+		for !stopping() {
+			time.Sleep(time.Millisecond)
+		}
+		endRun(ctx)
+	}()
+
+	mock.ExpectClose()
+	assert.Equal(t, 0, shutdown(ctx))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A snapshot represents a named record of the version of every file under
+// some syncFolders at one point in time.
+type snapshot struct {
+	name        string
+	source      string
+	created     time.Time
+	folders     []string
+	manifestKey string
+	files       []snapshotFile
+}
+
+// A snapshotFile represents one file version in a snapshot and where it was
+// stored when the snapshot was taken.
+type snapshotFile struct {
+	Path      string `json:"path"`
+	Version   int    `json:"version"`
+	Key       string `json:"key"`
+	VersionId string `json:"versionId,omitempty"`
+}
+
+// A versionChange represents a file that differs between two states. From is
+// 0 for added files and To is 0 for removed files.
+type versionChange struct {
+	path string
+	from int
+	to   int
+}
+
+// dbCreateSnapshotTables creates the snapshot tables if not present. Path
+// names are recorded the same way as in entries.
+func dbCreateSnapshotTables(ctx *context) {
+	queries := []string{
+		"CREATE TABLE IF NOT EXISTS snapshots (" +
+			"Name VARCHAR(255) NOT NULL, " +
+			"Source VARCHAR(255) NOT NULL, " +
+			"DateCreated DATETIME NOT NULL, " +
+			"Folders VARCHAR(2000), " +
+			"ManifestKey VARCHAR(1000), " +
+			"PRIMARY KEY (Name));",
+		"CREATE TABLE IF NOT EXISTS snapshot_entries (" +
+			"Snapshot VARCHAR(255) NOT NULL, " +
+			"PathName VARCHAR(500) NOT NULL, " +
+			"VersionNum INT NOT NULL, " +
+			"PRIMARY KEY (Snapshot, PathName));",
+	}
+	for _, query := range queries {
+		if _, err := ctx.db.Exec(dbCreateQuery(ctx, query)); err != nil {
+			log.Print(err)
+			log.Fatal("Failed to find or create snapshot tables.")
+		}
+	}
+}
+
+// autoSnapshotName gets the name of the snapshot taken after a run of the
+// current source. Ex: ncbi-20170804T220841Z
+func autoSnapshotName(ctx *context, t time.Time) string {
+	return ctx.src.name + "-" + t.UTC().Format("20060102T150405Z")
+}
+
+// createSnapshot records the current version of every file under the given
+// folders of the current source, or all of its syncFolders if none are given.
+// Writes a manifest of the snapshot to the bucket.
+func createSnapshot(ctx *context, name string, folders []string) (snapshot,
+	error) {
+	res := snapshot{name: name, source: ctx.src.name, created: now().UTC()}
+	if name == "" || strings.Contains(name, "/") {
+		return res, errors.New("Invalid snapshot name " + name)
+	}
+	if len(folders) == 0 {
+		for _, folder := range ctx.syncFolders {
+			folders = append(folders, folder.sourcePath)
+		}
+	}
+	res.folders = folders
+	seen := make(map[string]bool) // Folders may overlap
+	for _, folder := range folders {
+		entries, err := dbEntries(ctx, folder)
+		if err != nil {
+			return res, handle("Error in getting entries of "+folder, err)
+		}
+		for _, e := range entries {
+			if e.archiveKey != "" || seen[e.pathName] {
+				continue // Only current versions
+			}
+			seen[e.pathName] = true
+			res.files = append(res.files, snapshotFile{e.pathName, e.versionNum,
+				objectKey(ctx, e.pathName), e.versionId})
+		}
+	}
+	res.manifestKey = withPrefix(ctx, "snapshots/"+name+".json")
+
+	if err := dbSaveSnapshot(ctx, res); err != nil {
+		return res, handle("Error in saving snapshot.", err)
+	}
+	if err := putSnapshotManifest(ctx, res); err != nil {
+		return res, handle("Error in writing snapshot manifest.", err)
+	}
+	log.Printf("Saved snapshot %s of %d files.", name, len(res.files))
+	return res, nil
+}
+
+// dbSaveSnapshot records a snapshot and its files in one transaction.
+func dbSaveSnapshot(ctx *context, snap snapshot) error {
+	tx, err := ctx.db.Begin()
+	if err != nil {
+		return handle("Error in starting transaction.", err)
+	}
+	_, err = tx.Exec("insert into snapshots(Name, Source, DateCreated, "+
+		"Folders, ManifestKey) values(?, ?, ?, ?, ?)", snap.name, snap.source,
+		dbTime(snap.created),
+		strings.Join(snap.folders, ","), snap.manifestKey)
+	if err != nil {
+		errOut("Error in rolling back", tx.Rollback())
+		return handle("Error in inserting snapshot.", err)
+	}
+	for _, f := range snap.files {
+		_, err = tx.Exec("insert into snapshot_entries(Snapshot, PathName, "+
+			"VersionNum) values(?, ?, ?)", snap.name, dbPathName(ctx, f.Path),
+			f.Version)
+		if err != nil {
+			errOut("Error in rolling back", tx.Rollback())
+			return handle("Error in inserting snapshot entry.", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return handle("Error in committing snapshot.", err)
+	}
+	return err
+}
+
+// putSnapshotManifest writes the manifest object of a snapshot as JSON. Keys
+// are where the files were stored when the snapshot was taken.
+func putSnapshotManifest(ctx *context, snap snapshot) error {
+	body, err := json.MarshalIndent(struct {
+		Name    string         `json:"name"`
+		Source  string         `json:"source"`
+		Created string         `json:"created"`
+		Folders []string       `json:"folders"`
+		Files   []snapshotFile `json:"files"`
+	}{snap.name, snap.source, snap.created.Format(time.RFC3339), snap.folders,
+		snap.files}, "", "  ")
+	if err != nil {
+		return handle("Error in encoding manifest.", err)
+	}
+	_, err = ctx.svcS3.PutObject(&s3.PutObjectInput{
+		Body:        bytes.NewReader(body),
+		Bucket:      aws.String(ctx.bucket),
+		Key:         aws.String(snap.manifestKey),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return handle("Error in uploading manifest.", err)
+	}
+	return err
+}
+
+// dbSnapshots gets the recorded snapshots without their files, oldest first.
+func dbSnapshots(ctx *context) ([]snapshot, error) {
+	res := []snapshot{}
+	rows, err := ctx.db.Query("select Name, Source, DateCreated, Folders, " +
+		"ManifestKey from snapshots order by DateCreated, Name")
+	if err != nil {
+		return res, handle("Error in querying snapshots.", err)
+	}
+	defer func() {
+		if err = rows.Close(); err != nil {
+			errOut("Error in closing rows", err)
+		}
+	}()
+
+	for rows.Next() {
+		var snap snapshot
+		var created string
+		var folders, manifest sql.NullString
+		if err = rows.Scan(&snap.name, &snap.source, &created, &folders,
+			&manifest); err != nil {
+			return res, handle("Error scanning row.", err)
+		}
+		snap.created, _ = parseDbTime(created)
+		if folders.String != "" {
+			snap.folders = strings.Split(folders.String, ",")
+		}
+		snap.manifestKey = manifest.String
+		res = append(res, snap)
+	}
+	return res, rows.Err()
+}
+
+// dbSnapshotSource gets the name of the source a snapshot was taken of.
+func dbSnapshotSource(ctx *context, name string) (string, error) {
+	var res string
+	err := ctx.db.QueryRow("select Source from snapshots where Name=?",
+		name).Scan(&res)
+	if err == sql.ErrNoRows {
+		return res, errors.New("No snapshot named " + name)
+	} else if err != nil {
+		return res, handle("Error in querying snapshot.", err)
+	}
+	return res, err
+}
+
+// dbSnapshotVersions gets the version number of each file in a snapshot of
+// the current source.
+func dbSnapshotVersions(ctx *context, name string) (map[string]int, error) {
+	res := make(map[string]int)
+	rows, err := ctx.db.Query("select PathName, VersionNum from "+
+		"snapshot_entries where Snapshot=?", name)
+	if err != nil {
+		return res, handle("Error in querying snapshot entries.", err)
+	}
+	defer func() {
+		if err = rows.Close(); err != nil {
+			errOut("Error in closing rows", err)
+		}
+	}()
+
+	for rows.Next() {
+		var name string
+		var num int
+		if err = rows.Scan(&name, &num); err != nil {
+			return res, handle("Error scanning row.", err)
+		}
+		if file, ok := fileOfDbPath(ctx, name); ok {
+			res[file] = num
+		}
+	}
+	return res, rows.Err()
+}
+
+// resolveSnapshot gets where each file version of a snapshot is stored now.
+// Versions archived since the snapshot was taken resolve to their archived
+// copies.
+func resolveSnapshot(ctx *context, name string) ([]snapshotFile, error) {
+	res := []snapshotFile{}
+	versions, err := dbSnapshotVersions(ctx, name)
+	if err != nil {
+		return res, handle("Error in getting snapshot versions.", err)
+	}
+	for _, file := range sortedKeys(versions) {
+		key, versionId, err := dbVersionLocation(ctx, file, versions[file])
+		if err != nil {
+			return res, handle("Error in resolving "+file, err)
+		}
+		res = append(res, snapshotFile{file, versions[file], key, versionId})
+	}
+	return res, err
+}
+
+// diffVersions compares two sets of file versions. Returns the added,
+// removed, and changed files ordered by path.
+func diffVersions(before map[string]int, after map[string]int) []versionChange {
+	res := []versionChange{}
+	all := make(map[string]int)
+	for file := range before {
+		all[file] = 0
+	}
+	for file := range after {
+		all[file] = 0
+	}
+	for _, file := range sortedKeys(all) {
+		if before[file] != after[file] {
+			res = append(res, versionChange{file, before[file], after[file]})
+		}
+	}
+	return res
+}
+
+// sortedKeys gets the keys of a map in order.
+func sortedKeys(m map[string]int) []string {
+	res := []string{}
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// formatChange formats a change for command output. Ex: ~ /a/b (v2 -> v3)
+func formatChange(c versionChange) string {
+	switch {
+	case c.from == 0:
+		return fmt.Sprintf("+ %s (v%d)", c.path, c.to)
+	case c.to == 0:
+		return fmt.Sprintf("- %s (v%d)", c.path, c.from)
+	}
+	return fmt.Sprintf("~ %s (v%d -> v%d)", c.path, c.from, c.to)
+}
+
+// runSnapshot is the snapshot command. Takes a named snapshot of the current
+// file versions.
+func runSnapshot(ctx *context, args []string) error {
+	flags, src := newFlagSet("snapshot")
+	name := flags.String("name", "", "Name of the snapshot. Defaults to "+
+		"the source name and time.")
+	folders := flags.String("folders", "", "Comma-separated syncFolders to "+
+		"include. Defaults to all of the source's.")
+	if err := flags.Parse(args); err != nil {
+		return handle("Error in parsing flags.", err)
+	}
+	srcCtx, err := contextForSource(ctx, *src)
+	if err != nil {
+		return handle("Error in finding source.", err)
+	}
+	if *name == "" {
+		*name = autoSnapshotName(srcCtx, now())
+	}
+	list := []string{}
+	if *folders != "" {
+		list = strings.Split(*folders, ",")
+	}
+	_, err = createSnapshot(srcCtx, *name, list)
+	return err
+}
+
+// runListSnapshots is the list-snapshots command.
+func runListSnapshots(ctx *context, args []string) error {
+	snaps, err := dbSnapshots(ctx)
+	if err != nil {
+		return handle("Error in listing snapshots.", err)
+	}
+	for _, snap := range snaps {
+		fmt.Printf("%s\t%s\t%s\t%s\n", snap.name, snap.source,
+			snap.created.Format(time.RFC3339), strings.Join(snap.folders, ","))
+	}
+	return err
+}
+
+// runDiffSnapshots is the diff-snapshots command. Lists the files added,
+// removed, and changed from the first snapshot to the second.
+func runDiffSnapshots(ctx *context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("Usage: diff-snapshots <from> <to>")
+	}
+	states := []map[string]int{}
+	for _, name := range args {
+		srcCtx, err := snapshotContext(ctx, name)
+		if err != nil {
+			return err
+		}
+		versions, err := dbSnapshotVersions(srcCtx, name)
+		if err != nil {
+			return handle("Error in getting snapshot versions.", err)
+		}
+		states = append(states, versions)
+	}
+	for _, c := range diffVersions(states[0], states[1]) {
+		fmt.Println(formatChange(c))
+	}
+	return nil
+}
+
+// runResolveSnapshot is the resolve-snapshot command. Lists the key and
+// VersionId of each file in a snapshot.
+func runResolveSnapshot(ctx *context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: resolve-snapshot <name>")
+	}
+	srcCtx, err := snapshotContext(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	files, err := resolveSnapshot(srcCtx, args[0])
+	if err != nil {
+		return handle("Error in resolving snapshot.", err)
+	}
+	for _, f := range files {
+		fmt.Printf("%s\t%d\t%s\t%s\n", f.Path, f.Version, f.Key, f.VersionId)
+	}
+	return err
+}
+
+// snapshotContext gets a context set up for the source of a snapshot.
+func snapshotContext(ctx *context, name string) (*context, error) {
+	src, err := dbSnapshotSource(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return contextForSource(ctx, src)
+}
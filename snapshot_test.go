@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"testing"
+	"time"
+)
+
+func TestCreateSnapshot(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.bucket = "bucket"
+	ctx.src.name = "ncbi"
+	ctx.syncFolders = []syncFolder{{sourcePath: "/pub/taxonomy"}}
+	tmp := now
+	now = func() time.Time { return time.Date(2017, 9, 1, 10, 0, 0, 0, time.UTC) }
+	defer func() { now = tmp }()
+	rows := sqlmock.NewRows([]string{"PathName", "VersionNum", "DateModified", "ArchiveKey", "VersionId", "Size", "Md5", "Sha256"}).
+		AddRow("/pub/taxonomy/a", 1, nil, "archive/0123456789abcdef0123456789abcdef", nil, nil, nil, nil).
+		AddRow("/pub/taxonomy/a", 2, nil, nil, nil, nil, nil, nil).
+		AddRow("/pub/taxonomy/b", 1, nil, nil, "v1", nil, nil, nil)
+	mock.ExpectQuery("select PathName, VersionNum").WithArgs("/pub/taxonomy", "/pub/taxonomy/%").WillReturnRows(rows)
+	mock.ExpectBegin()
+	mock.ExpectExec("insert into snapshots").WithArgs("tax-1", "ncbi", "2017-09-01 10:00:00", "/pub/taxonomy", "snapshots/tax-1.json").WillReturnResult(testResult)
+	mock.ExpectExec("insert into snapshot_entries").WithArgs("tax-1", "/pub/taxonomy/a", 2).WillReturnResult(testResult)
+	mock.ExpectExec("insert into snapshot_entries").WithArgs("tax-1", "/pub/taxonomy/b", 1).WillReturnResult(testResult)
+	mock.ExpectCommit()
+	expectResponse(testServer, 1)
+
+	snap, err := createSnapshot(ctx, "tax-1", nil)
+	assert.Nil(t, err)
+	req := testServer.WaitRequest()
+	assert.Equal(t, "PUT", req.Method)
+	assert.Equal(t, "/bucket/snapshots/tax-1.json", req.URL.Path)
+	assert.Equal(t, []snapshotFile{{"/pub/taxonomy/a", 2, "pub/taxonomy/a", ""},
+		{"/pub/taxonomy/b", 1, "pub/taxonomy/b", "v1"}}, snap.files)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	_, err = createSnapshot(ctx, "a/b", nil)
+	assert.NotNil(t, err)
+}
+
+func TestResolveSnapshot(t *testing.T) {
+	mock, ctx := testSetup(t)
+	rows := sqlmock.NewRows([]string{"PathName", "VersionNum"}).
+		AddRow("/pub/b", 1).AddRow("/pub/a", 2)
+	mock.ExpectQuery("select PathName, VersionNum from snapshot_entries").WithArgs("tax-1").WillReturnRows(rows)
+	rows = sqlmock.NewRows([]string{"ArchiveKey", "VersionId"}).AddRow("archive/0123456789abcdef0123456789abcdef", nil)
+	mock.ExpectQuery("select ArchiveKey, VersionId").WithArgs("/pub/a", 2).WillReturnRows(rows)
+	rows = sqlmock.NewRows([]string{"ArchiveKey", "VersionId"}).AddRow(nil, nil)
+	mock.ExpectQuery("select ArchiveKey, VersionId").WithArgs("/pub/b", 1).WillReturnRows(rows)
+
+	res, err := resolveSnapshot(ctx, "tax-1")
+	assert.Nil(t, err)
+	assert.Equal(t, []snapshotFile{
+		{"/pub/a", 2, "archive/0123456789abcdef0123456789abcdef", ""},
+		{"/pub/b", 1, "pub/b", ""}}, res)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestDiffVersions(t *testing.T) {
+	before := map[string]int{"/a": 1, "/b": 2, "/c": 1}
+	after := map[string]int{"/a": 1, "/b": 3, "/d": 1}
+	res := diffVersions(before, after)
+	assert.Equal(t, []versionChange{{"/b", 2, 3}, {"/c", 1, 0}, {"/d", 0, 1}}, res)
+	assert.Equal(t, "~ /b (v2 -> v3)", formatChange(res[0]))
+	assert.Equal(t, "- /c (v1)", formatChange(res[1]))
+	assert.Equal(t, "+ /d (v1)", formatChange(res[2]))
+}
+
+func TestAutoSnapshotName(t *testing.T) {
+	ctx := &context{src: source{name: "ncbi"}}
+	at := time.Date(2017, 8, 4, 22, 8, 41, 0, time.UTC)
+	assert.Equal(t, "ncbi-20170804T220841Z", autoSnapshotName(ctx, at))
+}
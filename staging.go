@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"github.com/spf13/afero"
+	"log"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// Space kept free on the staging volume for logs and other processes.
+var stagingReserve = 512 * 1024 * 1024
+
+var freeSpace = freeSpaceStatfs
+
+// A stagingPlan represents the local disk space needed for a run. Files too
+// large for the staging volume are skipped.
+type stagingPlan struct {
+	planned int
+	free    int
+	skipped []string
+}
+
+// freeSpaceStatfs gets the bytes available to unprivileged users on the
+// volume of a path.
+func freeSpaceStatfs(path string) (int, error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, handle("Error in getting free space of "+path, err)
+	}
+	return int(stat.Bavail) * int(stat.Bsize), nil
+}
+
+// cleanStaging removes files left in the staging folder by earlier runs, such
+// as partial downloads from a crashed run. Returns the bytes freed.
+func cleanStaging(ctx *context) (int, error) {
+	freed, count := 0, 0
+	err := afero.Walk(ctx.os, ctx.temp,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			if err = ctx.os.Remove(path); err != nil {
+				return err
+			}
+			freed += int(info.Size())
+			count++
+			return err
+		})
+	if err != nil {
+		return freed, handle("Error in cleaning staging folder.", err)
+	}
+	if count > 0 {
+		log.Printf("Removed %d stale files (%d bytes) from staging folder.",
+			count, freed)
+	}
+	return freed, err
+}
+
+// instanceStaging gets the staging folder of this process under the shared
+// one. Space freed during a run then never removes another instance's
+// downloads.
+func instanceStaging(temp string) string {
+	return temp + "/" + instanceId
+}
+
+// stagingUsage gets the bytes used by files in the staging folder.
+func stagingUsage(ctx *context) (int, error) {
+	used := 0
+	err := afero.Walk(ctx.os, ctx.temp,
+		func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				used += int(info.Size())
+			}
+			return err
+		})
+	if err != nil {
+		return used, handle("Error in getting staging folder usage.", err)
+	}
+	return used, err
+}
+
+// preflightStaging compares the planned download sizes from the dry run with
+// the free space on the staging volume. Files are staged one at a time and
+// removed after upload, so each file only has to fit on its own. Files that
+// can't fit are left out of the run. The rest are ordered smallest first so
+// that the most files get through if space runs low during the run.
+func preflightStaging(ctx *context, res syncResult) (syncResult, stagingPlan) {
+	plan := stagingPlan{}
+	for _, file := range append(res.newF, res.modified...) {
+		plan.planned += res.sizes[file]
+	}
+	if ctx.src.streaming {
+		log.Printf("Streaming %d bytes. No local staging needed.", plan.planned)
+		return res, plan
+	}
+	free, err := freeSpace(ctx.temp)
+	if err != nil {
+		errOut("Skipping staging pre-flight check", err)
+		return res, plan
+	}
+	plan.free = free
+	log.Printf("Staging %d bytes one file at a time. %d bytes free on %s.",
+		plan.planned, free, ctx.temp)
+
+	fits := func(files []string) []string {
+		kept := []string{}
+		for _, file := range files {
+			if res.sizes[file] > free-stagingReserve {
+				log.Printf("Skipping %s. %d bytes won't fit in staging space.",
+					file, res.sizes[file])
+				plan.skipped = append(plan.skipped, file)
+				continue
+			}
+			kept = append(kept, file)
+		}
+		sort.Stable(bySize{kept, res.sizes})
+		return kept
+	}
+	res.newF = fits(res.newF)
+	res.modified = fits(res.modified)
+	return res, plan
+}
+
+// ensureSpace checks that a file of the given size can be staged now. Stale
+// files of this instance are cleaned up once if space is short.
+func ensureSpace(ctx *context, size int) error {
+	for attempt := 0; ; attempt++ {
+		free, err := freeSpace(ctx.temp)
+		if err != nil {
+			return handle("Error in checking staging space.", err)
+		}
+		if size <= free-stagingReserve {
+			return err
+		}
+		if attempt > 0 {
+			err = fmt.Errorf("need %d bytes but %d are free", size, free)
+			return handle("Not enough staging space.", err)
+		}
+		if _, err = cleanStaging(ctx); err != nil {
+			return handle("Error in freeing staging space.", err)
+		}
+	}
+}
+
+// bySize sorts file names by their sizes.
+type bySize struct {
+	files []string
+	sizes map[string]int
+}
+
+func (s bySize) Len() int {
+	return len(s.files)
+}
+
+func (s bySize) Less(i, j int) bool {
+	return s.sizes[s.files[i]] < s.sizes[s.files[j]]
+}
+
+func (s bySize) Swap(i, j int) {
+	s.files[i], s.files[j] = s.files[j], s.files[i]
+}
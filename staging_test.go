@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func FakeFreeSpace(path string) (int, error) {
+	return stagingReserve + 100, nil
+}
+
+func TestCleanStaging(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.temp = "/synctemp"
+	afero.WriteFile(ctx.os, "/synctemp/blast/db/partial", []byte("12345"), 0644)
+	afero.WriteFile(ctx.os, "/synctemp/other", []byte("123"), 0644)
+
+	used, err := stagingUsage(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, used)
+
+	freed, err := cleanStaging(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, freed)
+	used, _ = stagingUsage(ctx)
+	assert.Equal(t, 0, used)
+}
+
+func TestPreflightStaging(t *testing.T) {
+	_, ctx := testSetup(t)
+	tmp := freeSpace
+	freeSpace = FakeFreeSpace
+	defer func() { freeSpace = tmp }()
+
+	res := syncResult{
+		newF:     []string{"apple", "banana", "cherry"},
+		modified: []string{"date"},
+		sizes:    map[string]int{"apple": 50, "banana": 500, "cherry": 10, "date": 100},
+	}
+	res, plan := preflightStaging(ctx, res)
+	assert.Equal(t, []string{"cherry", "apple"}, res.newF)
+	assert.Equal(t, []string{"date"}, res.modified)
+	assert.Equal(t, []string{"banana"}, plan.skipped)
+	assert.Equal(t, 660, plan.planned)
+
+	// Streamed files aren't staged.
+	ctx.src.streaming = true
+	res.newF = []string{"banana"}
+	res, plan = preflightStaging(ctx, res)
+	assert.Equal(t, []string{"banana"}, res.newF)
+	assert.Empty(t, plan.skipped)
+}
+
+func TestEnsureSpace(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.temp = instanceStaging("/synctemp")
+	tmp := freeSpace
+	freeSpace = FakeFreeSpace
+	defer func() { freeSpace = tmp }()
+	afero.WriteFile(ctx.os, ctx.temp+"/partial", []byte("12345"), 0644)
+	afero.WriteFile(ctx.os, "/synctemp/other-1/partial", []byte("123"), 0644)
+
+	assert.Nil(t, ensureSpace(ctx, 100))
+	assert.NotNil(t, ensureSpace(ctx, 101))
+	// Stale files are cleaned up before giving up.
+	used, _ := stagingUsage(ctx)
+	assert.Equal(t, 0, used)
+	// Other instances' downloads are left alone.
+	ok, _ := afero.Exists(ctx.os, "/synctemp/other-1/partial")
+	assert.True(t, ok)
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/smallfish/simpleyaml"
+	"log"
+	"strings"
+	"time"
+)
+
+// coldClasses are the storage classes whose objects must be restored before
+// they can be read or copied.
+var coldClasses = map[string]bool{
+	s3.StorageClassGlacier:     true,
+	s3.StorageClassDeepArchive: true,
+}
+
+// Restore states of objects in cold storage.
+const (
+	restoreAvailable = "available"
+	restoreCold      = "cold" // No restore requested
+	restorePending   = "restoring"
+	restoreStarted   = "initiated"
+)
+
+// thawLinkExpiry is how long download links of thawed versions work.
+const thawLinkExpiry = 15 * time.Minute
+
+// Restore defaults. Restored copies are readable for restoreDays.
+const (
+	defaultRestoreDays = 7
+	defaultRestoreTier = s3.TierStandard
+)
+
+// restorePoll is how often pending restores are checked when waiting for
+// them.
+var restorePoll = 5 * time.Minute
+
+// A storageOptions represents the storage class and encryption objects are
+// written with. Empty fields use the bucket defaults.
+type storageOptions struct {
+	class      string
+	encryption string // AES256 or aws:kms
+	kmsKey     string // KMS key id for aws:kms
+}
+
+// A transition represents moving archived versions to a storage class once
+// they have been archived for some time.
+type transition struct {
+	after time.Duration
+	class string
+}
+
+// A storagePolicy represents how the objects of a folder are stored. Current
+// copies and archived versions may use different classes. Archived versions
+// move through the transitions, ordered by age, as they get older.
+type storagePolicy struct {
+	class        string
+	archiveClass string
+	encryption   string
+	kmsKey       string
+	transitions  []transition
+}
+
+// A thawOptions represents how cold objects are restored.
+type thawOptions struct {
+	days int
+	tier string // Expedited, Standard, or Bulk
+	wait bool   // Wait for restores instead of leaving them for a later run
+}
+
+// loadStoragePolicy loads the optional storage settings of a folder.
+// Ex: storage: {class: STANDARD, archiveClass: STANDARD_IA,
+// encryption: sse-kms, kmsKey: alias/ncbi,
+// transitions: [{after: 720h, class: GLACIER}]}
+func loadStoragePolicy(folder *simpleyaml.Yaml) storagePolicy {
+	item := folder.Get("storage")
+	res := storagePolicy{
+		class:        loadStorageClass(item, "class"),
+		archiveClass: loadStorageClass(item, "archiveClass"),
+		kmsKey:       optionalString(item, "kmsKey", ""),
+	}
+	switch enc := optionalString(item, "encryption", ""); enc {
+	case "":
+	case "sse-s3":
+		res.encryption = s3.ServerSideEncryptionAes256
+	case "sse-kms":
+		res.encryption = s3.ServerSideEncryptionAwsKms
+	default:
+		log.Fatal("Unknown encryption " + enc + ". Use sse-s3 or sse-kms.")
+	}
+	if res.kmsKey != "" && res.encryption != s3.ServerSideEncryptionAwsKms {
+		log.Fatal("kmsKey is only used with sse-kms encryption.")
+	}
+	size, err := item.Get("transitions").GetArraySize()
+	if err != nil {
+		return res
+	}
+	for i := 0; i < size; i++ {
+		t := item.Get("transitions").GetIndex(i)
+		tr := transition{
+			after: loadDuration(t, "after", 0),
+			class: loadStorageClass(t, "class"),
+		}
+		if tr.after <= 0 || tr.class == "" {
+			log.Fatal("Set after and class of each storage transition.")
+		}
+		if i > 0 && tr.after <= res.transitions[i-1].after {
+			log.Fatal("Storage transitions must be ordered by age.")
+		}
+		res.transitions = append(res.transitions, tr)
+	}
+	return res
+}
+
+// loadStorageClass loads an optional S3 storage class. Ex: STANDARD_IA
+func loadStorageClass(yml *simpleyaml.Yaml, key string) string {
+	class := optionalString(yml, key, "")
+	if class == "" {
+		return class
+	}
+	for _, c := range s3.StorageClass_Values() {
+		if c == class {
+			return class
+		}
+	}
+	log.Fatal("Unknown storage class " + class + ".")
+	return ""
+}
+
+// policyFor gets the storage policy of the folder of a file.
+func policyFor(ctx *context, file string) storagePolicy {
+	return folderOf(ctx, file).storage
+}
+
+// options gets the options for writing an object in a storage class.
+func (p storagePolicy) options(class string) storageOptions {
+	return storageOptions{class: class, encryption: p.encryption,
+		kmsKey: p.kmsKey}
+}
+
+// current gets the options for writing current copies.
+func (p storagePolicy) current() storageOptions {
+	return p.options(p.class)
+}
+
+// archive gets the options for writing archived versions.
+func (p storagePolicy) archive() storageOptions {
+	return p.options(p.archiveClass)
+}
+
+// classFor gets the class an archived version should be in at an age. Empty
+// if no transition applies yet.
+func (p storagePolicy) classFor(age time.Duration) string {
+	class := ""
+	for _, t := range p.transitions {
+		if age >= t.after {
+			class = t.class
+		}
+	}
+	return class
+}
+
+// rank gets how far along the transitions a class is. Classes outside the
+// transitions come first.
+func (p storagePolicy) rank(class string) int {
+	for i, t := range p.transitions {
+		if t.class == class {
+			return i
+		}
+	}
+	return -1
+}
+
+// setUpload sets the options on an upload.
+func (o storageOptions) setUpload(input *s3manager.UploadInput) {
+	if o.class != "" {
+		input.StorageClass = aws.String(o.class)
+	}
+	if o.encryption != "" {
+		input.ServerSideEncryption = aws.String(o.encryption)
+	}
+	if o.kmsKey != "" {
+		input.SSEKMSKeyId = aws.String(o.kmsKey)
+	}
+}
+
+// setCopy sets the options on the destination of a copy.
+func (o storageOptions) setCopy(input *s3.CreateMultipartUploadInput) {
+	if o.class != "" {
+		input.StorageClass = aws.String(o.class)
+	}
+	if o.encryption != "" {
+		input.ServerSideEncryption = aws.String(o.encryption)
+	}
+	if o.kmsKey != "" {
+		input.SSEKMSKeyId = aws.String(o.kmsKey)
+	}
+}
+
+// verifiable reports whether the ETags of objects written with the options
+// are checksums of their bytes. SSE-KMS ETags aren't.
+func (o storageOptions) verifiable() bool {
+	return o.encryption != s3.ServerSideEncryptionAwsKms
+}
+
+// dbCreateStorageTable creates the table of the storage classes of archived
+// versions, if not present.
+func dbCreateStorageTable(ctx *context) {
+	query := "CREATE TABLE IF NOT EXISTS archive_storage (" +
+		"PathName VARCHAR(500) NOT NULL, " +
+		"VersionNum INT NOT NULL, " +
+		"StorageClass VARCHAR(40) NOT NULL, " +
+		"DateArchived DATETIME NOT NULL, " +
+		"PRIMARY KEY (PathName, VersionNum));"
+	if _, err := ctx.db.Exec(dbCreateQuery(ctx, query)); err != nil {
+		log.Print(err)
+		log.Fatal("Failed to find or create archive storage table.")
+	}
+}
+
+// transitionStage moves archived versions to colder storage classes as they
+// age. Archived versions on versioned buckets are noncurrent versions, which
+// only bucket lifecycle rules can move. Returns the number of versions that
+// failed.
+func transitionStage(ctx *context) int {
+	failed := 0
+	for _, folder := range ctx.syncFolders {
+		if len(folder.storage.transitions) == 0 {
+			continue
+		}
+		if ctx.src.versioning {
+			log.Printf("Skipping storage transitions of %s. Use a "+
+				"NoncurrentVersionTransition rule on versioned buckets.",
+				folder.sourcePath)
+			continue
+		}
+		entries, err := dbEntries(ctx, folder.sourcePath)
+		if err != nil {
+			errOut("Error in getting entries of "+folder.sourcePath, err)
+			failed++
+			continue
+		}
+		for _, e := range entries {
+			if e.archiveKey == "" || folderOf(ctx,
+				e.pathName).sourcePath != folder.sourcePath {
+				continue
+			}
+			if stopping() || leaseLost(ctx) {
+				return failed
+			}
+			if err = transitionVersion(ctx, folder.storage, e); err != nil {
+				errOut("Error in moving "+e.pathName+" to colder storage", err)
+				failed++
+			}
+		}
+	}
+	return failed
+}
+
+// transitionVersion moves an archived version to the class for its age by
+// copying it over itself. Versions already there or in a colder class are
+// left alone, as are versions in cold storage, which can't be copied.
+func transitionVersion(ctx *context, p storagePolicy, e entry) error {
+	class, archived, err := archiveState(ctx, e)
+	if err != nil {
+		return handle("Error in getting archive state.", err)
+	}
+	target := p.classFor(now().Sub(archived))
+	if target == "" || coldClasses[class] || p.rank(target) <= p.rank(class) {
+		return nil
+	}
+	key := resolveArchiveKey(ctx, e.archiveKey)
+	size := e.size
+	if size == 0 {
+		if size, err = fileSizeOnS3(ctx, key, ctx.svcS3); err != nil {
+			return handle("Error in getting archived size.", err)
+		}
+	}
+	log.Printf("Moving %s v%d from %s to %s.", e.pathName, e.versionNum,
+		class, target)
+	if _, err = copyObjectStored(ctx, key, key, size,
+		p.options(target)); err != nil {
+		return handle("Error in copying to "+target, err)
+	}
+	return dbSetArchiveClass(ctx, e, target)
+}
+
+// archiveState gets the storage class of an archived version and when it was
+// archived. Versions seen for the first time are looked up on S3 and
+// recorded, since copies for transitions change their modified times.
+func archiveState(ctx *context, e entry) (string, time.Time, error) {
+	var class, archived string
+	err := ctx.db.QueryRow("select StorageClass, DateArchived from "+
+		"archive_storage where PathName=? and VersionNum=?",
+		dbPathName(ctx, e.pathName), e.versionNum).Scan(&class, &archived)
+	if err == nil {
+		t, err := parseDbTime(archived)
+		return class, t, err
+	}
+	if err != sql.ErrNoRows {
+		return "", time.Time{}, handle("Error in querying archive storage.",
+			err)
+	}
+
+	head, err := ctx.svcS3.HeadObject(versionInput(ctx,
+		resolveArchiveKey(ctx, e.archiveKey), ""))
+	if err != nil {
+		return "", time.Time{}, handle("Error in getting archived copy.", err)
+	}
+	class = storageClassOf(head)
+	t := aws.TimeValue(head.LastModified)
+	_, err = ctx.db.Exec("insert into archive_storage (PathName, VersionNum, "+
+		"StorageClass, DateArchived) values (?, ?, ?, ?);",
+		dbPathName(ctx, e.pathName), e.versionNum, class, dbTime(t))
+	if err != nil {
+		return "", time.Time{}, handle("Error in recording archive storage.",
+			err)
+	}
+	return class, t, err
+}
+
+// storageClassOf gets the storage class of an object. S3 leaves it out for
+// STANDARD.
+func storageClassOf(head *s3.HeadObjectOutput) string {
+	if head.StorageClass == nil {
+		return s3.StorageClassStandard
+	}
+	return *head.StorageClass
+}
+
+// dbSetArchiveClass records the storage class an archived version was moved
+// to.
+func dbSetArchiveClass(ctx *context, e entry, class string) error {
+	_, err := ctx.db.Exec("update archive_storage set StorageClass=? where "+
+		"PathName=? and VersionNum=?;", class, dbPathName(ctx, e.pathName),
+		e.versionNum)
+	if err != nil {
+		return handle("Error in updating archive storage.", err)
+	}
+	return err
+}
+
+// thawState gets the restore state of an object. Objects outside cold
+// storage are always available.
+func thawState(head *s3.HeadObjectOutput) string {
+	if !coldClasses[storageClassOf(head)] {
+		return restoreAvailable
+	}
+	// Ex: ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"
+	restore := aws.StringValue(head.Restore)
+	switch {
+	case strings.Contains(restore, `ongoing-request="false"`):
+		return restoreAvailable
+	case strings.Contains(restore, `ongoing-request="true"`):
+		return restorePending
+	}
+	return restoreCold
+}
+
+// thawObject makes an object in cold storage readable. Starts a restore if
+// none is in progress. Returns the restore state.
+func thawObject(ctx *context, key string, versionId string,
+	head *s3.HeadObjectOutput, opts thawOptions) (string, error) {
+	if state := thawState(head); state != restoreCold {
+		return state, nil
+	}
+	if opts.days < 1 {
+		opts.days = defaultRestoreDays
+	}
+	if opts.tier == "" {
+		opts.tier = defaultRestoreTier
+	}
+	input := &s3.RestoreObjectInput{
+		Bucket: aws.String(ctx.bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &s3.RestoreRequest{
+			Days: aws.Int64(int64(opts.days)),
+			GlacierJobParameters: &s3.GlacierJobParameters{
+				Tier: aws.String(opts.tier),
+			},
+		},
+	}
+	if versionId != "" {
+		input.VersionId = aws.String(versionId)
+	}
+	_, err := ctx.svcS3.RestoreObject(input)
+	if aerr, ok := err.(awserr.Error); ok &&
+		aerr.Code() == "RestoreAlreadyInProgress" {
+		return restorePending, nil
+	}
+	if err != nil {
+		return "", handle("Error in starting restore of "+key, err)
+	}
+	log.Printf("Started %s restore of %s for %d days.", opts.tier, key,
+		opts.days)
+	return restoreStarted, err
+}
+
+// A thawStatus represents the restore state of a stored file version. URL is
+// a short-lived download link once the version is readable.
+type thawStatus struct {
+	Path         string `json:"path"`
+	Version      int    `json:"version"`
+	Key          string `json:"key"`
+	StorageClass string `json:"storageClass"`
+	Status       string `json:"status"`
+	URL          string `json:"url,omitempty"`
+}
+
+// thawVersion gets the restore state of a file version, the latest if num is
+// 0. Starts a restore of a version in cold storage if start is set. Readable
+// versions get a download link.
+func thawVersion(ctx *context, file string, num int, start bool,
+	opts thawOptions) (thawStatus, error) {
+	if num < 1 {
+		num = lastVersionNum(ctx, file, true)
+	}
+	res := thawStatus{Path: file, Version: num}
+	if num < 1 {
+		return res, errors.New("no versions of " + file)
+	}
+	key, versionId, err := dbVersionLocation(ctx, file, num)
+	if err != nil {
+		return res, handle("Error in finding version.", err)
+	}
+	res.Key = key
+	head, err := ctx.svcS3.HeadObject(versionInput(ctx, key, versionId))
+	if err != nil {
+		return res, handle("Error in getting stored copy.", err)
+	}
+	res.StorageClass = storageClassOf(head)
+	res.Status = thawState(head)
+	if start {
+		if res.Status, err = thawObject(ctx, key, versionId, head,
+			opts); err != nil {
+			return res, err
+		}
+	}
+	if res.Status != restoreAvailable {
+		return res, nil
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(ctx.bucket),
+		Key:    aws.String(key),
+	}
+	if versionId != "" {
+		input.VersionId = aws.String(versionId)
+	}
+	req, _ := ctx.svcS3.GetObjectRequest(input)
+	if res.URL, err = req.Presign(thawLinkExpiry); err != nil {
+		return res, handle("Error in signing download link.", err)
+	}
+	return res, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/smallfish/simpleyaml"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoadStoragePolicy(t *testing.T) {
+	yml, _ := simpleyaml.NewYaml([]byte(`
+storage:
+  class: STANDARD
+  archiveClass: STANDARD_IA
+  encryption: sse-kms
+  kmsKey: alias/ncbi
+  transitions:
+    - after: 720h
+      class: GLACIER
+    - after: 4320h
+      class: DEEP_ARCHIVE
+`))
+	p := loadStoragePolicy(yml)
+	assert.Equal(t, "STANDARD", p.class)
+	assert.Equal(t, "STANDARD_IA", p.archiveClass)
+	assert.Equal(t, s3.ServerSideEncryptionAwsKms, p.encryption)
+	assert.Equal(t, "alias/ncbi", p.kmsKey)
+	assert.Equal(t, []transition{{720 * time.Hour, "GLACIER"}, {4320 * time.Hour, "DEEP_ARCHIVE"}}, p.transitions)
+	assert.Equal(t, storageOptions{"STANDARD_IA", s3.ServerSideEncryptionAwsKms, "alias/ncbi"}, p.archive())
+	assert.False(t, p.current().verifiable())
+
+	assert.Equal(t, "", p.classFor(24*time.Hour))
+	assert.Equal(t, "GLACIER", p.classFor(1000*time.Hour))
+	assert.Equal(t, "DEEP_ARCHIVE", p.classFor(5000*time.Hour))
+	assert.True(t, p.rank("DEEP_ARCHIVE") > p.rank("GLACIER"))
+	assert.True(t, p.rank("GLACIER") > p.rank("STANDARD_IA"))
+
+	yml, _ = simpleyaml.NewYaml([]byte("name: /pub\n"))
+	p = loadStoragePolicy(yml)
+	assert.Equal(t, storageOptions{}, p.current())
+	assert.True(t, p.current().verifiable())
+}
+
+func TestCopyObjectStored(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.bucket = "bucket"
+	expectCopyResponses(testServer, 1)
+	_, err := copyObjectStored(ctx, "pub/a", "archive/a", 0,
+		storageOptions{"STANDARD_IA", s3.ServerSideEncryptionAes256, ""})
+	assert.Nil(t, err)
+	reqs := testServer.WaitRequests(4)
+	assert.Equal(t, "STANDARD_IA", reqs[1].Header.Get("X-Amz-Storage-Class"))
+	assert.Equal(t, "AES256", reqs[1].Header.Get("X-Amz-Server-Side-Encryption"))
+}
+
+func TestTransitionVersion(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.bucket = "bucket"
+	clock := time.Date(2017, 9, 10, 0, 0, 0, 0, time.UTC)
+	tmp := now
+	now = func() time.Time { return clock }
+	defer func() { now = tmp }()
+	p := storagePolicy{archiveClass: "STANDARD_IA",
+		transitions: []transition{{720 * time.Hour, "GLACIER"}}}
+	e := entry{"/pub/a", 1, "2017-08-01 10:00:00", "archive/a", "", 10, "", ""}
+
+	// Too young to move.
+	mock.ExpectQuery("select StorageClass, DateArchived").WithArgs("/pub/a", 1).WillReturnRows(sqlmock.NewRows([]string{"StorageClass", "DateArchived"}).AddRow("STANDARD_IA", "2017-09-01 00:00:00"))
+	assert.Nil(t, transitionVersion(ctx, p, e))
+
+	// Seen for the first time and archived long ago.
+	mock.ExpectQuery("select StorageClass, DateArchived").WithArgs("/pub/a", 1).WillReturnRows(sqlmock.NewRows([]string{"StorageClass", "DateArchived"}))
+	testServer.Response(200, map[string]string{"Content-Length": "10", "x-amz-storage-class": "STANDARD_IA", "Last-Modified": "Tue, 01 Aug 2017 10:00:00 GMT"}, "")
+	mock.ExpectExec("insert into archive_storage").WithArgs("/pub/a", 1, "STANDARD_IA", "2017-08-01 10:00:00").WillReturnResult(testResult)
+	expectCopyResponses(testServer, 1)
+	mock.ExpectExec("update archive_storage set StorageClass").WithArgs("GLACIER", "/pub/a", 1).WillReturnResult(testResult)
+	assert.Nil(t, transitionVersion(ctx, p, e))
+	reqs := testServer.WaitRequests(5)
+	assert.Equal(t, "HEAD", reqs[0].Method)
+	assert.Equal(t, "GLACIER", reqs[2].Header.Get("X-Amz-Storage-Class"))
+	assert.Equal(t, "bucket/archive/a", reqs[3].Header.Get("X-Amz-Copy-Source"))
+
+	// Already moved.
+	mock.ExpectQuery("select StorageClass, DateArchived").WithArgs("/pub/a", 1).WillReturnRows(sqlmock.NewRows([]string{"StorageClass", "DateArchived"}).AddRow("GLACIER", "2017-08-01 10:00:00"))
+	assert.Nil(t, transitionVersion(ctx, p, e))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestThawObject(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.bucket = "bucket"
+	head := &s3.HeadObjectOutput{}
+	state, err := thawObject(ctx, "pub/a", "", head, thawOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, restoreAvailable, state)
+
+	head.StorageClass = aws.String(s3.StorageClassGlacier)
+	head.Restore = aws.String(`ongoing-request="true"`)
+	state, _ = thawObject(ctx, "pub/a", "", head, thawOptions{})
+	assert.Equal(t, restorePending, state)
+	head.Restore = aws.String(`ongoing-request="false", expiry-date="Fri, 15 Sep 2017 00:00:00 GMT"`)
+	state, _ = thawObject(ctx, "pub/a", "", head, thawOptions{})
+	assert.Equal(t, restoreAvailable, state)
+
+	// Starts a restore if none was requested.
+	head.Restore = nil
+	assert.Equal(t, restoreCold, thawState(head))
+	testServer.Response(202, nil, "")
+	state, err = thawObject(ctx, "archive/a", "v1", head, thawOptions{days: 3, tier: "Bulk"})
+	assert.Nil(t, err)
+	assert.Equal(t, restoreStarted, state)
+	req := testServer.WaitRequest()
+	assert.Equal(t, "POST", req.Method)
+	assert.Equal(t, "/bucket/archive/a", req.URL.Path)
+	assert.Equal(t, "v1", req.URL.Query().Get("versionId"))
+	assert.Contains(t, req.URL.RawQuery, "restore")
+}
+
+func TestRestoreFileCold(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.bucket = "bucket"
+	testServer.Response(200, map[string]string{"Content-Length": "5", "x-amz-storage-class": "GLACIER", "x-amz-restore": `ongoing-request="true"`}, "")
+	e := entry{"/blast/db/a", 2, "2017-08-03 10:00:00", "archive/a", "", 0, "", ""}
+	err := restoreFile(ctx, e, restoreTarget{dir: "/restore"}, true, thawOptions{})
+	assert.Equal(t, errThawing, err)
+	testServer.WaitRequest()
+}
+
+func TestHandleThaw(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.bucket = "bucket"
+	mock.ExpectQuery("select ArchiveKey, VersionId from entries").WithArgs("/pub/a", 2).WillReturnRows(sqlmock.NewRows([]string{"ArchiveKey", "VersionId"}).AddRow("archive/a", nil))
+	testServer.Response(200, map[string]string{"Content-Length": "5", "x-amz-storage-class": "DEEP_ARCHIVE"}, "")
+	testServer.Response(202, nil, "")
+	rec := httptest.NewRecorder()
+	apiHandler(ctx).ServeHTTP(rec, httptest.NewRequest("POST", "/thaw?path=/pub/a&version=2", nil))
+	assert.Equal(t, 202, rec.Code)
+	res := thawStatus{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, thawStatus{Path: "/pub/a", Version: 2, Key: "archive/a", StorageClass: "DEEP_ARCHIVE", Status: restoreStarted}, res)
+	testServer.WaitRequests(2)
+
+	// Readable versions get a download link.
+	mock.ExpectQuery("select ArchiveKey, VersionId from entries").WithArgs("/pub/a", 2).WillReturnRows(sqlmock.NewRows([]string{"ArchiveKey", "VersionId"}).AddRow("archive/a", nil))
+	testServer.Response(200, map[string]string{"Content-Length": "5"}, "")
+	rec = httptest.NewRecorder()
+	apiHandler(ctx).ServeHTTP(rec, httptest.NewRequest("GET", "/thaw?path=/pub/a&version=2", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, restoreAvailable, res.Status)
+	assert.Contains(t, res.URL, "/bucket/archive/a")
+	testServer.WaitRequest()
+
+	rec = httptest.NewRecorder()
+	apiHandler(ctx).ServeHTTP(rec, httptest.NewRequest("GET", "/thaw", nil))
+	assert.Equal(t, 400, rec.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
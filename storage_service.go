@@ -12,15 +12,49 @@ import (
 
 var fileSizeOnS3 = fileSizeOnS3Svc
 
-// putObject uploads one file from local disk to S3 with an uploadKey.
-func putObject(ctx *context, onDisk string, uploadKey string) error {
+// objectKey gets the S3 key for the current copy of a file, following the key
+// layout and destination prefixes of its folder.
+func objectKey(ctx *context, file string) string {
+	folder := folderOf(ctx, file)
+	key := renderLayout(layoutOf(folder).current, file, 0, "")
+	return folderKey(ctx, folder, key)
+}
+
+// withPrefix adds the source's destination prefix to an S3 key.
+func withPrefix(ctx *context, key string) string {
+	if ctx.src.prefix == "" {
+		return key
+	}
+	return ctx.src.prefix + "/" + key
+}
+
+// An uploadInfo represents details about an uploaded object that are
+// recorded with its version in the db.
+type uploadInfo struct {
+	versionId string // S3 VersionId if the bucket is versioned
+	size      int
+	md5       string // Hex checksums, if computed during the transfer
+	sha256    string
+}
+
+// putObject uploads one file from local disk to S3 with an uploadKey and
+// storage options. The checksums of the file are sent with the upload and
+// checked against the returned ETag.
+func putObject(ctx *context, onDisk string, uploadKey string,
+	opts storageOptions) (uploadInfo, error) {
 	// Setup
+	info := uploadInfo{}
 	sess := session.Must(session.NewSession())
 	// Ex: $HOME/temp/blast/db/README
 	log.Print("File upload. Source: " + onDisk)
+	sums, err := hashFile(ctx, onDisk)
+	if err != nil {
+		return info, handle("Error in computing checksums.", err)
+	}
+	sums.setInfo(&info)
 	local, err := ctx.os.Open(onDisk)
 	if err != nil {
-		return handle("Error in opening file on disk.", err)
+		return info, handle("Error in opening file on disk.", err)
 	}
 	defer func() {
 		if err = local.Close(); err != nil {
@@ -29,39 +63,39 @@ func putObject(ctx *context, onDisk string, uploadKey string) error {
 	}()
 
 	// Upload to S3
-	uploader := s3manager.NewUploader(sess)
-	output, err := uploader.Upload(&s3manager.UploadInput{
-		Body:   local,
+	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		u.PartSize = int64(sums.partSize)
+	})
+	input := &s3manager.UploadInput{
+		Body:   throttle(ctx, local, true),
 		Bucket: aws.String(ctx.bucket),
 		Key:    aws.String(uploadKey),
-	})
+	}
+	setChecksumHeaders(input, info, sums.partSize)
+	opts.setUpload(input)
+	output, err := uploader.Upload(input)
 	awsOutput(fmt.Sprintf("%#v", output))
 	if err != nil && !strings.Contains(err.Error(),
 		"IllegalLocationConstraintException") {
-		return handle(fmt.Sprintf("Error in file upload of %s to S3.", onDisk), err)
+		return info, handle(fmt.Sprintf("Error in file upload of %s to S3.",
+			onDisk), err)
+	}
+	if output != nil && output.VersionID != nil {
+		info.versionId = *output.VersionID
+	}
+	if output != nil && opts.verifiable() {
+		if err = sums.verify(output.ETag); err != nil {
+			errOut("Error in removing corrupted upload",
+				discardUpload(ctx, uploadKey, info.versionId))
+			return info, handle("Uploaded copy doesn't match "+onDisk, err)
+		}
 	}
 
 	// Remove file locally after upload finished
 	if err = ctx.os.Remove(onDisk); err != nil {
-		return handle("Error in deleting temporary file on local disk.", err)
+		return info, handle("Error in deleting temporary file on local disk.", err)
 	}
-	return err
-}
-
-// copyOnS3 copies a file on S3 from its current location to the archive folder
-// under a new key.
-func copyOnS3(ctx *context, file string, key string, svc *s3.S3) error {
-	params := &s3.CopyObjectInput{
-		Bucket:     aws.String(ctx.bucket),
-		CopySource: aws.String(ctx.bucket + file),
-		Key:        aws.String("archive/" + key),
-	}
-	output, err := svc.CopyObject(params)
-	awsOutput(output.GoString())
-	if err != nil {
-		return handle(fmt.Sprintf("Error in copying %s on S3.", file), err)
-	}
-	return err
+	return info, err
 }
 
 // fileSizeOnS3Svc gets the size of a file on S3.
@@ -99,36 +133,24 @@ func deleteObject(ctx *context, file string) error {
 	return err
 }
 
-// moveObject moves the to-be-archived file on S3 to the archive folder under
-// a new file key.
+// moveObject copies the to-be-archived file on S3 to its archive key, in the
+// archive storage class of its folder. The current copy is deleted
+// separately.
 func moveObject(ctx *context, file string, key string) error {
 	// Move to archive folder
 	svc := ctx.svcS3
 	// Ex: bucket/remote/blast/db/README
-	log.Print("Copy from: " + ctx.bucket + file)
-	log.Print("Copy-to key: " + "archive/" + key)
+	log.Print("Copy from: " + ctx.bucket + "/" + objectKey(ctx, file))
+	log.Print("Copy-to key: " + key)
 
 	// Get file size
-	size, err := fileSizeOnS3(ctx, file, svc)
+	size, err := fileSizeOnS3(ctx, objectKey(ctx, file), svc)
 	if err != nil {
 		return handle("Error in getting file size on S3.", err)
 	}
-
-	if size < 4500000000 {
-		// Handle via S3 SDK
-		err = copyOnS3(ctx, file, key, svc)
-		if err != nil {
-			errOut("Error in copying file on S3.", err)
-		}
-	} else {
-		log.Print("Large file handling...")
-		// Handle via S3 command line tool
-		template := "aws s3 mv s3://%s%s s3://%s/archive/%s"
-		cmd := fmt.Sprintf(template, ctx.bucket, file, ctx.bucket, key)
-		_, _, err = commandVerbose(cmd)
-		if err != nil {
-			errOut("Error in moving file on S3 via CLI.", err)
-		}
+	if _, err = copyObjectStored(ctx, objectKey(ctx, file), key, size,
+		policyFor(ctx, file).archive()); err != nil {
+		return handle("Error in copying file on S3.", err)
 	}
 	return err
 }
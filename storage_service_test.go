@@ -1,7 +1,19 @@
 package main
 
-import "github.com/aws/aws-sdk-go/service/s3"
+import (
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
 
 func FakeFileSizeOnS3(ctx *context, file string, svc *s3.S3) (int, error) {
 	return 5000000000, nil
 }
+
+func TestObjectKey(t *testing.T) {
+	_, ctx := testSetup(t)
+	assert.Equal(t, "blast/db/README", objectKey(ctx, "/blast/db/README"))
+	ctx.src.prefix = "mirror"
+	assert.Equal(t, "mirror/blast/db/README", objectKey(ctx, "/blast/db/README"))
+	assert.Equal(t, "/mirror/blast/db/README", dbPathName(ctx, "/blast/db/README"))
+}
@@ -1,16 +1,19 @@
 package main
 
 import (
+	"fmt"
 	"github.com/jasonlvhit/gocron"
 	"log"
+	"sync"
 	"time"
 )
 
 var callSyncFlow = callSyncFlowRepeat
 
-// callSyncFlowRepeat calls the Rsync workflow. Executes a dry run first for
-// identifying changes. Then runs the actual file sync operations. Finally
-// updates the db with changes. Gocron schedules repeating runs.
+// callSyncFlowRepeat calls the Rsync workflow for each source. Executes a dry
+// run first for identifying changes. Then runs the actual file sync
+// operations. Finally updates the db with changes. Gocron schedules repeating
+// runs.
 func callSyncFlowRepeat(ctx *context, repeat bool) error {
 	log.Print("Start of sync flow...")
 	var err error
@@ -24,7 +27,7 @@ func callSyncFlowRepeat(ctx *context, repeat bool) error {
 	// finishes.
 	gocron.Clear()
 	defer func() {
-		if !repeat {
+		if !repeat || stopping() {
 			return
 		}
 		gocron.Every(12).Hours().Do(callSyncFlowRepeat, ctx, true)
@@ -32,26 +35,315 @@ func callSyncFlowRepeat(ctx *context, repeat bool) error {
 		<-gocron.Start()
 	}()
 
-	// Dry run analysis stage for identifying file changes.
-	toSync, err := dryRunStage(ctx)
-	if err != nil {
-		// If listing from NCBI fails, wait some time and try again. Gocron
-		// scheduling will still be in effect.
+	// Sources are synced one after another. A failing source doesn't stop
+	// the others.
+	var failed error
+	for _, src := range syncSources(ctx) {
+		if stopping() {
+			return errInterrupted
+		}
+		if err = syncSource(ctx, src); err != nil {
+			failed = err
+		}
+	}
+	if failed == errInterrupted {
+		return failed
+	}
+	if failed != nil {
+		// If a source fails, wait some time and try again. Gocron scheduling
+		// will still be in effect. The error names the stage that failed.
 		defer func() {
 			time.Sleep(5 * time.Minute)
-			callSyncFlowRepeat(ctx, false)
+			if !stopping() {
+				callSyncFlowRepeat(ctx, false)
+			}
 		}()
-		return handle("Error in dry run stage.", err)
+		return handle("Error in syncing sources.", failed)
 	}
 
-	// File operation stage. Moving actual files around.
-	fileOperationStage(ctx, toSync)
-
 	log.Print("Finished processing changes.")
 	log.Print("End of sync flow...")
 	return err
 }
 
+// syncSources gets the sources to sync. Falls back to a single source from
+// the top-level settings if none are configured.
+func syncSources(ctx *context) []source {
+	if len(ctx.sources) > 0 {
+		return ctx.sources
+	}
+	return []source{defaultSource(ctx)}
+}
+
+// syncSource runs the dry run and file operation stages for one source and
+// records its stats. Runs hold a lease on the source and on each folder so
+// that only one instance syncs them at a time. A run stopped by a shutdown or
+// a lost lease is recorded as interrupted with the files it started.
+func syncSource(ctx *context, src source) error {
+	log.Printf("Syncing source %s from %s...", src.name, src.server)
+	stats := statsFor(ctx, src.name)
+	start := stats.start()
+	srcCtx := sourceContext(ctx, src)
+	srcCtx.runId = runIdOf(src.name, start)
+	if !beginRun(srcCtx) {
+		stats.fail(errInterrupted)
+		return errInterrupted
+	}
+	defer endRun(srcCtx)
+	runLease, holder, err := acquireLease(srcCtx, runLeaseName(src.name))
+	if runLease == nil {
+		if err != nil {
+			stats.fail(err)
+			return handle("Error in taking lease on source "+src.name, err)
+		}
+		log.Printf("Source %s is being synced by %s. Skipping run.",
+			src.name, holder)
+		stats.fail(fmt.Errorf("source is being synced by %s", holder))
+		return nil
+	}
+	srcCtx.leases = []*lease{runLease}
+	defer releaseLeases(srcCtx)
+	if err = dbStartRun(srcCtx, start); err != nil {
+		errOut("Error in recording run", err)
+	}
+	if src.versioning {
+		if err = checkBucketVersioning(srcCtx); err != nil {
+			end := stats.fail(err)
+			errOut("Error in recording run", dbFinishRun(srcCtx, end,
+				runFailed, syncResult{}, 0))
+			return handle("Error in checking bucket versioning for source "+
+				src.name, err)
+		}
+	}
+
+	// Dry run analysis stage for identifying file changes.
+	toSync, err := dryRunStage(srcCtx)
+	if err != nil {
+		end := stats.fail(err)
+		errOut("Error in recording run", dbFinishRun(srcCtx, end,
+			runFailed, syncResult{}, 0))
+		msg := fmt.Sprintf("Error in dry run stage for source %s.", src.name)
+		return handle(msg, err)
+	}
+	if stopping() || leaseLost(srcCtx) {
+		return interruptRun(srcCtx, syncResult{}, 0)
+	}
+	toSync = lockFolders(srcCtx, toSync)
+
+	// Check that downloads fit on the staging volume.
+	toSync, plan := preflightStaging(srcCtx, toSync)
+	stats.mutex.Lock()
+	stats.stagingPlanned = plan.planned
+	stats.stagingFree = plan.free
+	stats.skipped += len(plan.skipped)
+	stats.mutex.Unlock()
+	setRunChanges(srcCtx, toSync, false)
+
+	// File operation stage. Moving actual files around.
+	stats.setStage(stageFiles, len(toSync.newF)+len(toSync.modified))
+	failed := fileOperationStage(srcCtx, toSync)
+	interrupted := stopping() || leaseLost(srcCtx)
+	if interrupted {
+		toSync = attempted(toSync, stats.started())
+	}
+	setRunChanges(srcCtx, toSync, true)
+	if hooksFailed := hookStage(srcCtx, toSync); hooksFailed > 0 {
+		log.Printf("%d onChange hooks failed.", hooksFailed)
+	}
+	if interrupted {
+		return interruptRun(srcCtx, toSync, failed)
+	}
+
+	stats.setStage(stageDerive, 0)
+	deriveStage(srcCtx, append(toSync.newF, toSync.modified...))
+	if failedMoves := transitionStage(srcCtx); failedMoves > 0 {
+		log.Printf("%d archived versions failed to move to colder storage.",
+			failedMoves)
+	}
+	end := stats.finish(srcCtx, toSync, failed)
+	errOut("Error in recording run", dbFinishRun(srcCtx, end, runDone,
+		toSync, failed))
+	if src.manifests != "" {
+		if err = writeRunManifests(srcCtx, end); err != nil {
+			errOut("Error in writing run manifests", err)
+		}
+	}
+	if src.snapshots && failed == 0 {
+		name := autoSnapshotName(srcCtx, end)
+		if _, err = createSnapshot(srcCtx, name, nil); err != nil {
+			errOut("Error in taking snapshot after run", err)
+		}
+	}
+	log.Printf("Source %s: %d new, %d modified, %d deleted, %d failed, "+
+		"%d skipped in %s.", src.name, len(toSync.newF), len(toSync.modified),
+		len(toSync.deleted), failed, len(plan.skipped), end.Sub(start))
+	return nil
+}
+
+// interruptRun records the current run as interrupted by a shutdown or a lost
+// lease with the changes it handled.
+func interruptRun(ctx *context, res syncResult, failed int) error {
+	end := statsFor(ctx, ctx.src.name).fail(errInterrupted)
+	errOut("Error in recording run", dbFinishRun(ctx, end, runInterrupted,
+		res, failed))
+	log.Printf("Source %s interrupted after %d new and %d modified files.",
+		ctx.src.name, len(res.newF), len(res.modified))
+	return errInterrupted
+}
+
+// sourceContext returns a copy of the context set up to sync one source.
+// Connections and stats are shared with the parent context.
+func sourceContext(ctx *context, src source) *context {
+	res := *ctx
+	res.src = src
+	res.server = src.server
+	res.bucket = src.bucket
+	res.syncFolders = src.syncFolders
+	return &res
+}
+
+// statsMutex guards the stats map, which the API reads during runs.
+var statsMutex sync.Mutex
+
+// statsFor gets the stats of a source, creating them on first use.
+func statsFor(ctx *context, name string) *sourceStats {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	if ctx.stats == nil {
+		ctx.stats = make(map[string]*sourceStats)
+	}
+	if _, present := ctx.stats[name]; !present {
+		ctx.stats[name] = &sourceStats{}
+	}
+	return ctx.stats[name]
+}
+
+// A sourceStats represents totals and the latest run times for one source.
+// Staging fields are the bytes planned for download and the bytes free on the
+// staging volume in the latest run. Progress fields describe the run in
+// progress. The mutex guards every field, since the API reads them during
+// runs.
+type sourceStats struct {
+	mutex          sync.Mutex
+	runs           int
+	newF           int
+	modified       int
+	deleted        int
+	failed         int
+	skipped        int
+	stagingPlanned int
+	stagingFree    int
+	lastStart      time.Time
+	lastEnd        time.Time
+	lastSuccess    time.Time
+	lastErr        error
+	running        bool
+	stage          string
+	current        int // Files started in the stage
+	total          int // Files in the stage
+	lastProgress   time.Time
+	failedFolders  map[string]bool      // Folders with failed files this run
+	folderSuccess  map[string]time.Time // Last run of each folder without failures
+}
+
+// Stages of a run reported by the API.
+const (
+	stageDryRun = "dry run"
+	stageFiles  = "file operations"
+	stageDerive = "derive"
+)
+
+// start records the start of a run. Returns the start time.
+func (s *sourceStats) start() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.runs++
+	s.lastStart = time.Now()
+	s.running = true
+	s.stage, s.current, s.total = stageDryRun, 0, 0
+	s.lastProgress = s.lastStart
+	s.failedFolders = make(map[string]bool)
+	return s.lastStart
+}
+
+// setStage records the stage a run is in and how many files it has.
+func (s *sourceStats) setStage(stage string, total int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stage, s.current, s.total = stage, 0, total
+	s.lastProgress = time.Now()
+}
+
+// advance records that the run started on another file.
+func (s *sourceStats) advance() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.current++
+	s.lastProgress = time.Now()
+}
+
+// started gets the number of files started in the stage.
+func (s *sourceStats) started() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.current
+}
+
+// fileFailed records the folder of a file that failed in the run.
+func (s *sourceStats) fileFailed(folder string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failedFolders == nil {
+		s.failedFolders = make(map[string]bool)
+	}
+	s.failedFolders[folder] = true
+}
+
+// fail records a run that stopped with an error. Returns the end time.
+func (s *sourceStats) fail(err error) time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastErr = err
+	s.lastEnd = time.Now()
+	s.running, s.stage = false, ""
+	return s.lastEnd
+}
+
+// finish records a completed run and its totals. Folders without failed
+// files count as successfully synced. Returns the end time.
+func (s *sourceStats) finish(ctx *context, res syncResult, failed int) time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastEnd = time.Now()
+	s.lastErr = nil
+	s.lastSuccess = s.lastEnd
+	s.newF += len(res.newF)
+	s.modified += len(res.modified)
+	s.deleted += len(res.deleted)
+	s.failed += failed
+	s.running, s.stage = false, ""
+	if s.folderSuccess == nil {
+		s.folderSuccess = make(map[string]time.Time)
+	}
+	for _, folder := range ctx.syncFolders {
+		if !s.failedFolders[folder.sourcePath] {
+			s.folderSuccess[folder.sourcePath] = s.lastEnd
+		}
+	}
+	return s.lastEnd
+}
+
+// trackFile records that the operations of a file started, for progress
+// reports.
+func trackFile(ctx *context) {
+	statsFor(ctx, ctx.src.name).advance()
+}
+
+// trackFailure records that a file failed in the current run.
+func trackFailure(ctx *context, file string) {
+	statsFor(ctx, ctx.src.name).fileFailed(folderOf(ctx, file).sourcePath)
+}
+
 // An fInfo represents file path name, modified time, and size in bytes.
 type fInfo struct {
 	name    string
@@ -59,9 +351,12 @@ type fInfo struct {
 	size    int
 }
 
-// A syncResult represents lists of new, modified, and deleted files.
+// A syncResult represents lists of new, modified, and deleted files, and the
+// remote sizes in bytes of the files to download.
 type syncResult struct {
 	newF     []string
 	modified []string
 	deleted  []string
+	sizes    map[string]int
+	filtered map[string]filterDecision // Rules that kept or dropped files
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
 	"testing"
 )
 
@@ -26,13 +27,53 @@ func TestCallSyncFlow(t *testing.T) {
 	for _, v := range []string{"lemon", "lime"} {
 		ctx.os.Create(v)
 	}
-	mock.ExpectExec("insert into entries").WithArgs("lemon", 3).WillReturnResult(testResult)
-	mock.ExpectExec("update entries").WithArgs("03dbc4e3e7436484db322c0efaffe23d", "lime", 2).WillReturnResult(testResult)
-	mock.ExpectExec("insert into entries").WithArgs("lime", 3).WillReturnResult(testResult)
-	mock.ExpectExec("update entries").WithArgs("705c18ec390c3520692680d24d6f8d78", "mango", 2).WillReturnResult(testResult)
+	mock.ExpectExec("update leases set Holder").WithArgs(instanceId, sqlmock.AnyArg(), "run:default", instanceId, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("insert into sync_runs").WithArgs(sqlmock.AnyArg(), "default", sqlmock.AnyArg(), runRunning).WillReturnResult(testResult)
+	mock.ExpectExec("update leases set Holder").WithArgs(instanceId, sqlmock.AnyArg(), sqlmock.AnyArg(), instanceId, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("insert into entries").WithArgs("lemon", 3, nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(testResult)
+	mock.ExpectExec("update entries").WithArgs("archive/03dbc4e3e7436484db322c0efaffe23d", "lime", 2).WillReturnResult(testResult)
+	mock.ExpectExec("insert into entries").WithArgs("lime", 3, nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(testResult)
+	mock.ExpectExec("update entries").WithArgs("archive/705c18ec390c3520692680d24d6f8d78", "mango", 2).WillReturnResult(testResult)
+	mock.ExpectExec("update sync_runs set DateEnded").WithArgs(sqlmock.AnyArg(), runDone, 1, 2, 0, 0, sqlmock.AnyArg()).WillReturnResult(testResult)
+	mock.ExpectExec("delete from leases").WithArgs("run:default", instanceId).WillReturnResult(testResult)
+	mock.ExpectExec("delete from leases").WithArgs(sqlmock.AnyArg(), instanceId).WillReturnResult(testResult)
 
 	// Call
 	callSyncFlow(ctx, false)
 	testServer.WaitRequest()
 	assert.Nil(t, mock.ExpectationsWereMet())
 }
+
+func TestSyncSourcesDefault(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.server = "ftp.ncbi.nih.gov"
+	ctx.bucket = "czbiohub-ncbi-store"
+	ctx.syncFolders = []syncFolder{{sourcePath: "/blast/db"}}
+	ctx.src.protocol = "https"
+	ctx.src.limits.window = &timeWindow{start: 20 * 60, end: 6 * 60}
+	res := syncSources(ctx)
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, "default", res[0].name)
+	assert.Equal(t, ctx.syncFolders, res[0].syncFolders)
+	assert.Equal(t, "https", res[0].protocol)
+	assert.Equal(t, ctx.src.limits.window, res[0].limits.window)
+}
+
+func TestSourceContext(t *testing.T) {
+	_, ctx := testSetup(t)
+	src := source{
+		name:        "ebi",
+		server:      "ftp.ebi.ac.uk",
+		bucket:      "czbiohub-ebi-store",
+		prefix:      "mirror",
+		syncFolders: []syncFolder{{sourcePath: "/pub/taxonomy"}},
+	}
+	statsFor(ctx, "ebi").runs++
+	res := sourceContext(ctx, src)
+	assert.Equal(t, "ftp.ebi.ac.uk", res.server)
+	assert.Equal(t, "czbiohub-ebi-store", res.bucket)
+	assert.Equal(t, "/pub/taxonomy", res.syncFolders[0].sourcePath)
+	assert.Equal(t, ctx.db, res.db)
+	assert.Empty(t, ctx.server)
+	assert.Equal(t, 1, statsFor(res, "ebi").runs)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"github.com/smallfish/simpleyaml"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clock functions. Replaced in tests.
+var sleep = time.Sleep
+var now = time.Now
+
+// A transferLimits represents bandwidth caps in bytes per second and an
+// allowed time window for transfers. Nil limiters and windows mean no limit.
+// Limiters are shared by every transfer they apply to.
+type transferLimits struct {
+	download *rateLimiter
+	upload   *rateLimiter
+	window   *timeWindow
+}
+
+// A rateLimiter spaces out reads so that they average a number of bytes per
+// second.
+type rateLimiter struct {
+	rate  int
+	mutex sync.Mutex
+	next  time.Time
+}
+
+// A timeWindow represents a daily period in UTC, as minutes after midnight.
+// The end may be before the start for windows that span midnight.
+type timeWindow struct {
+	start int
+	end   int
+}
+
+// loadLimits loads the optional bandwidth settings of the config or of a
+// source. Rates are in bytes per second and windows are in UTC.
+// Ex: bandwidth: {download: 10M, upload: 512K, window: 20:00-06:00}
+func loadLimits(yml *simpleyaml.Yaml) transferLimits {
+	res := transferLimits{}
+	item := yml.Get("bandwidth")
+	if !item.IsFound() {
+		return res
+	}
+	res.download = loadRate(item, "download")
+	res.upload = loadRate(item, "upload")
+	if str := optionalString(item, "window", ""); str != "" {
+		window, err := parseWindow(str)
+		if err != nil {
+			log.Fatal("Error in loading transfer window. ", err)
+		}
+		res.window = &window
+	}
+	return res
+}
+
+// loadRate loads an optional bandwidth cap. Returns nil if not set.
+func loadRate(yml *simpleyaml.Yaml, key string) *rateLimiter {
+	str := optionalString(yml, key, "")
+	if str == "" {
+		return nil
+	}
+	rate, err := parseRate(str)
+	if err != nil {
+		log.Fatal("Error in loading bandwidth "+key+" rate. ", err)
+	}
+	return &rateLimiter{rate: rate}
+}
+
+// parseRate parses a rate in bytes per second with an optional K, M, or G
+// suffix. Ex: 512K, 10M
+func parseRate(str string) (int, error) {
+	str = strings.ToUpper(strings.TrimSpace(str))
+	unit := 1
+	switch {
+	case strings.HasSuffix(str, "K"):
+		unit = 1024
+	case strings.HasSuffix(str, "M"):
+		unit = 1024 * 1024
+	case strings.HasSuffix(str, "G"):
+		unit = 1024 * 1024 * 1024
+	}
+	if unit > 1 {
+		str = str[:len(str)-1]
+	}
+	num, err := strconv.Atoi(str)
+	if err != nil || num < 1 {
+		return 0, fmt.Errorf("invalid rate %q", str)
+	}
+	return num * unit, nil
+}
+
+// parseWindow parses a daily UTC time window. Ex: 20:00-06:00
+func parseWindow(str string) (timeWindow, error) {
+	res := timeWindow{}
+	parts := strings.Split(strings.TrimSpace(str), "-")
+	if len(parts) != 2 {
+		return res, fmt.Errorf("invalid window %q", str)
+	}
+	var err error
+	if res.start, err = parseClock(parts[0]); err != nil {
+		return res, err
+	}
+	if res.end, err = parseClock(parts[1]); err != nil {
+		return res, err
+	}
+	if res.start == res.end {
+		return res, fmt.Errorf("empty window %q", str)
+	}
+	return res, err
+}
+
+// parseClock parses a time of day as minutes after midnight. Ex: 06:30
+func parseClock(str string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(str))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", str)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether a time is inside the window.
+func (w *timeWindow) contains(t time.Time) bool {
+	t = t.UTC()
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.start <= m && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// untilOpen gets the time until the window next opens.
+func (w *timeWindow) untilOpen(t time.Time) time.Duration {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	open := midnight.Add(time.Duration(w.start) * time.Minute)
+	if !open.After(t) {
+		open = open.Add(24 * time.Hour)
+	}
+	return open.Sub(t)
+}
+
+// reserve records n bytes transferred. Returns how long to wait before the
+// transfer keeps to the limiter's rate.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	cur := now()
+	if l.next.Before(cur) {
+		l.next = cur
+	}
+	l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(l.rate))
+	return l.next.Sub(cur)
+}
+
+// windows gets the time windows that apply to the current source.
+func windows(ctx *context) []*timeWindow {
+	res := []*timeWindow{}
+	for _, w := range []*timeWindow{ctx.limits.window, ctx.src.limits.window} {
+		if w != nil {
+			res = append(res, w)
+		}
+	}
+	return res
+}
+
+// waitForWindow blocks until transfers are allowed by the global and source
+// time windows. Called between files, so a file that has started finishes
+// even if a window closes.
+func waitForWindow(ctx *context) {
+	for _, w := range windows(ctx) {
+		if !w.contains(now()) {
+			delay := w.untilOpen(now())
+			log.Printf("Outside transfer window. Pausing for %s.", delay)
+			sleep(delay)
+			waitForWindow(ctx) // Recheck the other windows.
+			return
+		}
+	}
+}
+
+// limiters gets the global and source rate limiters for one direction.
+func limiters(ctx *context, upload bool) []*rateLimiter {
+	all := []*rateLimiter{ctx.limits.download, ctx.src.limits.download}
+	if upload {
+		all = []*rateLimiter{ctx.limits.upload, ctx.src.limits.upload}
+	}
+	res := []*rateLimiter{}
+	for _, l := range all {
+		if l != nil {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// downloadRate gets the lowest download rate that applies to the current
+// source, or 0 if unlimited. Used for external download tools.
+func downloadRate(ctx *context) int {
+	rate := 0
+	for _, l := range limiters(ctx, false) {
+		if rate == 0 || l.rate < rate {
+			rate = l.rate
+		}
+	}
+	return rate
+}
+
+// throttle wraps a reader so that reads follow the bandwidth caps of the
+// current source. Time windows are checked between files instead, since a
+// connection paused for hours would time out.
+func throttle(ctx *context, r io.Reader, upload bool) io.Reader {
+	l := limiters(ctx, upload)
+	if len(l) == 0 {
+		return r
+	}
+	return &throttledReader{r, l}
+}
+
+// A throttledReader represents a reader limited by rate limiters.
+type throttledReader struct {
+	r        io.Reader
+	limiters []*rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Read in small chunks so the rate stays smooth.
+	for _, l := range t.limiters {
+		if chunk := l.rate/4 + 1; len(p) > chunk {
+			p = p[:chunk]
+		}
+	}
+	n, err := t.r.Read(p)
+	// Wait for the slowest limiter.
+	delay := time.Duration(0)
+	for _, l := range t.limiters {
+		if d := l.reserve(n); d > delay {
+			delay = d
+		}
+	}
+	if delay > 0 {
+		sleep(delay)
+	}
+	return n, err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"github.com/smallfish/simpleyaml"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	rate, err := parseRate("512K")
+	assert.Nil(t, err)
+	assert.Equal(t, 512*1024, rate)
+	rate, err = parseRate("10m")
+	assert.Nil(t, err)
+	assert.Equal(t, 10*1024*1024, rate)
+	rate, err = parseRate("1000")
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, rate)
+	_, err = parseRate("fast")
+	assert.NotNil(t, err)
+}
+
+func TestTimeWindow(t *testing.T) {
+	w, err := parseWindow("20:00-06:00")
+	assert.Nil(t, err)
+	at := func(h, m int) time.Time {
+		return time.Date(2017, 8, 4, h, m, 0, 0, time.UTC)
+	}
+	assert.True(t, w.contains(at(23, 0)))
+	assert.True(t, w.contains(at(5, 59)))
+	assert.False(t, w.contains(at(6, 0)))
+	assert.False(t, w.contains(at(12, 0)))
+	assert.Equal(t, 8*time.Hour, w.untilOpen(at(12, 0)))
+
+	w, _ = parseWindow("01:00-02:30")
+	assert.True(t, w.contains(at(2, 0)))
+	assert.False(t, w.contains(at(3, 0)))
+	assert.Equal(t, 22*time.Hour, w.untilOpen(at(3, 0)))
+
+	_, err = parseWindow("20:00")
+	assert.NotNil(t, err)
+	_, err = parseWindow("25:00-06:00")
+	assert.NotNil(t, err)
+}
+
+func TestLoadLimits(t *testing.T) {
+	yml, err := simpleyaml.NewYaml([]byte("bandwidth:\n  download: 1M\n" +
+		"  window: 20:00-06:00\n"))
+	assert.Nil(t, err)
+	res := loadLimits(yml)
+	assert.Equal(t, 1024*1024, res.download.rate)
+	assert.Nil(t, res.upload)
+	assert.Equal(t, 20*60, res.window.start)
+
+	yml, _ = simpleyaml.NewYaml([]byte("bucket: test\n"))
+	res = loadLimits(yml)
+	assert.Nil(t, res.download)
+	assert.Nil(t, res.window)
+}
+
+func TestThrottle(t *testing.T) {
+	_, ctx := testSetup(t)
+	clock := time.Date(2017, 8, 4, 12, 0, 0, 0, time.UTC)
+	slept := time.Duration(0)
+	tmp, tmp2 := now, sleep
+	now = func() time.Time { return clock }
+	sleep = func(d time.Duration) {
+		slept += d
+		clock = clock.Add(d)
+	}
+	defer func() { now, sleep = tmp, tmp2 }()
+
+	// Global and source caps both apply.
+	ctx.limits.download = &rateLimiter{rate: 1000}
+	ctx.src.limits.download = &rateLimiter{rate: 500}
+	assert.Equal(t, 500, downloadRate(ctx))
+	data, err := ioutil.ReadAll(throttle(ctx, bytes.NewReader(make([]byte, 1000)),
+		false))
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(data))
+	assert.Equal(t, 2*time.Second, slept)
+
+	// Uploads aren't capped, and windows don't pause a transfer under way.
+	slept = 0
+	ctx.src.limits.window = &timeWindow{start: 20 * 60, end: 6 * 60}
+	data, err = ioutil.ReadAll(throttle(ctx, bytes.NewReader([]byte("abc")),
+		true))
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", string(data))
+	assert.Equal(t, time.Duration(0), slept)
+
+	// Files wait for the window to open before they start.
+	waitForWindow(ctx)
+	assert.True(t, slept > 7*time.Hour)
+	assert.True(t, ctx.src.limits.window.contains(now()))
+}
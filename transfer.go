@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/jlaffaye/ftp"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var openRemote = openRemoteStream
+
+// transferFile copies one file from the remote server to a key on S3. In
+// streaming mode the download is piped straight into the upload. The file is
+// only staged on local disk if it can't be streamed or the streamed copy
+// can't be verified.
+func transferFile(ctx *context, file string, key string) (uploadInfo, error) {
+	if ctx.src.streaming {
+		info, err := streamObject(ctx, file, key)
+		if err == nil {
+			return info, err
+		}
+		errOut("Streaming failed. Falling back to local disk staging", err)
+	}
+	return diskTransfer(ctx, file, key)
+}
+
+// diskTransfer downloads a file to local disk and then uploads it to S3.
+func diskTransfer(ctx *context, file string, key string) (uploadInfo, error) {
+	if err := copyFileFromRemote(ctx, file); err != nil {
+		return uploadInfo{}, handle("Error in copying file from remote", err)
+	}
+	info, err := putObject(ctx, ctx.temp+file, key,
+		policyFor(ctx, file).current())
+	if err != nil {
+		return info, handle("Error in uploading file to S3", err)
+	}
+	return info, err
+}
+
+// streamObject downloads a file from the remote server and uploads it to S3
+// as it arrives. Checksums and size are computed along the way. Fails and
+// removes the upload if the size doesn't match what the remote reported or
+// the ETag doesn't match the bytes sent. Files of unknown size aren't
+// streamed, as they can't be checked and may not fit in the upload parts.
+func streamObject(ctx *context, file string, key string) (uploadInfo, error) {
+	info := uploadInfo{}
+	log.Print("Streaming upload. Source: " + file)
+	body, size, err := openRemote(ctx, file)
+	if err != nil {
+		return info, handle("Error in opening remote file.", err)
+	}
+	defer func() {
+		if err = body.Close(); err != nil {
+			errOut("Error in closing remote file", err)
+		}
+	}()
+	if size < 0 {
+		err = errors.New("remote didn't report the size of " + file)
+		return info, handle("Can't stream file of unknown size.", err)
+	}
+
+	sums := newChecksums(uploadPartSize(size))
+	// The bytes count against both the download and the upload caps.
+	reader := io.TeeReader(throttle(ctx, body, false), sums)
+	uploader := s3manager.NewUploaderWithClient(ctx.svcS3,
+		func(u *s3manager.Uploader) {
+			u.PartSize = int64(sums.partSize)
+		})
+	input := &s3manager.UploadInput{
+		Body:   throttle(ctx, reader, true),
+		Bucket: aws.String(ctx.bucket),
+		Key:    aws.String(key),
+	}
+	opts := policyFor(ctx, file).current()
+	opts.setUpload(input)
+	output, err := uploader.Upload(input)
+	awsOutput(fmt.Sprintf("%#v", output))
+	if err != nil {
+		return info, handle(fmt.Sprintf("Error in streaming %s to S3.", file),
+			err)
+	}
+	if output.VersionID != nil {
+		info.versionId = *output.VersionID
+	}
+	sums.setInfo(&info)
+
+	if info.size != size {
+		// Don't leave a truncated copy behind.
+		errOut("Error in removing incomplete upload",
+			discardUpload(ctx, key, info.versionId))
+		err = fmt.Errorf("streamed %d bytes but expected %d", info.size, size)
+		return info, handle("Streamed copy is incomplete.", err)
+	}
+	if !opts.verifiable() {
+		return info, err
+	}
+	if err = sums.verify(output.ETag); err != nil {
+		errOut("Error in removing corrupted upload",
+			discardUpload(ctx, key, info.versionId))
+		return info, handle("Streamed copy doesn't match the download.", err)
+	}
+	log.Printf("Streamed %d bytes. MD5: %s", info.size, info.md5)
+	return info, err
+}
+
+// openRemoteStream opens a download of a file from the current source using
+// its protocol. Returns the size reported by the remote, or -1 if unknown.
+func openRemoteStream(ctx *context, file string) (io.ReadCloser, int,
+	error) {
+	if ctx.src.protocol == "http" || ctx.src.protocol == "https" {
+		return openHTTPStream(ctx, file)
+	}
+	client, err := connectToServer(ctx)
+	if err != nil {
+		return nil, -1, handle("Error in connecting to FTP server.", err)
+	}
+	size, err := client.FileSize(file)
+	if err != nil {
+		errOut("Couldn't get size of "+file, err)
+		size = -1
+	}
+	resp, err := client.Retr(file)
+	if err != nil {
+		errOut("Error in quitting FTP connection", quitServer(client))
+		return nil, -1, handle("Error in retrieving file over FTP.", err)
+	}
+	return &ftpStream{resp, client}, int(size), err
+}
+
+// openHTTPStream opens a download of a file over HTTP(S).
+func openHTTPStream(ctx *context, file string) (io.ReadCloser, int, error) {
+	req, err := http.NewRequest("GET", remoteURL(ctx, file), nil)
+	if err != nil {
+		return nil, -1, handle("Error in making request.", err)
+	}
+	if ctx.src.username != "" {
+		req.SetBasicAuth(ctx.src.username, ctx.src.password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, -1, handle("Error in HTTP request.", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		errOut("Error in closing response", resp.Body.Close())
+		err = fmt.Errorf("status %s for %s", resp.Status, file)
+		return nil, -1, handle("Error in HTTP download.", err)
+	}
+	return resp.Body, int(resp.ContentLength), err
+}
+
+// An ftpStream represents a file download over FTP. Closing it also closes
+// the connection.
+type ftpStream struct {
+	resp   io.ReadCloser
+	client *ftp.ServerConn
+}
+
+func (s *ftpStream) Read(p []byte) (int, error) {
+	return s.resp.Read(p)
+}
+
+func (s *ftpStream) Close() error {
+	err := s.resp.Close()
+	if quitErr := quitServer(s.client); err == nil {
+		err = quitErr
+	}
+	return err
+}
+
+// isStreamable reports whether the current source's protocol supports
+// streaming downloads.
+func isStreamable(protocol string) bool {
+	switch strings.ToLower(protocol) {
+	case "", "ftp", "http", "https":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func FakeOpenRemote(ctx *context, file string) (io.ReadCloser, int, error) {
+	return ioutil.NopCloser(strings.NewReader("kiwi")), 4, nil
+}
+
+func FakeOpenRemoteShort(ctx *context, file string) (io.ReadCloser, int, error) {
+	return ioutil.NopCloser(strings.NewReader("kiw")), 4, nil
+}
+
+func TestStreamObject(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.bucket = "czbiohub-ncbi-store"
+	tmp := openRemote
+	openRemote = FakeOpenRemote
+	defer func() { openRemote = tmp }()
+
+	testServer.Response(200, map[string]string{"x-amz-version-id": "v1"}, "")
+	info, err := streamObject(ctx, "/pub/kiwi", "pub/kiwi")
+	assert.Nil(t, err)
+	req := testServer.WaitRequest()
+	assert.Equal(t, "PUT", req.Method)
+	assert.Equal(t, "/czbiohub-ncbi-store/pub/kiwi", req.URL.Path)
+	assert.Equal(t, 4, info.size)
+	assert.Equal(t, "v1", info.versionId)
+	assert.Equal(t, "de5949721e6352f01dfef317c3e898a8", info.md5)
+	assert.Equal(t, "1a5afeda973d776e31d1d7266f184468f84d99bed311d88d3dcb67015934f9f9", info.sha256)
+}
+
+func TestStreamObjectIncomplete(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.bucket = "czbiohub-ncbi-store"
+	tmp := openRemote
+	openRemote = FakeOpenRemoteShort
+	defer func() { openRemote = tmp }()
+
+	testServer.Response(200, nil, "")
+	testServer.Response(204, nil, "")
+	_, err := streamObject(ctx, "/pub/kiwi", "pub/kiwi")
+	assert.NotNil(t, err)
+	reqs := testServer.WaitRequests(2)
+	assert.Equal(t, "DELETE", reqs[1].Method)
+}
+
+func TestStreamObjectUnknownSize(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.bucket = "czbiohub-ncbi-store"
+	tmp := openRemote
+	openRemote = func(ctx *context, file string) (io.ReadCloser, int, error) {
+		return ioutil.NopCloser(strings.NewReader("kiwi")), -1, nil
+	}
+	defer func() { openRemote = tmp }()
+
+	// Nothing is uploaded, so the file goes through local disk instead.
+	_, err := streamObject(ctx, "/pub/kiwi", "pub/kiwi")
+	assert.NotNil(t, err)
+}
+
+func TestIsStreamable(t *testing.T) {
+	assert.True(t, isStreamable(""))
+	assert.True(t, isStreamable("FTP"))
+	assert.True(t, isStreamable("https"))
+	assert.False(t, isStreamable("rsync"))
+}
+
+func TestStreamObjectETag(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.bucket = "czbiohub-ncbi-store"
+	tmp := openRemote
+	openRemote = FakeOpenRemote
+	defer func() { openRemote = tmp }()
+
+	testServer.Response(200, map[string]string{"ETag": "\"de5949721e6352f01dfef317c3e898a8\""}, "")
+	_, err := streamObject(ctx, "/pub/kiwi", "pub/kiwi")
+	assert.Nil(t, err)
+	testServer.WaitRequest()
+
+	// A corrupted upload is removed by version so the previous one stays.
+	testServer.Response(200, map[string]string{"ETag": "\"0123\"", "x-amz-version-id": "v2"}, "")
+	testServer.Response(204, nil, "")
+	_, err = streamObject(ctx, "/pub/kiwi", "pub/kiwi")
+	assert.NotNil(t, err)
+	reqs := testServer.WaitRequests(2)
+	assert.Equal(t, "DELETE", reqs[1].Method)
+	assert.Equal(t, "v2", reqs[1].URL.Query().Get("versionId"))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Kinds of file differences between two points in time.
+const (
+	fileAdded   = "added"
+	fileRemoved = "removed"
+	fileChanged = "changed"
+)
+
+// A fileDiff represents a file that differs between two points in time. Old
+// fields are empty for added files and new fields for removed files.
+type fileDiff struct {
+	Change     string `json:"change"`
+	Path       string `json:"path"`
+	OldVersion int    `json:"oldVersion,omitempty"`
+	NewVersion int    `json:"newVersion,omitempty"`
+	OldSize    int    `json:"oldSize,omitempty"`
+	NewSize    int    `json:"newSize,omitempty"`
+	OldModTime string `json:"oldModTime,omitempty"`
+	NewModTime string `json:"newModTime,omitempty"`
+}
+
+// parsePoint parses a point in time given as a date, a time, or the id of a
+// finished sync run. Runs stand for the time they ended.
+func parsePoint(ctx *context, str string) (time.Time, error) {
+	if t, err := parseAsOf(str); err == nil {
+		return t, nil
+	}
+	t, err := dbRunEnd(ctx, str)
+	if err != nil {
+		return t, handle("Not a date or run id: "+str, err)
+	}
+	return t, nil
+}
+
+// dbRunEnd gets the end time of a sync run.
+func dbRunEnd(ctx *context, runId string) (time.Time, error) {
+	var ended sql.NullString
+	err := ctx.db.QueryRow("select DateEnded from sync_runs where RunId=?",
+		runId).Scan(&ended)
+	switch {
+	case err == sql.ErrNoRows:
+		return time.Time{}, errors.New("no run " + runId)
+	case err != nil:
+		return time.Time{}, handle("Error in querying runs.", err)
+	case !ended.Valid:
+		return time.Time{}, errors.New("run " + runId + " hasn't ended")
+	}
+	return parseDbTime(ended.String)
+}
+
+// diffTree compares the versions of the files under a path at two points in
+// time. Uses only the history in the entries table. Returns the differences
+// ordered by path.
+func diffTree(ctx *context, path string, from time.Time,
+	to time.Time) ([]fileDiff, error) {
+	res := []fileDiff{}
+	before, err := versionsAsOf(ctx, path, from)
+	if err != nil {
+		return res, handle("Error in getting versions as of "+
+			from.Format(time.RFC3339), err)
+	}
+	after, err := versionsAsOf(ctx, path, to)
+	if err != nil {
+		return res, handle("Error in getting versions as of "+
+			to.Format(time.RFC3339), err)
+	}
+
+	old := make(map[string]entry)
+	cur := make(map[string]entry)
+	all := make(map[string]int)
+	for _, e := range before {
+		old[e.pathName] = e
+		all[e.pathName] = 0
+	}
+	for _, e := range after {
+		cur[e.pathName] = e
+		all[e.pathName] = 0
+	}
+	for _, file := range sortedKeys(all) {
+		o, inOld := old[file]
+		n, inNew := cur[file]
+		d := fileDiff{Path: file}
+		switch {
+		case !inOld:
+			d.Change = fileAdded
+		case !inNew:
+			d.Change = fileRemoved
+		case o.versionNum != n.versionNum:
+			d.Change = fileChanged
+		default:
+			continue
+		}
+		if inOld {
+			d.OldVersion, d.OldSize, d.OldModTime = o.versionNum, o.size,
+				o.modTime
+		}
+		if inNew {
+			d.NewVersion, d.NewSize, d.NewModTime = n.versionNum, n.size,
+				n.modTime
+		}
+		res = append(res, d)
+	}
+	return res, nil
+}
+
+// formatFileDiff formats a difference as a tab-separated line of the change,
+// path, old and new versions, sizes, and modified times.
+func formatFileDiff(d fileDiff) string {
+	version := func(num int) string {
+		if num == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("v%d", num)
+	}
+	orDash := func(str string) string {
+		if str == "" {
+			return "-"
+		}
+		return str
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s", d.Change, d.Path,
+		version(d.OldVersion), version(d.NewVersion), d.OldSize, d.NewSize,
+		orDash(d.OldModTime), orDash(d.NewModTime))
+}
+
+// runDiff is the diff command. Lists the files under a path that were added,
+// removed, or changed between two dates or runs.
+func runDiff(ctx *context, args []string) error {
+	flags, name := newFlagSet("diff")
+	path := flags.String("path", "/", "Path of the tree to compare. "+
+		"Ex: /pub/taxonomy")
+	from := flags.String("from", "", "Date, time, or run id to compare from.")
+	to := flags.String("to", "", "Date, time, or run id to compare to. "+
+		"Defaults to now.")
+	if err := flags.Parse(args); err != nil {
+		return handle("Error in parsing flags.", err)
+	}
+	srcCtx, err := contextForSource(ctx, *name)
+	if err != nil {
+		return handle("Error in finding source.", err)
+	}
+	diffs, err := diffPoints(srcCtx, *path, *from, *to)
+	if err != nil {
+		return err
+	}
+	for _, d := range diffs {
+		fmt.Println(formatFileDiff(d))
+	}
+	return nil
+}
+
+// diffPoints parses two points in time and compares the tree under a path
+// between them. The end defaults to now.
+func diffPoints(ctx *context, path string, from string,
+	to string) ([]fileDiff, error) {
+	if from == "" {
+		return nil, errors.New("Set a date or run id to compare from.")
+	}
+	start, err := parsePoint(ctx, from)
+	if err != nil {
+		return nil, handle("Error in parsing start.", err)
+	}
+	end := now().UTC()
+	if to != "" {
+		if end, err = parsePoint(ctx, to); err != nil {
+			return nil, handle("Error in parsing end.", err)
+		}
+	}
+	return diffTree(ctx, path, start, end)
+}
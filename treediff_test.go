@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// expectTaxonomyHistory queues the entries history of /pub/taxonomy once.
+func expectTaxonomyHistory(mock sqlmock.Sqlmock) {
+	rows := sqlmock.NewRows([]string{"PathName", "VersionNum", "DateModified", "ArchiveKey", "VersionId", "Size", "Md5", "Sha256"}).
+		AddRow("/pub/taxonomy/a", 1, "2017-07-01 10:00:00", "archive/a1", nil, 10, nil, nil).
+		AddRow("/pub/taxonomy/a", 2, "2017-08-10 10:00:00", nil, nil, 12, nil, nil).
+		AddRow("/pub/taxonomy/b", 1, "2017-07-01 10:00:00", nil, nil, 5, nil, nil).
+		AddRow("/pub/taxonomy/c", 1, "2017-08-20 10:00:00", nil, nil, 7, nil, nil)
+	mock.ExpectQuery("select PathName, VersionNum").WithArgs("/pub/taxonomy", "/pub/taxonomy/%").WillReturnRows(rows)
+}
+
+func TestDiffTree(t *testing.T) {
+	mock, ctx := testSetup(t)
+	expectTaxonomyHistory(mock)
+	expectTaxonomyHistory(mock)
+	from := time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+	res, err := diffTree(ctx, "/pub/taxonomy", from, to)
+	assert.Nil(t, err)
+	assert.Equal(t, []fileDiff{
+		{fileChanged, "/pub/taxonomy/a", 1, 2, 10, 12, "2017-07-01 10:00:00", "2017-08-10 10:00:00"},
+		{Change: fileAdded, Path: "/pub/taxonomy/c", NewVersion: 1, NewSize: 7, NewModTime: "2017-08-20 10:00:00"},
+	}, res)
+	assert.Equal(t, "added\t/pub/taxonomy/c\t-\tv1\t0\t7\t-\t2017-08-20 10:00:00", formatFileDiff(res[1]))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestParsePoint(t *testing.T) {
+	mock, ctx := testSetup(t)
+	res, err := parsePoint(ctx, "2017-08-04")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2017, 8, 4, 23, 59, 59, 0, time.UTC), res)
+
+	rows := sqlmock.NewRows([]string{"DateEnded"}).AddRow("2017-08-04 23:00:00")
+	mock.ExpectQuery("select DateEnded from sync_runs").WithArgs("ncbi-20170804T220841Z").WillReturnRows(rows)
+	res, err = parsePoint(ctx, "ncbi-20170804T220841Z")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2017, 8, 4, 23, 0, 0, 0, time.UTC), res)
+
+	rows = sqlmock.NewRows([]string{"DateEnded"}).AddRow(nil)
+	mock.ExpectQuery("select DateEnded from sync_runs").WithArgs("running").WillReturnRows(rows)
+	_, err = parsePoint(ctx, "running")
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestHandleDiff(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.server = "ftp.ncbi.nih.gov"
+	expectTaxonomyHistory(mock)
+	expectTaxonomyHistory(mock)
+	req := httptest.NewRequest("GET", "/diff?path=/pub/taxonomy&from=2017-08-01&to=2017-08-15", nil)
+	rec := httptest.NewRecorder()
+	apiHandler(ctx).ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+	res := []fileDiff{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, "/pub/taxonomy/a", res[0].Path)
+	assert.Equal(t, 2, res[0].NewVersion)
+
+	rec = httptest.NewRecorder()
+	apiHandler(ctx).ServeHTTP(rec, httptest.NewRequest("GET", "/diff?path=/pub", nil))
+	assert.Equal(t, 400, rec.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
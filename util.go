@@ -135,3 +135,25 @@ func errOut(input string, err error) {
 	log.Printf("[error] in %s[%s:%d] %s", runtime.FuncForPC(pc).Name(),
 		fn, line, input)
 }
+
+// A rollback holds compensating actions for the completed steps of an
+// operation. They are run in reverse order if a later step fails.
+type rollback struct {
+	names []string
+	undo  []func() error
+}
+
+// add registers the compensating action for a completed step.
+func (r *rollback) add(name string, undo func() error) {
+	r.names = append(r.names, name)
+	r.undo = append(r.undo, undo)
+}
+
+// run runs the compensating actions, latest first. Failures are logged and
+// the remaining actions still run.
+func (r *rollback) run() {
+	for i := len(r.undo) - 1; i >= 0; i-- {
+		log.Print("Rolling back: " + r.names[i])
+		errOut("Error in rolling back "+r.names[i], r.undo[i]())
+	}
+}
@@ -43,3 +43,22 @@ func TestCommandWithOutputFunc(t *testing.T) {
 	assert.Equal(t, "+ echo 'testing!'\n", stderr)
 	assert.Nil(t, err)
 }
+
+func TestRollback(t *testing.T) {
+	undone := []string{}
+	r := rollback{}
+	r.add("first", func() error {
+		undone = append(undone, "first")
+		return nil
+	})
+	r.add("second", func() error {
+		undone = append(undone, "second")
+		return errors.New("This SHOULD error")
+	})
+	r.add("third", func() error {
+		undone = append(undone, "third")
+		return nil
+	})
+	r.run()
+	assert.Equal(t, []string{"third", "second", "first"}, undone)
+}
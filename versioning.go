@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"log"
+)
+
+// checkBucketVersioning checks that versioning is enabled on the bucket of
+// the current source. Old versions would be lost otherwise.
+func checkBucketVersioning(ctx *context) error {
+	input := &s3.GetBucketVersioningInput{Bucket: aws.String(ctx.bucket)}
+	output, err := ctx.svcS3.GetBucketVersioning(input)
+	if err != nil {
+		return handle("Error in getting bucket versioning status.", err)
+	}
+	if output.Status == nil ||
+		*output.Status != s3.BucketVersioningStatusEnabled {
+		err = errors.New("versioning is not enabled on " + ctx.bucket)
+		return handle("Bucket can't be used in versioning mode.", err)
+	}
+	return err
+}
+
+// runMigrateVersioning is the migrate-versioning command. Converts copies
+// archived under the key layout into noncurrent S3 versions of the current
+// keys, so that a source can switch to versioning mode.
+func runMigrateVersioning(ctx *context, args []string) error {
+	flags, name := newFlagSet("migrate-versioning")
+	deleteOld := flags.Bool("delete", false, "Delete the old archived copies "+
+		"after migrating.")
+	dryRun := flags.Bool("dry", false, "Only log what would be done.")
+	if err := flags.Parse(args); err != nil {
+		return handle("Error in parsing flags.", err)
+	}
+	srcCtx, err := contextForSource(ctx, *name)
+	if err != nil {
+		return handle("Error in finding source.", err)
+	}
+	if err = checkBucketVersioning(srcCtx); err != nil {
+		return handle("Enable bucket versioning before migrating.", err)
+	}
+	return migrateToVersioning(srcCtx, *deleteOld, *dryRun)
+}
+
+// migrateToVersioning migrates the archived entries of every file of the
+// current source. Archived copies are copied onto the current key oldest
+// first, then the current copy is restored on top. Files deleted on the
+// remote get a delete marker. Readers may see an older copy of a file while
+// it is migrated, so run this between syncs.
+func migrateToVersioning(ctx *context, deleteOld bool, dryRun bool) error {
+	entries, err := dbEntries(ctx, "/")
+	if err != nil {
+		return handle("Error in getting entries to migrate.", err)
+	}
+	byFile := make(map[string][]entry)
+	files := []string{}
+	for _, e := range entries {
+		if folderOf(ctx, e.pathName).sourcePath == "" {
+			continue // Not part of this source
+		}
+		if _, present := byFile[e.pathName]; !present {
+			files = append(files, e.pathName)
+		}
+		byFile[e.pathName] = append(byFile[e.pathName], e)
+	}
+
+	failed := 0
+	for _, file := range files {
+		if err = migrateFile(ctx, file, byFile[file], deleteOld,
+			dryRun); err != nil {
+			errOut("Error in migrating "+file, err)
+			failed++
+		}
+	}
+	log.Printf("Migrated %d files with %d failures.", len(files)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d files failed to migrate", failed)
+	}
+	return nil
+}
+
+// migrateFile migrates the archived versions of one file. Versions must be
+// ordered oldest first. The VersionId of the current copy is recorded before
+// archived versions are copied over it. The current copy is put back if a
+// step fails, or by a later run if the restore itself failed.
+func migrateFile(ctx *context, file string, versions []entry, deleteOld bool,
+	dryRun bool) error {
+	key := objectKey(ctx, file)
+	var current *entry
+	toMigrate := []entry{}
+	for i, e := range versions {
+		if e.archiveKey == "" {
+			current = &versions[i]
+		} else if e.versionId == "" {
+			toMigrate = append(toMigrate, e)
+		}
+	}
+	if len(toMigrate) == 0 {
+		if current == nil || current.versionId == "" || dryRun {
+			return nil
+		}
+		return checkCurrentCopy(ctx, file, key, current)
+	}
+	log.Printf("Migrating %d archived versions of %s.", len(toMigrate), file)
+	if dryRun {
+		return nil
+	}
+
+	// Remember the current copy before it gets overwritten.
+	currentSize := 0
+	if current != nil {
+		output, err := ctx.svcS3.HeadObject(versionInput(ctx, key,
+			current.versionId))
+		if err != nil {
+			return handle("Error in getting current copy.", err)
+		}
+		currentSize = int(aws.Int64Value(output.ContentLength))
+		if current.versionId == "" {
+			current.versionId = aws.StringValue(output.VersionId)
+			err = dbSetVersionId(ctx, file, current.versionNum,
+				current.versionId)
+			if err != nil {
+				return handle("Error in recording VersionId.", err)
+			}
+		}
+	}
+
+	var err error
+	undo := rollback{}
+	defer func() {
+		if err != nil {
+			undo.run()
+		}
+	}()
+	for i, e := range toMigrate {
+		archived := resolveArchiveKey(ctx, e.archiveKey)
+		var size int
+		size, err = fileSizeOnS3(ctx, archived, ctx.svcS3)
+		if err != nil {
+			return handle("Error in getting archived copy size.", err)
+		}
+		var id string
+		id, err = copyObjectS3(ctx, archived, "", key, size)
+		if err != nil {
+			return handle("Error in copying archived version.", err)
+		}
+		if i == 0 {
+			undo.add("restore current copy", func() error {
+				return restoreCurrentCopy(ctx, file, key, current,
+					currentSize)
+			})
+		}
+		if err = dbArchiveFile(ctx, file, key, e.versionNum); err != nil {
+			return handle("Error in archiving file in db", err)
+		}
+		if err = dbSetVersionId(ctx, file, e.versionNum, id); err != nil {
+			return handle("Error in recording VersionId.", err)
+		}
+	}
+	if err = restoreCurrentCopy(ctx, file, key, current,
+		currentSize); err != nil {
+		return err
+	}
+
+	if !deleteOld {
+		return nil
+	}
+	for _, e := range toMigrate {
+		if err := deleteObject(ctx, resolveArchiveKey(ctx, e.archiveKey)); err != nil {
+			errOut("Error in deleting old archived copy", err)
+		}
+	}
+	return nil
+}
+
+// checkCurrentCopy puts back the current copy of a file if an earlier
+// migration left an archived version in its place.
+func checkCurrentCopy(ctx *context, file string, key string,
+	current *entry) error {
+	output, err := ctx.svcS3.HeadObject(versionInput(ctx, key, ""))
+	if err != nil {
+		return handle("Error in getting current copy.", err)
+	}
+	if aws.StringValue(output.VersionId) == current.versionId {
+		return err
+	}
+	log.Printf("Restoring current copy of %s left by an earlier migration.",
+		file)
+	output, err = ctx.svcS3.HeadObject(versionInput(ctx, key,
+		current.versionId))
+	if err != nil {
+		return handle("Error in getting recorded current copy.", err)
+	}
+	return restoreCurrentCopy(ctx, file, key, current,
+		int(aws.Int64Value(output.ContentLength)))
+}
+
+// restoreCurrentCopy copies the recorded current version of a file back over
+// its key, or adds a delete marker if the file has no current version.
+func restoreCurrentCopy(ctx *context, file string, key string, current *entry,
+	size int) error {
+	if current == nil {
+		if err := deleteObject(ctx, key); err != nil {
+			return handle("Error in adding delete marker.", err)
+		}
+		return nil
+	}
+	id, err := copyObjectS3(ctx, key, current.versionId, key, size)
+	if err != nil {
+		return handle("Error in restoring current copy.", err)
+	}
+	if err = dbSetVersionId(ctx, file, current.versionNum, id); err != nil {
+		return handle("Error in recording VersionId.", err)
+	}
+	return err
+}
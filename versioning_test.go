@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/AdRoll/goamz/testutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCheckBucketVersioning(t *testing.T) {
+	_, ctx := testSetup(t)
+	ctx.bucket = "czbiohub-ncbi-store"
+	body := "<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>"
+	testServer.Response(200, nil, body)
+	assert.Nil(t, checkBucketVersioning(ctx))
+
+	testServer.Response(200, nil, "<VersioningConfiguration></VersioningConfiguration>")
+	assert.NotNil(t, checkBucketVersioning(ctx))
+}
+
+func TestMigrateFile(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.bucket = "czbiohub-ncbi-store"
+	file := "/pub/taxonomy/taxdump.tar.gz"
+	versions := []entry{
+		{file, 1, "", "0123456789abcdef0123456789abcdef", "", 0, "", ""},
+		{file, 2, "", "", "", 0, "", ""},
+	}
+	testServer.Response(200, map[string]string{"x-amz-version-id": "cur", "Content-Length": "12"}, "")
+	testServer.Response(200, map[string]string{"Content-Length": "10"}, "")
+	expectCompletedCopy(testServer, "v1")
+	expectCompletedCopy(testServer, "v2")
+	key := "pub/taxonomy/taxdump.tar.gz"
+	mock.ExpectExec("update entries set VersionId").WithArgs("cur", file, 2).WillReturnResult(testResult)
+	mock.ExpectExec("update entries set ArchiveKey").WithArgs(key, file, 1).WillReturnResult(testResult)
+	mock.ExpectExec("update entries set VersionId").WithArgs("v1", file, 1).WillReturnResult(testResult)
+	mock.ExpectExec("update entries set VersionId").WithArgs("v2", file, 2).WillReturnResult(testResult)
+
+	err := migrateFile(ctx, file, versions, false, false)
+	assert.Nil(t, err)
+	reqs := testServer.WaitRequests(10)
+	assert.Equal(t, "czbiohub-ncbi-store/archive/0123456789abcdef0123456789abcdef",
+		reqs[4].Header.Get("X-Amz-Copy-Source"))
+	assert.Equal(t, "bytes=0-9", reqs[4].Header.Get("X-Amz-Copy-Source-Range"))
+	assert.Equal(t, "czbiohub-ncbi-store/pub/taxonomy/taxdump.tar.gz?versionId=cur",
+		reqs[8].Header.Get("X-Amz-Copy-Source"))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrateFileRollback(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.bucket = "czbiohub-ncbi-store"
+	file := "/pub/taxonomy/taxdump.tar.gz"
+	versions := []entry{
+		{file, 1, "", "0123456789abcdef0123456789abcdef", "", 0, "", ""},
+		{file, 2, "", "fedcba9876543210fedcba9876543210", "", 0, "", ""},
+		{file, 3, "", "", "", 0, "", ""},
+	}
+	testServer.Response(200, map[string]string{"x-amz-version-id": "cur", "Content-Length": "12"}, "")
+	testServer.Response(200, map[string]string{"Content-Length": "10"}, "")
+	expectCompletedCopy(testServer, "v1")
+	testServer.Response(404, nil, "")
+	expectCompletedCopy(testServer, "v3")
+	key := "pub/taxonomy/taxdump.tar.gz"
+	mock.ExpectExec("update entries set VersionId").WithArgs("cur", file, 3).WillReturnResult(testResult)
+	mock.ExpectExec("update entries set ArchiveKey").WithArgs(key, file, 1).WillReturnResult(testResult)
+	mock.ExpectExec("update entries set VersionId").WithArgs("v1", file, 1).WillReturnResult(testResult)
+	mock.ExpectExec("update entries set VersionId").WithArgs("v3", file, 3).WillReturnResult(testResult)
+
+	// The current copy is put back when a later version fails.
+	err := migrateFile(ctx, file, versions, false, false)
+	assert.NotNil(t, err)
+	reqs := testServer.WaitRequests(11)
+	assert.Equal(t, "czbiohub-ncbi-store/pub/taxonomy/taxdump.tar.gz?versionId=cur",
+		reqs[9].Header.Get("X-Amz-Copy-Source"))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrateFileRerun(t *testing.T) {
+	mock, ctx := testSetup(t)
+	ctx.bucket = "czbiohub-ncbi-store"
+	file := "/pub/taxonomy/taxdump.tar.gz"
+	key := "pub/taxonomy/taxdump.tar.gz"
+	versions := []entry{
+		{file, 1, "", key, "v1", 0, "", ""},
+		{file, 2, "", "", "cur", 0, "", ""},
+	}
+
+	// Nothing to do when the recorded copy is current.
+	testServer.Response(200, map[string]string{"x-amz-version-id": "cur"}, "")
+	assert.Nil(t, migrateFile(ctx, file, versions, false, false))
+	testServer.WaitRequest()
+
+	// An archived version left over the key is replaced.
+	testServer.Response(200, map[string]string{"x-amz-version-id": "v1"}, "")
+	testServer.Response(200, map[string]string{"x-amz-version-id": "cur", "Content-Length": "12"}, "")
+	expectCompletedCopy(testServer, "v3")
+	mock.ExpectExec("update entries set VersionId").WithArgs("v3", file, 2).WillReturnResult(testResult)
+	assert.Nil(t, migrateFile(ctx, file, versions, false, false))
+	reqs := testServer.WaitRequests(6)
+	assert.Equal(t, "cur", reqs[1].URL.Query().Get("versionId"))
+	assert.Equal(t, "czbiohub-ncbi-store/pub/taxonomy/taxdump.tar.gz?versionId=cur",
+		reqs[4].Header.Get("X-Amz-Copy-Source"))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+// expectCompletedCopy queues responses for a one part copy that creates a
+// new object version.
+func expectCompletedCopy(server *testutil.HTTPServer, versionId string) {
+	server.Response(200, nil, "")
+	server.Response(200, nil, initiatedUpload)
+	server.Response(200, nil, "<CopyPartResult><ETag>\"p\"</ETag></CopyPartResult>")
+	server.Response(200, map[string]string{"x-amz-version-id": versionId},
+		"<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+}